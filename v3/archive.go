@@ -0,0 +1,65 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"time"
+)
+
+// An ArchiveWriter adds the downloaded files of Requests set via
+// Request.SetArchive as entries to an archive, such as a zip or tar file.
+//
+// A Client serializes all calls to an ArchiveWriter, so it need not be safe for
+// concurrent use, but it must not be used by any other Client or goroutine
+// while transfers are in progress.
+type ArchiveWriter interface {
+	// CreateEntry adds an entry with the given name, size and modification time
+	// to the archive and returns a writer for its content. The content of the
+	// entry is written in full before CreateEntry is called again.
+	CreateEntry(name string, size int64, modTime time.Time) (io.Writer, error)
+}
+
+// NewZipArchiveWriter returns an ArchiveWriter that adds deflated entries to
+// the given zip.Writer. The caller remains responsible for closing w once all
+// transfers are complete.
+func NewZipArchiveWriter(w *zip.Writer) ArchiveWriter {
+	return zipArchiveWriter{w}
+}
+
+type zipArchiveWriter struct {
+	w *zip.Writer
+}
+
+func (a zipArchiveWriter) CreateEntry(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return a.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+}
+
+// NewTarArchiveWriter returns an ArchiveWriter that adds regular file entries
+// to the given tar.Writer. The caller remains responsible for closing w once
+// all transfers are complete.
+func NewTarArchiveWriter(w *tar.Writer) ArchiveWriter {
+	return tarArchiveWriter{w}
+}
+
+type tarArchiveWriter struct {
+	w *tar.Writer
+}
+
+func (a tarArchiveWriter) CreateEntry(name string, size int64, modTime time.Time) (io.Writer, error) {
+	err := a.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.w, nil
+}
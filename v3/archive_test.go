@@ -0,0 +1,124 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+// TestSetArchive tests that a batch of downloads is written as entries to a
+// single archive, excluding downloads that fail checksum validation.
+func TestSetArchive(t *testing.T) {
+	size := 4096
+	tests := []struct {
+		Name string
+		New  func(w io.Writer) (ArchiveWriter, io.Closer)
+		Read func(t *testing.T, b []byte) map[string][]byte
+	}{
+		{
+			Name: "Zip",
+			New: func(w io.Writer) (ArchiveWriter, io.Closer) {
+				zw := zip.NewWriter(w)
+				return NewZipArchiveWriter(zw), zw
+			},
+			Read: func(t *testing.T, b []byte) map[string][]byte {
+				zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries := make(map[string][]byte)
+				for _, f := range zr.File {
+					r, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					entries[f.Name], err = ioutil.ReadAll(r)
+					r.Close()
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				return entries
+			},
+		},
+		{
+			Name: "Tar",
+			New: func(w io.Writer) (ArchiveWriter, io.Closer) {
+				tw := tar.NewWriter(w)
+				return NewTarArchiveWriter(tw), tw
+			},
+			Read: func(t *testing.T, b []byte) map[string][]byte {
+				tr := tar.NewReader(bytes.NewReader(b))
+				entries := make(map[string][]byte)
+				for {
+					hdr, err := tr.Next()
+					if err == io.EOF {
+						return entries
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if entries[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				var buf bytes.Buffer
+				aw, closer := test.New(&buf)
+				reqs := make([]*Request, 8)
+				for i := range reqs {
+					reqs[i] = mustNewRequest("", fmt.Sprintf("%s/file%d", url, i))
+					reqs[i].SetArchive(aw, fmt.Sprintf("dir/file%d", i))
+				}
+				reqs[0].SetArchive(aw, "") // named after the resolved filename
+				reqs[1].SetChecksum(sha256.New(), make([]byte, sha256.Size), false)
+				for resp := range DefaultClient.DoBatch(4, reqs...) {
+					if err := resp.Err(); resp.Request.URL().Path == "/file1" {
+						if err != ErrBadChecksum {
+							t.Errorf("expected ErrBadChecksum, got %v", err)
+						}
+					} else if err != nil {
+						t.Errorf("unexpected error: %v", err)
+					}
+				}
+				if err := closer.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				entries := test.Read(t, buf.Bytes())
+				if len(entries) != len(reqs)-1 {
+					t.Errorf("expected %d entries, got %d", len(reqs)-1, len(entries))
+				}
+				if _, ok := entries["dir/file1"]; ok {
+					t.Errorf("expected no entry for download with bad checksum")
+				}
+				for name, b := range entries {
+					if name != "file0" && !strings.HasPrefix(name, "dir/") {
+						t.Errorf("unexpected entry: %s", name)
+					}
+					if len(b) != size {
+						t.Fatalf("%s: expected %d bytes, got %d", name, size, len(b))
+					}
+					for i := range b {
+						if b[i] != byte(i) {
+							t.Fatalf("%s: expected byte %d to be %d, got %d", name, i, byte(i), b[i])
+						}
+					}
+				}
+			}, grabtest.ContentLength(size))
+		})
+	}
+}
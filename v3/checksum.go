@@ -0,0 +1,174 @@
+package grab
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+)
+
+// sriAlgorithms are the hash algorithms of Subresource Integrity metadata, in
+// order of increasing strength.
+var sriAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha384", sha512.New384},
+	{"sha512", sha512.New},
+}
+
+// parseSRI returns a new hash and the expected checksum of the strongest
+// supported algorithm in the given Subresource Integrity metadata, such as
+// "sha384-<base64>". Multiple space separated values are allowed and any
+// options following a "?" are ignored, as described by the W3C specification.
+func parseSRI(integrity string) (hash.Hash, []byte, error) {
+	best := -1
+	var sum []byte
+	for _, value := range strings.Fields(integrity) {
+		i := strings.Index(value, "-")
+		if i < 0 {
+			return nil, nil, fmt.Errorf("invalid integrity metadata: %q", value)
+		}
+		algo := -1
+		for j, a := range sriAlgorithms {
+			if strings.EqualFold(value[:i], a.name) {
+				algo = j
+				break
+			}
+		}
+		if algo < 0 {
+			// unsupported algorithms are ignored
+			continue
+		}
+		digest := value[i+1:]
+		if j := strings.Index(digest, "?"); j >= 0 {
+			digest = digest[:j]
+		}
+		b, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			b, err = base64.RawStdEncoding.DecodeString(digest)
+		}
+		if err != nil || len(b) != sriAlgorithms[algo].new().Size() {
+			return nil, nil, fmt.Errorf("invalid %s digest: %q", sriAlgorithms[algo].name, digest)
+		}
+		if algo > best {
+			best, sum = algo, b
+		}
+	}
+	if best < 0 {
+		return nil, nil, fmt.Errorf("no supported algorithm in integrity metadata: %q", integrity)
+	}
+	return sriAlgorithms[best].new(), sum, nil
+}
+
+// multihashAlgorithms maps multihash function codes to their hash algorithms.
+var multihashAlgorithms = map[uint64]func() hash.Hash{
+	0x11: sha1.New,
+	0x12: sha256.New,
+	0x13: sha512.New,
+	0x20: sha512.New384,
+	0xd5: md5.New,
+}
+
+// cidRaw is the multicodec of a CID that addresses raw binary content.
+const cidRaw = 0x55
+
+// parseMultihash returns a new hash and the expected checksum of the given
+// multihash, which may be hex or base58btc encoded, or be given as a version 1
+// CID of raw content in base32 or base58btc.
+func parseMultihash(mh string) (hash.Hash, []byte, error) {
+	mh = strings.TrimSpace(mh)
+	b, err := decodeMultihashString(mh)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) > 0 && b[0] == 0x01 && (mh[0] == 'b' || mh[0] == 'z') {
+		// CIDv1: <version><codec><multihash>
+		codec, n := binary.Uvarint(b[1:])
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("invalid CID: %q", mh)
+		}
+		if codec != cidRaw {
+			return nil, nil, fmt.Errorf("unsupported CID codec 0x%x: %q", codec, mh)
+		}
+		b = b[1+n:]
+	}
+	code, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid multihash: %q", mh)
+	}
+	b = b[n:]
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) != size {
+		return nil, nil, fmt.Errorf("invalid multihash length: %q", mh)
+	}
+	f, ok := multihashAlgorithms[code]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported multihash function 0x%x: %q", code, mh)
+	}
+	h := f()
+	if int(size) != h.Size() {
+		return nil, nil, fmt.Errorf("invalid multihash length: %q", mh)
+	}
+	return h, b[n:], nil
+}
+
+// decodeMultihashString decodes a hex encoded multihash, a base58btc encoded
+// multihash, such as a version 0 CID, or a multibase encoded version 1 CID.
+func decodeMultihashString(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty multihash")
+	}
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	switch s[0] {
+	case 'b':
+		// multibase base32, lowercase without padding
+		enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+		if b, err := enc.DecodeString(strings.ToUpper(s[1:])); err == nil {
+			return b, nil
+		}
+	case 'z':
+		// multibase base58btc
+		if b, ok := decodeBase58(s[1:]); ok {
+			return b, nil
+		}
+	}
+	if b, ok := decodeBase58(s); ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("invalid multihash encoding: %q", s)
+}
+
+// base58Alphabet is the Bitcoin base58 alphabet used by multihash.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 decodes a base58btc encoded string.
+func decodeBase58(s string) ([]byte, bool) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base58Alphabet, s[i])
+		if d < 0 {
+			return nil, false
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
@@ -0,0 +1,141 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+// defaultHandlerSHA384 is the base64 encoded SHA-384 checksum of the content of
+// the default grabtest handler.
+const defaultHandlerSHA384 = "ng8AtyVcHCETaxxlLAkRdZfzEKDp7UkcJMUStKCyuHPttG8X9CtiHFsGNwWl2G5s"
+
+func TestParseSRI(t *testing.T) {
+	sha256Sum := base64.StdEncoding.EncodeToString(grabtest.DefaultHandlerSHA256ChecksumBytes)
+	tests := []struct {
+		Integrity string
+		Size      int
+		Err       bool
+	}{
+		{"sha384-" + defaultHandlerSHA384, sha512.Size384, false},
+		{"sha256-" + sha256Sum, sha256.Size, false},
+		{"SHA256-" + sha256Sum, sha256.Size, false},
+		{"sha256-" + sha256Sum + "?ct=application/octet-stream", sha256.Size, false},
+		{"sha256-" + sha256Sum + " sha384-" + defaultHandlerSHA384, sha512.Size384, false},
+		{"md5-abc sha256-" + sha256Sum, sha256.Size, false},
+		{"", 0, true},
+		{"sha384", 0, true},
+		{defaultHandlerSHA384, 0, true},
+		{"md5-1B2M2Y8AsgTpgAmY7PhCfg==", 0, true},
+		{"sha384-" + sha256Sum, 0, true},
+		{"sha384-not*base64", 0, true},
+	}
+	for _, test := range tests {
+		h, sum, err := parseSRI(test.Integrity)
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected error for %q", test.Integrity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.Integrity, err)
+			continue
+		}
+		if h.Size() != test.Size || len(sum) != test.Size {
+			t.Errorf("expected %d byte checksum for %q, got %d", test.Size, test.Integrity, len(sum))
+		}
+	}
+}
+
+func TestParseMultihash(t *testing.T) {
+	sha256Hex := grabtest.DefaultHandlerSHA256Checksum
+	tests := []struct {
+		Multihash string
+		Err       bool
+	}{
+		{"1220" + sha256Hex, false},
+		{"QmfHJA79wv8yRCAT6mWGMMdWMdpQqkqHwfqNs6NU9pjK22", false},
+		{"zQmfHJA79wv8yRCAT6mWGMMdWMdpQqkqHwfqNs6NU9pjK22", false},
+		{"bafkreih3xkzit57zjmsxg3cyxzdktfgeih6qevjmyybcguxd3bws7k34qm", false},
+		{"", true},
+		{"1220", true},
+		{"1221" + sha256Hex, true},
+		{"1320" + sha256Hex, true},
+		{"9920" + sha256Hex, true},
+		{"Qm0OIl", true},
+		{"bafybeih3xkzit57zjmsxg3cyxzdktfgeih6qevjmyybcguxd3bws7k34qm", true},
+	}
+	for _, test := range tests {
+		h, sum, err := parseMultihash(test.Multihash)
+		if test.Err {
+			if err == nil {
+				t.Errorf("expected error for %q", test.Multihash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.Multihash, err)
+			continue
+		}
+		if h.Size() != sha256.Size {
+			t.Errorf("expected sha256 hash for %q", test.Multihash)
+		}
+		if !bytes.Equal(sum, grabtest.DefaultHandlerSHA256ChecksumBytes) {
+			t.Errorf("unexpected checksum for %q: %x", test.Multihash, sum)
+		}
+	}
+}
+
+// TestSetChecksumSRI tests that downloads are validated against Subresource
+// Integrity metadata and multihashes.
+func TestSetChecksumSRI(t *testing.T) {
+	tests := []struct {
+		Name string
+		Set  func(req *Request) error
+		Err  error
+	}{
+		{"SRI", func(req *Request) error {
+			return req.SetChecksumSRI("sha384-"+defaultHandlerSHA384, false)
+		}, nil},
+		{"SRIMismatch", func(req *Request) error {
+			sum := base64.StdEncoding.EncodeToString(make([]byte, sha512.Size384))
+			return req.SetChecksumSRI("sha384-"+sum, false)
+		}, ErrBadChecksum},
+		{"Multihash", func(req *Request) error {
+			return req.SetChecksumMultihash("QmfHJA79wv8yRCAT6mWGMMdWMdpQqkqHwfqNs6NU9pjK22", false)
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				if err := test.Set(req); err != nil {
+					t.Fatal(err)
+				}
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Errorf("expected error %v, got %v", test.Err, err)
+				}
+			})
+		})
+	}
+
+	t.Run("Malformed", func(t *testing.T) {
+		req := mustNewRequest("", "http://example.com/file")
+		if err := req.SetChecksumSRI("sha384-", false); err == nil {
+			t.Errorf("expected error for malformed integrity metadata")
+		}
+		if err := req.SetChecksumMultihash("not a multihash", false); err == nil {
+			t.Errorf("expected error for malformed multihash")
+		}
+		if req.hash != nil {
+			t.Errorf("expected request not to be modified")
+		}
+	})
+}
@@ -1,13 +1,20 @@
 package grab
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +35,18 @@ type truncater interface {
 //
 // Clients are safe for concurrent use by multiple goroutines.
 type Client struct {
+	// bytesTransferred is the total number of bytes read from remote servers by
+	// all transfers of this client. Must be 64bit aligned on 386.
+	bytesTransferred int64
+
+	// closed is non-zero once Close or Shutdown has been called.
+	closed int32
+
+	// active is the set of transfers in progress, to be waited for by
+	// Shutdown.
+	activeMu sync.Mutex
+	active   map[*Response]struct{}
+
 	// HTTPClient specifies the http.Client which will be used for communicating
 	// with the remote server during the file transfer.
 	HTTPClient HTTPClient
@@ -38,12 +57,70 @@ type Client struct {
 	// The user agent string may be overridden in the headers of each request.
 	UserAgent string
 
+	// Header specifies default headers which will be set in all requests made
+	// by this client, such as authorization headers required by a particular
+	// service.
+	//
+	// Each header may be overridden in the headers of each request. Headers set
+	// by grab itself, such as Range, take precedence over both. The headers of
+	// a Request are never modified, so the same Request may be sent by clients
+	// with different defaults. Other defaults are set by UserAgent and
+	// BufferSize, which are likewise overridden by each Request.
+	Header http.Header
+
 	// BufferSize specifies the size in bytes of the buffer that is used for
 	// transferring all requested files. Larger buffers may result in faster
 	// throughput but will use more memory and result in less frequent updates
 	// to the transfer progress statistics. The BufferSize of each request can
 	// be overridden on each Request object. Default: 32KB.
 	BufferSize int
+
+	// Logger, if set, receives messages describing each stage of every
+	// transfer, such as each HTTP request sent and the decision to resume a
+	// partial download. It is useful for debugging failed transfers.
+	Logger Logger
+
+	// SingleFlight specifies that concurrent calls to Do with the same URL and
+	// destination should share a single file transfer, rather than racing to
+	// write to the same file. The first caller initiates the transfer and all
+	// other callers receive the same Response object once the transfer has
+	// started. Note that Response.Request therefore refers to the Request of the
+	// first caller.
+	SingleFlight bool
+
+	// MaxOpenTransfers specifies the maximum number of transfers this client
+	// may have in progress at once, across all calls to Do, DoChannel and
+	// DoBatch. Each transfer in progress holds open a connection to the remote
+	// server and, unless Request.NoStore is set, a destination file. Calls to
+	// Do will block until a transfer completes if the limit is reached. Zero
+	// means no limit.
+	//
+	// MaxOpenTransfers must not be modified after the first request is sent.
+	MaxOpenTransfers int
+
+	// ByteQuota specifies the maximum number of bytes this client may transfer
+	// from remote servers, across all of its transfers. Once the quota is
+	// reached, new transfers fail immediately with ErrQuotaExceeded. Transfers
+	// in progress when the quota is crossed are allowed to finish. Zero means
+	// no limit. See also BytesTransferred.
+	ByteQuota int64
+
+	// transferSem is a semaphore limiting the number of transfers in progress
+	// to MaxOpenTransfers.
+	transferSemOnce sync.Once
+	transferSem     chan struct{}
+
+	// inflight maps the URL and destination of each in-progress transfer to a
+	// *flight if SingleFlight is enabled.
+	inflightMu sync.Mutex
+	inflight   map[string]*flight
+
+	// archiveMu serializes writes to the ArchiveWriter of any Request.
+	archiveMu sync.Mutex
+
+	// bufferPools maps buffer sizes to a *sync.Pool of transfer buffers so
+	// they may be reused across transfers.
+	bufferPools sync.Map
 }
 
 // NewClient returns a new file download Client, using default configuration.
@@ -75,8 +152,115 @@ var DefaultClient = NewClient()
 // will block the caller until the transfer is completed, successfully or
 // otherwise.
 func (c *Client) Do(req *Request) *Response {
+	if c.SingleFlight {
+		return c.doOnce(req)
+	}
+	return c.do(req, nil)
+}
+
+// DoStream sends a file transfer request like Do, and additionally returns a
+// reader that yields the contents of the file as they are written to the
+// destination, including any bytes resumed from an existing partial file.
+//
+// The reader is backed by a buffer of Request.StreamBufferSize bytes, or 32KB
+// if not set. Unlike Do, StreamBufferSize does not imply NoStore. When the
+// buffer is full, the transfer waits for the consumer to read from it, so a
+// slow consumer slows down the transfer. Closing the reader discards any
+// unread data and does not cancel the transfer, which continues without a
+// consumer.
+//
+// Once the transfer is complete and validated, Read returns io.EOF, or the
+// error returned by Response.Err if the transfer failed.
+//
+// An error is returned if the transfer failed before it started transferring,
+// in which case the returned reader is nil. Client.SingleFlight does not apply
+// to DoStream.
+func (c *Client) DoStream(req *Request) (*Response, io.ReadCloser, error) {
+	r := *req
+	r.teeBufferSize = r.StreamBufferSize
+	if r.teeBufferSize < 1 {
+		r.teeBufferSize = 32 * 1024
+	}
+	r.StreamBufferSize = 0
+	resp := c.do(&r, nil)
+	select {
+	case <-resp.Done:
+		if err := resp.Err(); err != nil {
+			return resp, nil, err
+		}
+	default:
+	}
+	return resp, streamReader{resp.tee}, nil
+}
+
+// Pipe sends a file transfer request like Do, but writes the downloaded
+// content to dst as it is transferred, instead of storing it. Pipe implies
+// Request.NoStore, so Response.Open and Response.Bytes are unavailable and
+// nothing is written to the local file system.
+//
+// A checksum set via SetChecksum is computed as the content is written to dst
+// and validated once the transfer is complete. As the content has already been
+// written to dst by then, the caller should discard it if Response.Err returns
+// ErrBadChecksum. Like Request.StreamBufferSize, Pipe cannot be combined with
+// a Verifier or Request.ExtractDir, as the content cannot be read again.
+//
+// If a write to dst fails, the transfer is canceled and Response.Err returns
+// an error that wraps both ErrBadDestination and the error returned by dst.
+// Client.SingleFlight does not apply to Pipe.
+func (c *Client) Pipe(req *Request, dst io.Writer) *Response {
+	r := *req
+	r.pipe = dst
+	r.NoStore = true
+	r.StreamBufferSize = 0
+	return c.do(&r, nil)
+}
+
+// flight is a transfer shared by concurrent calls to Do when
+// Client.SingleFlight is enabled.
+type flight struct {
+	resp  *Response
+	ready chan struct{} // closed once the transfer has been initiated
+}
+
+// doOnce executes the given Request unless a transfer with the same URL and
+// destination is already in progress, in which case it waits for that transfer
+// to be initiated and returns its Response.
+func (c *Client) doOnce(req *Request) *Response {
+	key := req.URL().String()
+	if req.File != nil {
+		key += "\x00" + req.File.Name()
+	} else {
+		key += "\x00" + req.Filename
+	}
+
+	c.inflightMu.Lock()
+	if f, ok := c.inflight[key]; ok {
+		c.inflightMu.Unlock()
+		<-f.ready
+		return f.resp
+	}
+	if c.inflight == nil {
+		c.inflight = make(map[string]*flight)
+	}
+	f := &flight{ready: make(chan struct{})}
+	c.inflight[key] = f
+	c.inflightMu.Unlock()
+
+	f.resp = c.do(req, func() {
+		c.inflightMu.Lock()
+		delete(c.inflight, key)
+		c.inflightMu.Unlock()
+	})
+	close(f.ready)
+	return f.resp
+}
+
+// do executes the given Request and calls done, if not nil, once the transfer
+// has completed.
+func (c *Client) do(req *Request, done func()) *Response {
 	// cancel will be called on all code-paths via closeResponse
 	ctx, cancel := context.WithCancel(req.Context())
+	ctx = withRequestValues(ctx, req)
 	req = req.WithContext(ctx)
 	resp := &Response{
 		Request:    req,
@@ -87,22 +271,204 @@ func (c *Client) Do(req *Request) *Response {
 		cancel:     cancel,
 		bufferSize: req.BufferSize,
 	}
+	if req.ReadBufferSize > 0 {
+		resp.bufferSize = req.ReadBufferSize
+	}
 	if resp.bufferSize == 0 {
 		// default to Client.BufferSize
 		resp.bufferSize = c.BufferSize
 	}
+	if req.File != nil {
+		resp.Filename = req.File.Name()
+	}
+	if req.archive != nil {
+		// content is written to the archive once it has been validated
+		req.NoStore = true
+	}
+	if f := req.hashFactory; f != nil {
+		// never share a hash with other transfers of the same request
+		req.hash = f()
+	}
+	if req.pipe != nil && req.hash != nil && req.computeHash == nil {
+		// piped content cannot be read again to compute its checksum
+		req.computeHash = req.hash
+	}
+	if req.StreamBufferSize > 0 {
+		req.NoStore = true
+		resp.stream = newStreamBuffer(req.StreamBufferSize)
+		go func() {
+			// unblock the transfer and consumer if canceled
+			<-ctx.Done()
+			resp.stream.close(ctx.Err())
+		}()
+	}
+	if req.teeBufferSize > 0 {
+		resp.tee = newStreamBuffer(req.teeBufferSize)
+		go func() {
+			<-ctx.Done()
+			resp.tee.close(ctx.Err())
+		}()
+	}
+
+	// register the transfer, unless the client is closed
+	closed := !c.track(resp)
+
+	// wait for a free transfer slot, if limited
+	if sem := c.transferSemaphore(); sem != nil {
+		select {
+		case sem <- struct{}{}:
+			next := done
+			done = func() {
+				<-sem
+				if next != nil {
+					next()
+				}
+			}
+		case <-ctx.Done():
+			// the canceled context will close the response in c.run
+		}
+	}
 
 	// Run state-machine while caller is blocked to initialize the file transfer.
 	// Must never transition to the copyFile state - this happens next in another
 	// goroutine.
-	c.run(resp, c.statFileInfo)
+	start := c.statFileInfo
+	if req.ResolveVia != nil {
+		start = c.resolveVia
+	}
+	if closed {
+		resp.err = ErrClientClosed
+		start = c.closeResponse
+	} else if err := checkRequest(resp); err != nil {
+		resp.err = err
+		start = c.closeResponse
+	} else if c.ByteQuota > 0 && c.BytesTransferred() >= c.ByteQuota {
+		resp.err = ErrQuotaExceeded
+		start = c.closeResponse
+	}
+	c.run(resp, start)
 
 	// Run copyFile in a new goroutine. copyFile will no-op if the transfer is
 	// already complete or failed.
-	go c.run(resp, c.copyFile)
+	go func() {
+		c.run(resp, c.copyFile)
+		c.untrack(resp)
+		if done != nil {
+			done()
+		}
+	}()
 	return resp
 }
 
+// checkRequest returns ErrBadRequest if the Request of the given Response
+// combines options that cannot be used together.
+func checkRequest(resp *Response) error {
+	req := resp.Request
+	if req.NoStore && req.File != nil {
+		return ErrBadRequest
+	}
+	if resp.streamed() && (req.archive != nil || req.verifier != nil || req.ExtractDir != "" ||
+		req.hash != nil && req.hash != req.computeHash) {
+		// streamed content cannot be read again for validation
+		return ErrBadRequest
+	}
+	if req.WrapWriter != nil && (req.NoStore || req.File != nil || req.ResumeFrom > 0 || req.verifier != nil || req.ExtractDir != "" ||
+		req.computeHash != nil && req.hash != nil && req.hash != req.computeHash) {
+		// wrapped content cannot be resumed or read again for validation
+		return ErrBadRequest
+	}
+	return nil
+}
+
+// track registers the given transfer as in progress, so that Shutdown waits for
+// it. It returns false if the client is closed.
+func (c *Client) track(resp *Response) bool {
+	c.activeMu.Lock()
+	defer c.activeMu.Unlock()
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return false
+	}
+	if c.active == nil {
+		c.active = make(map[*Response]struct{})
+	}
+	c.active[resp] = struct{}{}
+	return true
+}
+
+// untrack removes the given transfer from the set of transfers in progress.
+func (c *Client) untrack(resp *Response) {
+	c.activeMu.Lock()
+	delete(c.active, resp)
+	c.activeMu.Unlock()
+}
+
+// Close releases the resources held by the client by closing any idle
+// connections of its HTTPClient, if it supports CloseIdleConnections. Once
+// closed, new transfers fail immediately with ErrClientClosed. Transfers in
+// progress are not canceled and their connections are closed once idle.
+//
+// DefaultClient is shared by all users of this package and should not be
+// closed.
+func (c *Client) Close() error {
+	c.activeMu.Lock()
+	atomic.StoreInt32(&c.closed, 1)
+	c.activeMu.Unlock()
+	if hc, ok := c.HTTPClient.(interface{ CloseIdleConnections() }); ok {
+		hc.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the client. New transfers fail immediately
+// with ErrClientClosed, while transfers in progress are allowed to finish
+// until ctx is done. Any transfers still in progress are then canceled and
+// Shutdown waits for them to close their destination files, including any
+// buffered writes, so that they may be resumed by another client after a
+// restart. Once all transfers are closed, idle connections are closed as by
+// Close.
+//
+// Shutdown returns nil if all transfers finished, or the error of ctx if any
+// were canceled.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.activeMu.Lock()
+	atomic.StoreInt32(&c.closed, 1)
+	active := make([]*Response, 0, len(c.active))
+	for resp := range c.active {
+		active = append(active, resp)
+	}
+	c.activeMu.Unlock()
+
+	var err error
+	for _, resp := range active {
+		select {
+		case <-resp.Done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			resp.Cancel()
+		}
+	}
+	c.Close()
+	return err
+}
+
+// BytesTransferred returns the total number of bytes this client has
+// transferred from remote servers, across all of its transfers, including those
+// in progress. Bytes resumed from existing files are not included.
+func (c *Client) BytesTransferred() int64 {
+	return atomic.LoadInt64(&c.bytesTransferred)
+}
+
+// transferSemaphore returns a semaphore limiting the number of transfers in
+// progress to Client.MaxOpenTransfers, or nil if there is no limit.
+func (c *Client) transferSemaphore() chan struct{} {
+	c.transferSemOnce.Do(func() {
+		if c.MaxOpenTransfers > 0 {
+			c.transferSem = make(chan struct{}, c.MaxOpenTransfers)
+		}
+	})
+	return c.transferSem
+}
+
 // DoChannel executes all requests sent through the given Request channel, one
 // at a time, until it is closed by another goroutine. The caller is blocked
 // until the Request channel is closed and all transfers have completed. All
@@ -118,14 +484,44 @@ func (c *Client) Do(req *Request) *Response {
 // If an error occurs during any of the file transfers it will be accessible via
 // the associated Response.Err function.
 func (c *Client) DoChannel(reqch <-chan *Request, respch chan<- *Response) {
+	c.doChannel(reqch, respch, nil)
+}
+
+// doChannel executes all requests sent through the given Request channel, one
+// at a time, waiting for the dependencies of each Request in the given batch to
+// complete before it is started.
+func (c *Client) doChannel(reqch <-chan *Request, respch chan<- *Response, batch batchDeps) {
 	// TODO: enable cancelling of batch jobs
 	for req := range reqch {
-		resp := c.Do(req)
+		var resp *Response
+		if err := batch.wait(req); err != nil {
+			resp = c.fail(req, err)
+		} else {
+			resp = c.Do(req)
+		}
 		respch <- resp
 		<-resp.Done
+		batch.finish(req, resp.Err())
 	}
 }
 
+// fail returns a completed Response for the given Request without sending it.
+func (c *Client) fail(req *Request, err error) *Response {
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	resp := &Response{
+		Request:  req,
+		Start:    time.Now(),
+		Done:     make(chan struct{}, 0),
+		Filename: req.Filename,
+		ctx:      ctx,
+		cancel:   cancel,
+		err:      err,
+	}
+	c.run(resp, c.closeResponse)
+	return resp
+}
+
 // DoBatch executes all the given requests using the given number of concurrent
 // workers. Control is passed back to the caller as soon as the workers are
 // initiated.
@@ -133,6 +529,24 @@ func (c *Client) DoChannel(reqch <-chan *Request, respch chan<- *Response) {
 // If the requested number of workers is less than one, a worker will be created
 // for every request. I.e. all requests will be executed concurrently.
 //
+// A Request that depends on others in the batch via Request.DependsOn is
+// started after the Requests it depends on, and only once they have completed
+// successfully. While it waits, it occupies a worker. Requests without
+// dependencies are unaffected.
+//
+// Each worker has at most one transfer in progress at a time, holding open one
+// connection to the remote server and one destination file. The number of
+// workers therefore bounds the number of file descriptors used by the batch,
+// while the returned Response channel is buffered to hold a Response for every
+// Request so that slow receivers never delay a transfer. To bound file
+// descriptor usage across all batches and other transfers of a Client, set
+// Client.MaxOpenTransfers.
+//
+// Requests are started in order of their Request.Priority, highest first, and
+// otherwise in the order they were given. As the batch is fixed when DoBatch
+// is called, a Request with a low Priority is delayed only by the finite number
+// of Requests in the batch with a higher Priority, and is never starved.
+//
 // If an error occurs during any of the file transfers it will be accessible via
 // call to the associated Response.Err.
 //
@@ -142,13 +556,18 @@ func (c *Client) DoBatch(workers int, requests ...*Request) <-chan *Response {
 	if workers < 1 {
 		workers = len(requests)
 	}
+	requests = sortByPriority(requests)
+	batch := newBatchDeps(requests)
+	if batch != nil {
+		requests = sortByDependency(requests, batch)
+	}
 	reqch := make(chan *Request, len(requests))
 	respch := make(chan *Response, len(requests))
 	wg := sync.WaitGroup{}
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			c.DoChannel(reqch, respch)
+			c.doChannel(reqch, respch, batch)
 			wg.Done()
 		}()
 	}
@@ -165,6 +584,206 @@ func (c *Client) DoBatch(workers int, requests ...*Request) <-chan *Response {
 	return respch
 }
 
+// DoBatchFailFast executes the given requests like DoBatch, but aborts the batch
+// as soon as any transfer fails. Transfers in progress are canceled, and
+// Requests that have not yet started are never sent and have no Response. The
+// batch is also aborted if ctx is canceled.
+//
+// The returned Response channel is closed once all started transfers have
+// completed. The returned function then reports the Response whose failure
+// aborted the batch, or nil if no transfer failed. Transfers canceled by the
+// abort fail with context.Canceled.
+func (c *Client) DoBatchFailFast(ctx context.Context, workers int, requests ...*Request) (<-chan *Response, func() *Response) {
+	if workers < 1 {
+		workers = len(requests)
+	}
+	requests = sortByPriority(requests)
+	ctx, cancel := context.WithCancel(ctx)
+	var mu sync.Mutex
+	var failed *Response
+	reqch := make(chan *Request)
+	respch := make(chan *Response, len(requests))
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range reqch {
+				// cancel the transfer if the batch is aborted
+				rctx, rcancel := context.WithCancel(req.Context())
+				go func() {
+					select {
+					case <-ctx.Done():
+						rcancel()
+					case <-rctx.Done():
+					}
+				}()
+				resp := c.Do(req.WithContext(rctx))
+				respch <- resp
+				if err := resp.Err(); err != nil {
+					mu.Lock()
+					if failed == nil && ctx.Err() == nil {
+						failed = resp
+						cancel()
+					}
+					mu.Unlock()
+				}
+				rcancel()
+			}
+		}()
+	}
+
+	// queue requests until the batch is aborted
+	go func() {
+	queue:
+		for _, req := range requests {
+			select {
+			case <-ctx.Done():
+				break queue
+			default:
+			}
+			select {
+			case reqch <- req:
+			case <-ctx.Done():
+				break queue
+			}
+		}
+		close(reqch)
+		wg.Wait()
+		cancel()
+		close(respch)
+	}()
+	return respch, func() *Response {
+		mu.Lock()
+		defer mu.Unlock()
+		return failed
+	}
+}
+
+// sortByPriority returns a copy of the given requests, sorted by their
+// Request.Priority, highest first, and otherwise in their given order.
+func sortByPriority(requests []*Request) []*Request {
+	requests = append([]*Request(nil), requests...)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Priority > requests[j].Priority
+	})
+	return requests
+}
+
+// batchDeps tracks the completion of the Requests of a batch that others
+// depend on.
+type batchDeps map[*Request]*batchDep
+
+// batchDep is the outcome of a Request in a batch.
+type batchDep struct {
+	done   chan struct{} // closed once the Request has completed
+	err    error         // the error of the Request, set before done is closed
+	cyclic bool          // the Request depends on itself via other Requests
+	once   sync.Once
+}
+
+// newBatchDeps returns the dependencies of the given requests, or nil if no
+// Request depends on another in the batch.
+func newBatchDeps(requests []*Request) batchDeps {
+	var batch batchDeps
+	for _, req := range requests {
+		if len(req.dependsOn) > 0 {
+			batch = make(batchDeps, len(requests))
+			break
+		}
+	}
+	if batch == nil {
+		return nil
+	}
+	for _, req := range requests {
+		batch[req] = &batchDep{done: make(chan struct{})}
+	}
+	return batch
+}
+
+// wait blocks until all dependencies of req in the batch have completed and
+// returns an error if any of them failed, or if req is part of a cycle.
+func (b batchDeps) wait(req *Request) error {
+	if b == nil {
+		return nil
+	}
+	if b[req].cyclic {
+		return ErrBadRequest
+	}
+	for _, dep := range req.dependsOn {
+		d, ok := b[dep]
+		if !ok {
+			continue
+		}
+		<-d.done
+		if errors.Is(d.err, ErrDependencyFailed) {
+			return d.err
+		}
+		if d.err != nil {
+			return &dependencyError{d.err}
+		}
+	}
+	return nil
+}
+
+// finish records the outcome of req so that Requests that depend on it may
+// proceed. Only the first outcome of a Request given more than once is
+// recorded.
+func (b batchDeps) finish(req *Request, err error) {
+	if b == nil {
+		return
+	}
+	d := b[req]
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+// sortByDependency returns a copy of the given requests, ordered so that each
+// Request follows the Requests it depends on, and otherwise in their given
+// order. Requests that close a dependency cycle are marked as cyclic, so that
+// they fail rather than wait for a Request that is queued after them.
+func sortByDependency(requests []*Request, batch batchDeps) []*Request {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*Request]int, len(requests))
+	sorted := make([]*Request, 0, len(requests))
+	var visit func(req *Request)
+	visit = func(req *Request) {
+		state[req] = visiting
+		for _, dep := range req.dependsOn {
+			if _, ok := batch[dep]; !ok {
+				continue
+			}
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				batch[req].cyclic = true
+			}
+		}
+		state[req] = visited
+		sorted = append(sorted, req)
+	}
+	first := make(map[*Request]bool, len(requests))
+	for _, req := range requests {
+		if first[req] {
+			// the same Request was given more than once
+			sorted = append(sorted, req)
+			continue
+		}
+		first[req] = true
+		if state[req] == unvisited {
+			visit(req)
+		}
+	}
+	return sorted
+}
+
 // An stateFunc is an action that mutates the state of a Response and returns
 // the next stateFunc to be called.
 type stateFunc func(*Response) stateFunc
@@ -192,24 +811,79 @@ func (c *Client) run(resp *Response, f stateFunc) {
 	}
 }
 
+// resolveVia sends a GET request for the URL of the Request and passes the
+// response to Request.ResolveVia to resolve the URL and filename of the file
+// content.
+//
+// The next stateFunc is statFileInfo, or closeResponse if an error occurs.
+func (c *Client) resolveVia(resp *Response) stateFunc {
+	hresp, err := c.doHTTPRequest(resp, resp.Request.HTTPRequest)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	rawurl, filename, err := resp.Request.ResolveVia(hresp)
+	hresp.Body.Close()
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	if rawurl != "" {
+		u, err := hresp.Request.URL.Parse(rawurl)
+		if err != nil {
+			resp.err = err
+			return c.closeResponse
+		}
+		c.logf(resp, LogDebug, "resolved content URL %s", u)
+		resp.Request.HTTPRequest.URL = u
+		resp.Request.HTTPRequest.Host = ""
+	}
+	if filename != "" && resp.Request.File == nil && !resp.Request.NoStore {
+		name := filepath.Base(filepath.Clean("/" + filename))
+		if name == "/" || name == "." {
+			resp.err = ErrNoFilename
+			return c.closeResponse
+		}
+		dir := resp.Filename
+		if fi, err := os.Stat(dir); dir == "" || strings.HasSuffix(dir, string(os.PathSeparator)) || err == nil && fi.IsDir() {
+			resp.Filename = filepath.Join(dir, name)
+		}
+	}
+	return c.statFileInfo
+}
+
 // statFileInfo retrieves FileInfo for any local file matching
 // Response.Filename.
 //
-// If the file does not exist, is a directory, or its name is unknown the next
-// stateFunc is headRequest.
+// If the file is a directory, or its name is unknown the next stateFunc is
+// headRequest. If the file does not exist, or will be replaced according to
+// Request.OnFilenameCollision, the next stateFunc is checkDestination.
 //
 // If the file exists, Response.fi is set and the next stateFunc is
-// validateLocal.
+// validateLocal, or checksumLocal if Request.SkipIfChecksumMatches is set.
 //
 // If an error occurs, the next stateFunc is closeResponse.
 func (c *Client) statFileInfo(resp *Response) stateFunc {
+	c.transformFilename(resp)
+	if resp.Request.ResumeFrom > 0 {
+		return c.resumeFrom
+	}
 	if resp.Request.NoStore || resp.Filename == "" {
 		return c.headRequest
 	}
-	fi, err := os.Stat(resp.Filename)
+	if resp.Request.File == nil && !resp.Request.FollowSymlinks {
+		if resp.err = checkSymlink(resp.Filename); resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	fi, err := statDestination(resp)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return c.headRequest
+			return c.checkDestination
+		}
+		if resp.Request.File == nil {
+			// the destination path cannot be accessed, e.g. a parent is a file
+			err = &badDestinationError{err}
 		}
 		resp.err = err
 		return c.closeResponse
@@ -218,10 +892,135 @@ func (c *Client) statFileInfo(resp *Response) stateFunc {
 		resp.Filename = ""
 		return c.headRequest
 	}
+	if resp.Request.File != nil && fi.Size() == 0 {
+		// treat an empty file provided by the caller as a new file
+		return c.headRequest
+	}
+	if resp.Request.SkipIfChecksumMatches && resp.Request.hash != nil && !resp.checkedLocal {
+		resp.fi = fi
+		return c.checksumLocal
+	}
+	if resp.Request.File == nil {
+		switch resp.collisionPolicy() {
+		case CollisionOverwrite, CollisionRename, CollisionOverwriteIfDifferent:
+			// handled by openWriter
+			return c.checkDestination
+
+		case CollisionError:
+			resp.err = ErrFileExists
+			return c.closeResponse
+		}
+	}
 	resp.fi = fi
 	return c.validateLocal
 }
 
+// checksumLocal compares the checksum of an existing local file to the
+// expected checksum, if Request.SkipIfChecksumMatches is set.
+//
+// If the checksums match, the transfer is complete and the next stateFunc is
+// verifyFile. Otherwise, the next stateFunc is statFileInfo.
+func (c *Client) checksumLocal(resp *Response) stateFunc {
+	req := resp.Request
+	resp.checkedLocal = true
+	sum, err := resp.checksumUnsafe(req.hash)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	if !bytes.Equal(sum, req.checksum) {
+		c.logf(resp, LogDebug, "%s does not match the expected checksum", resp.Filename)
+		resp.fi = nil
+		atomic.StoreInt32(&resp.phase, int32(PhaseTransfer))
+		return c.statFileInfo
+	}
+	c.logf(resp, LogInfo, "%s matches the expected checksum", resp.Filename)
+	resp.DidResume = true
+	resp.bytesResumed = resp.fi.Size()
+	atomic.StoreInt64(&resp.sizeUnsafe, resp.fi.Size())
+	if h := req.computeHash; h == req.hash {
+		resp.checksum = sum
+	} else if h != nil {
+		resp.checksum, resp.err = resp.checksumUnsafe(h)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	return c.verifyFile
+}
+
+// checkDestination checks that the file named by Response.Filename can be
+// created or overwritten before any requests are sent to the remote server.
+//
+// The next stateFunc is headRequest, or closeResponse if the destination cannot
+// be written to.
+func (c *Client) checkDestination(resp *Response) stateFunc {
+	if resp.Request.File == nil {
+		if resp.err = checkDestination(resp.Filename); resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	return c.headRequest
+}
+
+// statDestination returns the FileInfo of the destination file, which is either
+// Request.File or the file named by Response.Filename.
+func statDestination(resp *Response) (os.FileInfo, error) {
+	if resp.Request.File != nil {
+		return resp.Request.File.Stat()
+	}
+	return os.Stat(resp.Filename)
+}
+
+// transformFilename applies Request.FilenameTransform to the base name of
+// Response.Filename, once it is known to name a file rather than a directory.
+func (c *Client) transformFilename(resp *Response) {
+	f := resp.Request.FilenameTransform
+	if f == nil || resp.filenameTransformed || resp.Request.File != nil {
+		return
+	}
+	dir, name := filepath.Split(resp.Filename)
+	if name == "" {
+		return
+	}
+	if fi, err := os.Stat(resp.Filename); err == nil && fi.IsDir() {
+		return
+	}
+	resp.filenameTransformed = true
+	resp.Filename = dir + f(name)
+	c.logf(resp, LogDebug, "transformed filename %s to %s", name, resp.Filename)
+}
+
+// resumeFrom prepares a transfer to resume from the offset given in
+// Request.ResumeFrom, without comparing the local file to the remote file.
+//
+// An error is returned if the local file does not exist or is smaller than the
+// given offset.
+//
+// The next stateFunc is getRequest.
+func (c *Client) resumeFrom(resp *Response) stateFunc {
+	if resp.Request.NoResume || resp.Request.NoStore {
+		resp.err = ErrBadRequest
+		return c.closeResponse
+	}
+	fi, err := statDestination(resp)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	if fi.IsDir() || fi.Size() < resp.Request.ResumeFrom {
+		resp.err = ErrBadLength
+		return c.closeResponse
+	}
+	resp.fi = fi
+	resp.Request.HTTPRequest.Header.Set(
+		"Range",
+		fmt.Sprintf("bytes=%d-", resp.Request.ResumeFrom))
+	resp.DidResume = true
+	resp.bytesResumed = resp.Request.ResumeFrom
+	return c.getRequest
+}
+
 // validateLocal compares a local copy of the downloaded file to the remote
 // file.
 //
@@ -232,13 +1031,31 @@ func (c *Client) statFileInfo(resp *Response) stateFunc {
 // stateFunc is checksumFile.
 //
 // If the local file is smaller than the remote file and the remote server is
-// known to support ranged requests, the next stateFunc is getRequest.
+// known to support ranged requests, the next stateFunc is verifyResume or
+// resumeLocal.
 func (c *Client) validateLocal(resp *Response) stateFunc {
+	if resp.Request.ResumePolicy != nil {
+		if resp.HTTPResponse == nil && !resp.Request.NoHead && !resp.optionsKnown {
+			return c.headRequest
+		}
+		return c.applyResumePolicy(resp)
+	}
+
 	if resp.Request.SkipExisting {
 		resp.err = ErrFileExists
 		return c.closeResponse
 	}
 
+	if resp.Request.RestartIfModified {
+		if resp.HTTPResponse == nil {
+			return c.headRequest
+		}
+		if isModifiedSince(resp.HTTPResponse, resp.fi.ModTime()) {
+			c.logf(resp, LogInfo, "%s was modified remotely, overwriting", resp.Filename)
+			return c.getRequest
+		}
+	}
+
 	// determine target file size
 	expectedSize := resp.Request.Size
 	if expectedSize == 0 && resp.HTTPResponse != nil {
@@ -254,6 +1071,7 @@ func (c *Client) validateLocal(resp *Response) stateFunc {
 
 	if expectedSize == resp.fi.Size() {
 		// local file matches remote file size - wrap it up
+		c.logf(resp, LogInfo, "%s is already complete", resp.Filename)
 		resp.DidResume = true
 		resp.bytesResumed = resp.fi.Size()
 		return c.checksumFile
@@ -261,6 +1079,7 @@ func (c *Client) validateLocal(resp *Response) stateFunc {
 
 	if resp.Request.NoResume {
 		// local file should be overwritten
+		c.logf(resp, LogInfo, "overwriting %s", resp.Filename)
 		return c.getRequest
 	}
 
@@ -271,40 +1090,182 @@ func (c *Client) validateLocal(resp *Response) stateFunc {
 	}
 
 	if resp.CanResume {
-		// set resume range on GET request
-		resp.Request.HTTPRequest.Header.Set(
-			"Range",
-			fmt.Sprintf("bytes=%d-", resp.fi.Size()))
-		resp.DidResume = true
-		resp.bytesResumed = resp.fi.Size()
-		return c.getRequest
+		if resp.Request.ResumeVerifySize > 0 {
+			return c.verifyResume
+		}
+		return c.resumeLocal
 	}
 	return c.headRequest
 }
 
-func (c *Client) checksumFile(resp *Response) stateFunc {
-	if resp.Request.hash == nil {
+// applyResumePolicy handles a local copy of the downloaded file as decided by
+// Request.ResumePolicy.
+func (c *Client) applyResumePolicy(resp *Response) stateFunc {
+	action, err := resp.Request.ResumePolicy(resp.fi, resp.HTTPResponse)
+	if err != nil {
+		resp.err = err
 		return c.closeResponse
 	}
-	if resp.Filename == "" {
-		panic("grab: developer error: filename not set")
-	}
-	if resp.Size() < 0 {
-		panic("grab: developer error: size unknown")
+	switch action {
+	case ActionResume:
+		expectedSize := resp.Request.Size
+		if expectedSize == 0 && resp.HTTPResponse != nil {
+			expectedSize = resp.HTTPResponse.ContentLength
+		}
+		if expectedSize == resp.fi.Size() {
+			c.logf(resp, LogInfo, "%s is already complete", resp.Filename)
+			resp.DidResume = true
+			resp.bytesResumed = resp.fi.Size()
+			return c.checksumFile
+		}
+		if expectedSize > 0 && expectedSize < resp.fi.Size() {
+			resp.err = ErrBadLength
+			return c.closeResponse
+		}
+		if resp.Request.ResumeVerifySize > 0 {
+			return c.verifyResume
+		}
+		return c.resumeLocal
+
+	case ActionRestart:
+		c.logf(resp, LogInfo, "overwriting %s", resp.Filename)
+		return c.getRequest
+
+	case ActionSkip:
+		c.logf(resp, LogInfo, "skipping %s", resp.Filename)
+		resp.DidResume = true
+		resp.bytesResumed = resp.fi.Size()
+		atomic.StoreInt64(&resp.sizeUnsafe, resp.fi.Size())
+		return c.checksumFile
+
+	case ActionFail:
+		resp.err = ErrFileExists
+		return c.closeResponse
 	}
-	req := resp.Request
+	resp.err = ErrBadRequest
+	return c.closeResponse
+}
 
-	// compute checksum
-	var sum []byte
-	sum, resp.err = resp.checksumUnsafe()
-	if resp.err != nil {
+// verifyResume compares the trailing Request.ResumeVerifySize bytes of the
+// local file to the same range of the remote file.
+//
+// If the bytes match, the next stateFunc is resumeLocal. Otherwise, the local
+// file is overwritten and the next stateFunc is getRequest.
+func (c *Client) verifyResume(resp *Response) stateFunc {
+	size := resp.fi.Size()
+	n := resp.Request.ResumeVerifySize
+	if n > size {
+		n = size
+	}
+	if n == 0 {
+		return c.resumeLocal
+	}
+	offset := size - n
+
+	// read local bytes
+	local := make([]byte, n)
+	var f *os.File
+	if f = resp.Request.File; f == nil {
+		f, resp.err = os.Open(resp.Filename)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+		defer f.Close()
+	}
+	if _, resp.err = f.ReadAt(local, offset); resp.err != nil {
 		return c.closeResponse
 	}
 
+	// read remote bytes
+	req := resp.Request.HTTPRequest.Clone(resp.Request.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, size-1))
+	hresp, err := c.doHTTPRequest(resp, req)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	defer hresp.Body.Close()
+	remote := make([]byte, n)
+	var start int64
+	cr := hresp.Header.Get("Content-Range")
+	if hresp.StatusCode == http.StatusPartialContent {
+		if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err == nil && start == offset {
+			_, err = io.ReadFull(hresp.Body, remote)
+			if err == nil && bytes.Equal(local, remote) {
+				return c.resumeLocal
+			}
+		}
+	}
+
+	// restart transfer
+	c.logf(resp, LogInfo, "%s does not match the remote file, overwriting", resp.Filename)
+	return c.getRequest
+}
+
+// resumeLocal sets the resume range of the GET request to the end of the local
+// file.
+//
+// The next stateFunc is getRequest.
+func (c *Client) resumeLocal(resp *Response) stateFunc {
+	resp.Request.HTTPRequest.Header.Set(
+		"Range",
+		fmt.Sprintf("bytes=%d-", resp.fi.Size()))
+	resp.DidResume = true
+	resp.bytesResumed = resp.fi.Size()
+	c.logf(resp, LogInfo, "resuming %s from byte %d", resp.Filename, resp.bytesResumed)
+	return c.getRequest
+}
+
+func (c *Client) checksumFile(resp *Response) stateFunc {
+	req := resp.Request
+	if req.computeHash != nil && resp.checksum == nil {
+		// nothing was transferred, so compute the checksum of the local file
+		resp.checksum, resp.err = resp.checksumUnsafe(req.computeHash)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	if req.hash == nil {
+		return c.verifyFile
+	}
+	if name := req.trailerChecksum; name != "" {
+		if resp.transfer == nil {
+			c.logf(resp, LogDebug, "skipping trailer checksum validation as nothing was transferred")
+			return c.verifyFile
+		}
+		sum, ok := decodeChecksum(resp.HTTPResponse.Trailer.Get(name), req.hash.Size())
+		if !ok {
+			c.logf(resp, LogDebug, "missing or malformed checksum trailer: %s", name)
+		}
+		req.checksum = sum
+	}
+	if resp.Filename == "" {
+		panic("grab: developer error: filename not set")
+	}
+	if resp.Size() < 0 {
+		panic("grab: developer error: size unknown")
+	}
+
+	// compute checksum, unless it was computed during the transfer
+	sum := resp.checksum
+	if req.hash != req.computeHash {
+		sum, resp.err = resp.checksumUnsafe(req.hash)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+	}
+
 	// compare checksum
 	if !bytes.Equal(sum, req.checksum) {
+		c.logf(resp, LogDebug, "checksum mismatch: expected %x, got %x", req.checksum, sum)
+		if resp.checksumRetries < req.ChecksumRetries && !resp.streamed() && resp.tee == nil {
+			resp.checksumRetries++
+			c.logf(resp, LogInfo, "restarting transfer after checksum mismatch (retry %d of %d)",
+				resp.checksumRetries, req.ChecksumRetries)
+			return c.retryTransfer
+		}
 		resp.err = ErrBadChecksum
-		if !resp.Request.NoStore && req.deleteOnError {
+		if !resp.Request.NoStore && req.File == nil && req.deleteOnError {
 			if err := os.Remove(resp.Filename); err != nil {
 				// err should be os.PathError and include file path
 				resp.err = fmt.Errorf(
@@ -312,16 +1273,293 @@ func (c *Client) checksumFile(resp *Response) stateFunc {
 					err)
 			}
 		}
+		return c.closeResponse
+	}
+	return c.verifyFile
+}
+
+// retryTransfer discards the content of a transfer that failed checksum
+// validation and restarts it from the beginning, using the destination that
+// was determined by the first attempt.
+//
+// The next stateFunc is copyFile, or nil if the transfer could not be
+// restarted and the Response was closed.
+func (c *Client) retryTransfer(resp *Response) stateFunc {
+	req := resp.Request
+	resp.closeResponseBody()
+	if resp.buffer != nil {
+		c.putBuffer(resp.buffer)
+		resp.buffer = nil
+	}
+	if req.NoStore {
+		resp.storeBuffer.Reset()
+	} else if req.File == nil {
+		if err := os.Remove(resp.Filename); err != nil && !os.IsNotExist(err) {
+			resp.err = err
+			return c.closeResponse
+		}
+	}
+	resp.fi = nil
+	// public fields are replaced as documented for Request.ChecksumRetries,
+	// while the fields read by the accessors of Response are synchronized
+	resp.DidResume = false
+	atomic.StoreInt64(&resp.bytesResumed, 0)
+	resp.checksum = nil
+	atomic.StoreInt32(&resp.phase, int32(PhaseTransfer))
+	req.HTTPRequest.Header.Del("Range")
+
+	// run the synchronous states again before copying in this goroutine
+	c.run(resp, c.getRequest)
+	if resp.IsComplete() {
+		return nil
 	}
+	return c.copyFile
+}
+
+// verifyFile validates the downloaded file using the Verifier set via
+// Request.SetVerifier.
+//
+// The next stateFunc is replaceFile, or closeResponse if verification fails.
+func (c *Client) verifyFile(resp *Response) stateFunc {
+	req := resp.Request
+	if req.verifier == nil {
+		return c.replaceFile
+	}
+	f, err := resp.openUnsafe()
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	resp.err = req.verifier.Verify(f)
+	f.Close()
+	if resp.err != nil && !req.NoStore && req.File == nil && req.deleteOnVerifyError {
+		if err := os.Remove(resp.Filename); err != nil {
+			resp.err = fmt.Errorf(
+				"cannot remove downloaded file that failed verification: %v",
+				err)
+		}
+	}
+	if resp.err != nil {
+		return c.closeResponse
+	}
+	return c.replaceFile
+}
+
+// replaceFile replaces an existing file with the downloaded temporary file if
+// their contents differ, or otherwise removes the temporary file, if
+// Request.OnFilenameCollision is CollisionOverwriteIfDifferent.
+//
+// The next stateFunc is setModTime.
+func (c *Client) replaceFile(resp *Response) stateFunc {
+	if resp.replaceFilename == "" {
+		return c.setModTime
+	}
+	tmp := resp.Filename
+	resp.Filename, resp.replaceFilename = resp.replaceFilename, ""
+	same, err := sameContents(tmp, resp.Filename)
+	if err != nil {
+		os.Remove(tmp)
+		resp.err = err
+		return c.closeResponse
+	}
+	if same {
+		c.logf(resp, LogInfo, "%s is unchanged", resp.Filename)
+		resp.NotModified = true
+		resp.err = os.Remove(tmp)
+	} else {
+		c.logf(resp, LogInfo, "replacing %s", resp.Filename)
+		resp.err = os.Rename(tmp, resp.Filename)
+	}
+	if resp.err != nil {
+		return c.closeResponse
+	}
+	return c.setModTime
+}
+
+// setModTime sets the modification time of the completed file to
+// Request.ModTime, if set.
+//
+// The next stateFunc is extractFiles, or closeResponse if the timestamp could
+// not be set.
+func (c *Client) setModTime(resp *Response) stateFunc {
+	t := resp.Request.ModTime
+	if t.IsZero() || resp.Request.NoStore {
+		return c.extractFiles
+	}
+	if resp.err = os.Chtimes(resp.Filename, t, t); resp.err != nil {
+		return c.closeResponse
+	}
+	return c.extractFiles
+}
+
+// extractFiles extracts the downloaded archive into Request.ExtractDir, if
+// set.
+//
+// The next stateFunc is archiveFile, or closeResponse if extraction fails.
+func (c *Client) extractFiles(resp *Response) stateFunc {
+	dir := resp.Request.ExtractDir
+	if dir == "" {
+		return c.archiveFile
+	}
+	c.logf(resp, LogDebug, "extracting to %s", dir)
+	resp.extracted, resp.err = extractArchive(resp.Request.Context(), resp, dir)
+	if resp.err != nil {
+		return c.closeResponse
+	}
+	return c.archiveFile
+}
+
+// archiveFile writes the downloaded file as an entry to the ArchiveWriter set
+// via Request.SetArchive, if any. Writes are serialized across all transfers of
+// the Client.
+//
+// The next stateFunc is compressFile, or closeResponse if the entry could not
+// be written.
+func (c *Client) archiveFile(resp *Response) stateFunc {
+	req := resp.Request
+	if req.archive == nil {
+		return c.compressFile
+	}
+	name := req.archiveName
+	if name == "" {
+		if name, resp.err = guessFilename(resp.HTTPResponse); resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	modTime := req.ModTime
+	if modTime.IsZero() && !req.IgnoreRemoteTime && resp.HTTPResponse != nil {
+		modTime, _ = parseHTTPTime(resp.HTTPResponse.Header.Get("Last-Modified"))
+	}
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	c.logf(resp, LogDebug, "writing archive entry %s", name)
+	b := resp.storeBuffer.Bytes()
+	c.archiveMu.Lock()
+	w, err := req.archive.CreateEntry(name, int64(len(b)), modTime)
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	c.archiveMu.Unlock()
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	return c.compressFile
+}
+
+// compressFile compresses the downloaded file with gzip, if Request.Compress
+// is set and the file is not already compressed.
+//
+// The next stateFunc is closeResponse.
+func (c *Client) compressFile(resp *Response) stateFunc {
+	req := resp.Request
+	if !req.Compress || req.NoStore || req.File != nil {
+		return c.closeResponse
+	}
+	if resp.HTTPResponse != nil {
+		types := req.CompressedContentTypes
+		if types == nil {
+			types = DefaultCompressedContentTypes
+		}
+		if matchContentType(resp.HTTPResponse.Header.Get("Content-Type"), types) {
+			c.logf(resp, LogDebug, "%s is already compressed", resp.Filename)
+			return c.closeResponse
+		}
+	}
+	c.logf(resp, LogDebug, "compressing %s", resp.Filename)
+	filename, err := compressFile(req.Context(), resp.Filename)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	resp.Filename = filename
 	return c.closeResponse
 }
 
 // doHTTPRequest sends a HTTP Request and returns the response
-func (c *Client) doHTTPRequest(req *http.Request) (*http.Response, error) {
+func (c *Client) doHTTPRequest(resp *Response, req *http.Request) (*http.Response, error) {
+	attempt := resp.attempts
+	resp.attempts++
+	if len(resp.Request.Cookies) > 0 || resp.Request.UseServerDigest || resp.Request.URLFunc != nil || len(c.Header) > 0 {
+		// copy headers so that the caller's request is not modified
+		req = req.Clone(req.Context())
+		if f := resp.Request.URLFunc; f != nil {
+			s, err := f(attempt)
+			if err != nil {
+				return nil, err
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			req.URL = u
+			req.Host = ""
+		}
+		for _, cookie := range resp.Request.Cookies {
+			req.AddCookie(cookie)
+		}
+		if resp.Request.UseServerDigest && req.Header.Get("Want-Digest") == "" {
+			req.Header.Set("Want-Digest", "sha-256, sha-512;q=0.5")
+		}
+	}
+	for key, values := range c.Header {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := req.Header[key]; !ok {
+			req.Header[key] = append([]string(nil), values...)
+		}
+	}
 	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
 		req.Header.Set("User-Agent", c.UserAgent)
 	}
-	return c.HTTPClient.Do(req)
+	if r := req.Header.Get("Range"); r != "" {
+		c.logf(resp, LogDebug, "sending %s request with Range: %s", req.Method, r)
+	} else {
+		c.logf(resp, LogDebug, "sending %s request", req.Method)
+	}
+	req = req.WithContext(withTrace(req.Context(), resp))
+	hc := c.HTTPClient
+	if resp.Request.SameHostRedirectsOnly {
+		var err error
+		if hc, err = sameHostClient(hc, resp.Request.RedirectHosts); err != nil {
+			return nil, err
+		}
+	}
+	hresp, err := hc.Do(req)
+	if err != nil {
+		if cerr := req.Context().Err(); cerr != nil {
+			// report cancelation consistently, rather than as a transport error
+			return nil, cerr
+		}
+		return nil, err
+	}
+	c.logf(resp, LogDebug, "received %s response: %s", req.Method, hresp.Status)
+	return hresp, nil
+}
+
+// sameHostClient returns a copy of the given HTTPClient which rejects redirects
+// to a host other than the host of the original request or one of the given
+// hosts.
+func sameHostClient(hc HTTPClient, hosts []string) (HTTPClient, error) {
+	orig, ok := hc.(*http.Client)
+	if !ok {
+		return nil, ErrBadRequest
+	}
+	check := orig.CheckRedirect
+	clone := *orig
+	clone.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !isAllowedHost(req.URL, via[0].URL.Host, hosts) {
+			return ErrRedirectHost
+		}
+		if check != nil {
+			return check(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &clone, nil
 }
 
 func (c *Client) headRequest(resp *Response) stateFunc {
@@ -330,7 +1568,7 @@ func (c *Client) headRequest(resp *Response) stateFunc {
 	}
 	resp.optionsKnown = true
 
-	if resp.Request.NoResume {
+	if resp.Request.NoResume && resp.Request.ResumePolicy == nil {
 		return c.getRequest
 	}
 
@@ -339,17 +1577,34 @@ func (c *Client) headRequest(resp *Response) stateFunc {
 		return c.getRequest
 	}
 
+	if resp.Request.NoHead {
+		// attempt to resume without knowing if the remote server supports
+		// ranged requests. getRequest will restart the transfer if the server
+		// ignores the Range header.
+		if resp.fi != nil && resp.fi.Size() > 0 {
+			resp.Request.HTTPRequest.Header.Set(
+				"Range",
+				fmt.Sprintf("bytes=%d-", resp.fi.Size()))
+			resp.DidResume = true
+			resp.bytesResumed = resp.fi.Size()
+		}
+		return c.getRequest
+	}
+
 	hreq := new(http.Request)
 	*hreq = *resp.Request.HTTPRequest
 	hreq.Method = "HEAD"
 
-	resp.HTTPResponse, resp.err = c.doHTTPRequest(hreq)
+	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp, hreq)
 	if resp.err != nil {
 		return c.closeResponse
 	}
 	resp.HTTPResponse.Body.Close()
 
 	if resp.HTTPResponse.StatusCode != http.StatusOK {
+		if isHeadRejected(resp.HTTPResponse.StatusCode) && !resp.Request.NoStore {
+			return c.probeRequest
+		}
 		return c.getRequest
 	}
 
@@ -364,18 +1619,133 @@ func (c *Client) headRequest(resp *Response) stateFunc {
 	return c.readResponse
 }
 
+// probeRequest determines the size of the remote file and whether the remote
+// server supports ranged requests by requesting only the first byte of the
+// file. It is used in place of a HEAD request if the remote server rejects
+// HEAD requests. The size of the file is read from the Content-Range header of
+// the response, as in "bytes 0-0/1024".
+//
+// The next stateFunc is readResponse if the remote server honored the Range
+// header, or otherwise getRequest.
+func (c *Client) probeRequest(resp *Response) stateFunc {
+	preq := new(http.Request)
+	*preq = *resp.Request.HTTPRequest
+	preq.Header = preq.Header.Clone()
+	preq.Header.Set("Range", "bytes=0-0")
+
+	presp, err := c.doHTTPRequest(resp, preq)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	if presp.StatusCode != http.StatusPartialContent {
+		presp.Body.Close()
+		return c.getRequest
+	}
+	io.Copy(ioutil.Discard, presp.Body)
+	presp.Body.Close()
+
+	var size int64
+	cr := presp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes 0-0/%d", &size); err != nil {
+		c.logf(resp, LogDebug, "ignoring unsupported Content-Range: %s", cr)
+		return c.getRequest
+	}
+	presp.ContentLength = size
+	resp.HTTPResponse = presp
+	resp.rangeProbed = true
+	resp.Request.HTTPRequest.URL = presp.Request.URL
+	resp.Request.HTTPRequest.Host = presp.Request.Host
+	return c.readResponse
+}
+
 func (c *Client) getRequest(resp *Response) stateFunc {
-	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp.Request.HTTPRequest)
+	if n := resp.Request.HeadBytes; n > resp.bytesResumed {
+		resp.Request.HTTPRequest.Header.Set(
+			"Range",
+			fmt.Sprintf("bytes=%d-%d", resp.bytesResumed, n-1))
+	}
+	resp.HTTPResponse, resp.err = c.doHTTPRequest(resp, resp.Request.HTTPRequest)
 	if resp.err != nil {
 		return c.closeResponse
 	}
+	resp.httpRequest = resp.HTTPResponse.Request
+
+	// check Content-Range
+	if resp.DidResume {
+		switch resp.HTTPResponse.StatusCode {
+		case http.StatusOK:
+			// server ignored the Range header and is sending the entire file
+			resp.DidResume = false
+			resp.bytesResumed = 0
+
+		case http.StatusPartialContent:
+			var start int64
+			if cr := resp.HTTPResponse.Header.Get("Content-Range"); cr != "" {
+				if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err != nil || start != resp.bytesResumed {
+					resp.err = ErrBadLength
+					return c.closeResponse
+				}
+			}
 
-	// TODO: check Content-Range
+		case http.StatusRequestedRangeNotSatisfiable:
+			// the local file is already complete if the remote file has the
+			// same size, as given in a Content-Range header such as
+			// "bytes */1024"
+			var size int64
+			cr := resp.HTTPResponse.Header.Get("Content-Range")
+			if _, err := fmt.Sscanf(cr, "bytes */%d", &size); err == nil && size == resp.bytesResumed {
+				c.logf(resp, LogInfo, "%s is already complete", resp.Filename)
+				resp.closeResponseBody()
+				atomic.StoreInt64(&resp.sizeUnsafe, size)
+				return c.checksumFile
+			}
+		}
+	}
+
+	// renew expired pre-signed URLs
+	if c.canReSign(resp) {
+		return c.reSign(resp)
+	}
 
 	// check status code
 	if !resp.Request.IgnoreBadStatusCodes {
 		if resp.HTTPResponse.StatusCode < 200 || resp.HTTPResponse.StatusCode > 299 {
 			resp.err = StatusCodeError(resp.HTTPResponse.StatusCode)
+			if n := resp.Request.ErrorBodySize; n > 0 {
+				// keep any partial body if the read fails
+				resp.errorBody, _ = ioutil.ReadAll(io.LimitReader(resp.HTTPResponse.Body, int64(n)))
+			}
+			return c.closeResponse
+		}
+	}
+
+	// validate using the checksum provided by the remote server
+	if resp.Request.UseServerDigest && resp.Request.hash == nil && !resp.streamed() {
+		if h, sum := parseDigest(resp.HTTPResponse.Header.Values("Digest")); h != nil {
+			resp.Request.SetChecksum(h, sum, false)
+		}
+	}
+	if resp.Request.UseContentMD5 && resp.Request.hash == nil && !resp.streamed() {
+		partial := resp.HTTPResponse.StatusCode == http.StatusPartialContent
+		if sum := parseContentMD5(resp.HTTPResponse.Header, partial); sum != nil {
+			resp.Request.SetChecksum(md5.New(), sum, false)
+		}
+	}
+
+	// check content type
+	if types := resp.Request.AllowedContentTypes; len(types) > 0 {
+		ct := resp.HTTPResponse.Header.Get("Content-Type")
+		if !matchContentType(ct, types) {
+			resp.err = contentTypeError(ct)
+			return c.closeResponse
+		}
+	}
+
+	// check caller preconditions
+	if f := resp.Request.Precondition; f != nil {
+		resp.err = f(resp.HTTPResponse)
+		if resp.err != nil {
 			return c.closeResponse
 		}
 	}
@@ -383,21 +1753,86 @@ func (c *Client) getRequest(resp *Response) stateFunc {
 	return c.readResponse
 }
 
+// reconnect sends a new GET request for the remainder of the file from the
+// given offset, to replace a connection that was idle while the transfer was
+// paused or that ended early. The previous connection is closed.
+func (c *Client) reconnect(resp *Response, offset int64) (io.Reader, error) {
+	c.logf(resp, LogInfo, "reconnecting from byte %d", offset)
+	req := resp.Request.HTTPRequest.Clone(resp.Request.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	hresp, err := c.doHTTPRequest(resp, req)
+	if err != nil {
+		return nil, err
+	}
+	if hresp.StatusCode != http.StatusPartialContent {
+		hresp.Body.Close()
+		return nil, StatusCodeError(hresp.StatusCode)
+	}
+	var start int64
+	cr := hresp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err != nil || start != offset {
+		hresp.Body.Close()
+		return nil, ErrBadLength
+	}
+	resp.closeResponseBody()
+	resp.reconnectBody = hresp.Body
+	return hresp.Body, nil
+}
+
+// canReSign returns true if the last HTTP response indicates that a pre-signed
+// URL has expired and Request.ReSign may be called to renew it.
+func (c *Client) canReSign(resp *Response) bool {
+	return resp.Request.ReSign != nil &&
+		!resp.didReSign &&
+		isExpiredSignature(resp.HTTPResponse)
+}
+
+// reSign replaces the request URL with the one returned by Request.ReSign.
+// Any HEAD request that failed using the expired URL is discarded, so that the
+// capabilities of the remote server can be determined again.
+//
+// The next stateFunc is statFileInfo, or closeResponse if ReSign returns an
+// error.
+func (c *Client) reSign(resp *Response) stateFunc {
+	c.logf(resp, LogInfo, "pre-signed URL has expired, renewing")
+	resp.didReSign = true
+	resp.closeResponseBody()
+	resp.HTTPResponse = nil
+	resp.optionsKnown = false
+	u, err := resp.Request.ReSign(resp.Request.HTTPRequest.URL)
+	if err != nil {
+		resp.err = err
+		return c.closeResponse
+	}
+	resp.Request.HTTPRequest.URL = u
+	resp.Request.HTTPRequest.Host = u.Host
+	return c.statFileInfo
+}
+
 func (c *Client) readResponse(resp *Response) stateFunc {
 	if resp.HTTPResponse == nil {
 		panic("grab: developer error: Response.HTTPResponse is nil")
 	}
 
 	// check expected size
-	resp.sizeUnsafe = resp.HTTPResponse.ContentLength
-	if resp.sizeUnsafe >= 0 {
+	size := resp.HTTPResponse.ContentLength
+	if size < 0 && resp.Request.SizeHeader != "" {
+		size = parseSizeHeader(resp.HTTPResponse.Header.Get(resp.Request.SizeHeader))
+	}
+	if size >= 0 {
 		// remote size is known
-		resp.sizeUnsafe += resp.bytesResumed
-		if resp.Request.Size > 0 && resp.Request.Size != resp.sizeUnsafe {
+		size += resp.bytesResumed
+		if resp.Request.Size > 0 && resp.Request.Size != size {
+			atomic.StoreInt64(&resp.sizeUnsafe, size)
 			resp.err = ErrBadLength
 			return c.closeResponse
 		}
 	}
+	if n := resp.Request.HeadBytes; n > 0 && size > n {
+		// only the first n bytes are wanted
+		size = n
+	}
+	atomic.StoreInt64(&resp.sizeUnsafe, size)
 
 	// check filename
 	if resp.Filename == "" {
@@ -406,16 +1841,52 @@ func (c *Client) readResponse(resp *Response) stateFunc {
 			resp.err = err
 			return c.closeResponse
 		}
+		if resp.Request.ExtensionFromContentType && filepath.Ext(filename) == "" {
+			filename += extensionByType(resp.HTTPResponse.Header.Get("Content-Type"))
+		}
 		// Request.Filename will be empty or a directory
 		resp.Filename = filepath.Join(resp.Request.Filename, filename)
+		c.transformFilename(resp)
+		if !resp.Request.NoStore {
+			if resp.err = checkDestination(resp.Filename); resp.err != nil {
+				return c.closeResponse
+			}
+		}
 	}
 
-	if !resp.Request.NoStore && resp.requestMethod() == "HEAD" {
-		if resp.HTTPResponse.Header.Get("Accept-Ranges") == "bytes" {
+	if !resp.Request.NoStore && (resp.requestMethod() == "HEAD" || resp.rangeProbed) {
+		if resp.rangeProbed || resp.HTTPResponse.Header.Get("Accept-Ranges") == "bytes" {
 			resp.CanResume = true
 		}
+		resp.rangeProbed = false
 		return c.statFileInfo
 	}
+
+	// run OnResolved hook
+	if f := resp.Request.OnResolved; f != nil {
+		filename := resp.Filename
+		resp.err = f(resp)
+		if resp.err != nil {
+			return c.closeResponse
+		}
+		if resp.Filename != filename && resp.Request.File == nil && !resp.Request.NoStore {
+			if resp.err = checkDestination(resp.Filename); resp.err != nil {
+				return c.closeResponse
+			}
+			// the local file that was compared to the remote file has changed
+			resp.fi, resp.err = os.Stat(resp.Filename)
+			if resp.err != nil {
+				if !os.IsNotExist(resp.err) {
+					return c.closeResponse
+				}
+				resp.fi, resp.err = nil, nil
+			}
+			if resp.bytesResumed > 0 && (resp.fi == nil || resp.fi.Size() < resp.bytesResumed) {
+				resp.err = ErrBadLength
+				return c.closeResponse
+			}
+		}
+	}
 	return c.openWriter
 }
 
@@ -424,20 +1895,31 @@ func (c *Client) readResponse(resp *Response) stateFunc {
 //
 // Requires that Response.Filename and resp.DidResume are already be set.
 func (c *Client) openWriter(resp *Response) stateFunc {
-	if !resp.Request.NoStore && !resp.Request.NoCreateDirectories {
+	if !resp.Request.NoStore && !resp.Request.NoCreateDirectories && resp.Request.File == nil {
 		resp.err = mkdirp(resp.Filename)
 		if resp.err != nil {
 			return c.closeResponse
 		}
 	}
 
-	if resp.Request.NoStore {
+	if resp.stream != nil {
+		resp.writer = resp.stream
+	} else if resp.Request.pipe != nil {
+		resp.writer = pipeWriter{resp.Request.pipe}
+	} else if resp.Request.NoStore {
 		resp.writer = &resp.storeBuffer
+	} else if resp.Request.File != nil {
+		// seek to start or resume offset in the file provided by the caller
+		resp.writer = resp.Request.File
+		_, resp.err = resp.Request.File.Seek(resp.bytesResumed, io.SeekStart)
+		if resp.err != nil {
+			return c.closeResponse
+		}
 	} else {
 		// compute write flags
 		flag := os.O_CREATE | os.O_WRONLY
 		if resp.fi != nil {
-			if resp.DidResume {
+			if resp.DidResume && resp.bytesResumed == resp.fi.Size() && !resp.Request.Preallocate && !resp.Request.Sparse {
 				flag = os.O_APPEND | os.O_WRONLY
 			} else {
 				// truncate later in copyFile, if not cancelled
@@ -446,36 +1928,146 @@ func (c *Client) openWriter(resp *Response) stateFunc {
 			}
 		}
 
+		// the filename may have been resolved since statFileInfo
+		if !resp.Request.FollowSymlinks {
+			if resp.err = checkSymlink(resp.Filename); resp.err != nil {
+				return c.closeResponse
+			}
+		}
+
 		// open file
-		f, err := os.OpenFile(resp.Filename, flag, 0666)
+		var f *os.File
+		var err error
+		switch resp.collisionPolicy() {
+		case CollisionError:
+			f, err = os.OpenFile(resp.Filename, flag|os.O_EXCL, 0666)
+			if os.IsExist(err) {
+				err = ErrFileExists
+			}
+
+		case CollisionRename:
+			f, err = createUnique(resp.Filename, flag)
+			if err == nil {
+				resp.Filename = f.Name()
+			}
+
+		case CollisionOverwriteIfDifferent:
+			var fi os.FileInfo
+			if fi, err = os.Stat(resp.Filename); err != nil {
+				f, err = os.OpenFile(resp.Filename, flag, 0666)
+				break
+			}
+			// download to a temporary file, to be compared in replaceFile
+			prefix := filepath.Base(resp.Filename)
+			if !strings.HasPrefix(prefix, ".") {
+				prefix = "." + prefix
+			}
+			f, err = ioutil.TempFile(filepath.Dir(resp.Filename), prefix+".grab-")
+			if err == nil {
+				resp.replaceFilename = resp.Filename
+				resp.Filename = f.Name()
+				err = f.Chmod(fi.Mode())
+			}
+
+		default:
+			f, err = os.OpenFile(resp.Filename, flag, 0666)
+		}
 		if err != nil {
+			if os.IsPermission(err) {
+				err = &badDestinationError{err}
+			}
 			resp.err = err
 			return c.closeResponse
 		}
 		resp.writer = f
 
-		// seek to start or end
-		whence := os.SEEK_SET
-		if resp.bytesResumed > 0 {
-			whence = os.SEEK_END
+		// a file may exist at a filename that was only resolved from the
+		// response to a GET request
+		if resp.fi == nil {
+			if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+				resp.fi = fi
+			}
 		}
-		_, resp.err = f.Seek(0, whence)
+
+		// seek to start or resume offset
+		_, resp.err = f.Seek(resp.bytesResumed, io.SeekStart)
 		if resp.err != nil {
 			return c.closeResponse
 		}
+		if resp.Request.Sparse && !resp.Request.Preallocate {
+			resp.writer = newSparseWriter(f, resp.bytesResumed)
+		}
 	}
 
 	// init transfer
-	if resp.bufferSize < 1 {
+	defaultBuffer := resp.bufferSize < 1
+	if defaultBuffer {
 		resp.bufferSize = 32 * 1024
 	}
-	b := make([]byte, resp.bufferSize)
-	resp.transfer = newTransfer(
-		resp.Request.Context(),
-		resp.Request.RateLimiter,
-		resp.writer,
-		resp.HTTPResponse.Body,
-		b)
+	resp.buffer = c.getBuffer(resp.bufferSize)
+	w := resp.writer
+	resp.writeBuffer = nil
+	if n := resp.Request.WriteBufferSize; n > 0 {
+		resp.writeBuffer = bufio.NewWriterSize(w, n)
+		w = resp.writeBuffer
+	}
+	resp.wrapWriter = nil
+	if f := resp.Request.WrapWriter; f != nil {
+		resp.wrapWriter = f(w)
+		w = resp.wrapWriter
+	}
+	if resp.Request.hash != nil && resp.Request.computeHash == nil {
+		// validate the checksum computed as the file is written, rather than
+		// reading the file again once the transfer is complete
+		resp.Request.computeHash = resp.Request.hash
+	}
+	if h := resp.Request.computeHash; h != nil {
+		// compute checksum as the file is written
+		h.Reset()
+		w = io.MultiWriter(w, h)
+	}
+	if resp.tee != nil {
+		w = io.MultiWriter(w, resp.tee)
+	}
+	if resp.transfer == nil {
+		resp.transfer = newTransfer(
+			resp.Request.Context(),
+			resp.Request.RateLimiter,
+			w,
+			resp.HTTPResponse.Body,
+			*resp.buffer)
+	} else {
+		// the transfer is restarted and its progress may be read concurrently
+		resp.transfer.reset(w, resp.HTTPResponse.Body, *resp.buffer)
+	}
+
+	// the destination may use its own buffer, unless BufferSize was set. Files
+	// are excluded, as the response body is never a source that
+	// (*os.File).ReadFrom can copy from directly, so it would only allocate a
+	// buffer of its own. See BenchmarkTransferFileReadFrom.
+	_, isFile := w.(*os.File)
+	resp.transfer.readFrom = defaultBuffer && resp.writeBuffer == nil && !isFile
+	if d := resp.Request.SampleInterval; d > 0 {
+		resp.transfer.setInterval(d)
+	}
+	if f := resp.Request.NewGauge; f != nil {
+		resp.transfer.setGauge(f())
+	}
+	resp.transfer.total = &c.bytesTransferred
+	resp.transfer.reconnect = func(offset int64) (io.Reader, error) {
+		return c.reconnect(resp, resp.bytesResumed+offset)
+	}
+	resp.transfer.retries = resp.Request.ReadRetries
+
+	// never write more than the expected size
+	resp.transfer.truncate = resp.Request.HeadBytes > 0
+	if n := resp.Size(); n >= 0 {
+		resp.transfer.limit = n - resp.bytesResumed
+	} else if n := resp.Request.Size; n > 0 {
+		resp.transfer.limit = n - resp.bytesResumed
+	} else if n := resp.Request.HeadBytes; n > 0 {
+		resp.transfer.limit = n - resp.bytesResumed
+	}
 
 	// next step is copyFile, but this will be called later in another goroutine
 	return nil
@@ -502,19 +2094,82 @@ func (c *Client) copyFile(resp *Response) stateFunc {
 
 	// We waited to truncate the file in openWriter() to make sure
 	// the BeforeCopy didn't cancel the copy. If this was an existing
-	// file that is not going to be resumed, truncate the contents.
-	if t, ok := resp.writer.(truncater); ok && resp.fi != nil && !resp.DidResume {
-		t.Truncate(0)
+	// file that is not going to be resumed, or is resumed from an offset
+	// before its end, truncate the contents. Files provided by the caller
+	// are never truncated.
+	if t, ok := resp.writer.(truncater); ok && resp.fi != nil && resp.fi.Size() > resp.bytesResumed && resp.Request.File == nil {
+		t.Truncate(resp.bytesResumed)
+	}
+
+	// preallocate disk space for the entire file, if the size is known
+	if f, ok := resp.writer.(*os.File); ok && resp.Request.Preallocate && resp.Size() > 0 {
+		resp.err = preallocate(f, resp.Size())
+		if resp.err != nil {
+			if isNoSpace(resp.err) {
+				resp.err = &noSpaceError{resp.err}
+			}
+			return c.closeResponse
+		}
+	}
+
+	// include resumed bytes in the computed checksum and tee
+	if resp.bytesResumed > 0 {
+		var prefix []io.Writer
+		if h := resp.Request.computeHash; h != nil {
+			prefix = append(prefix, h)
+		}
+		if resp.tee != nil {
+			prefix = append(prefix, resp.tee)
+		}
+		if len(prefix) > 0 {
+			resp.err = copyPrefix(resp, io.MultiWriter(prefix...))
+			if resp.err != nil {
+				return c.closeResponse
+			}
+		}
 	}
 
+	c.logf(resp, LogDebug, "transferring to %s", resp.Filename)
 	bytesCopied, resp.err = resp.transfer.copy()
 	if resp.err != nil {
 		return c.closeResponse
 	}
+	if w := resp.wrapWriter; w != nil {
+		resp.wrapWriter = nil
+		if resp.err = w.Close(); resp.err != nil {
+			if isNoSpace(resp.err) {
+				resp.err = &noSpaceError{resp.err}
+			}
+			return c.closeResponse
+		}
+	}
+	if b := resp.writeBuffer; b != nil {
+		if resp.err = b.Flush(); resp.err != nil {
+			if isNoSpace(resp.err) {
+				resp.err = &noSpaceError{resp.err}
+			}
+			return c.closeResponse
+		}
+	}
+	if w, ok := resp.writer.(*sparseWriter); ok {
+		// extend the file over any trailing blocks of zeros
+		if resp.err = w.extend(); resp.err != nil {
+			return c.closeResponse
+		}
+	}
+	if size := resp.Size(); size >= 0 && size != resp.bytesResumed+bytesCopied {
+		// size was declared by Request.SizeHeader, which is not enforced by
+		// the HTTPClient
+		resp.err = ErrBadLength
+		return c.closeResponse
+	}
 	closeWriter(resp)
+	if h := resp.Request.computeHash; h != nil {
+		resp.checksum = h.Sum(nil)
+	}
 
 	// set file timestamp
-	if !resp.Request.NoStore && !resp.Request.IgnoreRemoteTime {
+	if !resp.Request.NoStore && !resp.Request.IgnoreRemoteTime && resp.Request.ModTime.IsZero() {
 		resp.err = setLastModified(resp.HTTPResponse, resp.Filename)
 		if resp.err != nil {
 			return c.closeResponse
@@ -542,13 +2197,62 @@ func (c *Client) copyFile(resp *Response) stateFunc {
 	return c.checksumFile
 }
 
+// copyPrefix writes the bytes of the destination file that precede the resume
+// offset to the given writer.
+func copyPrefix(resp *Response, w io.Writer) error {
+	var r io.Reader
+	if resp.Request.File != nil {
+		r = io.NewSectionReader(resp.Request.File, 0, resp.bytesResumed)
+	} else {
+		f, err := os.Open(resp.Filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	_, err := io.CopyN(w, r, resp.bytesResumed)
+	return err
+}
+
 func closeWriter(resp *Response) {
-	if closer, ok := resp.writer.(io.Closer); ok {
+	if resp.wrapWriter != nil {
+		resp.wrapWriter.Close()
+		resp.wrapWriter = nil
+	}
+	if resp.writeBuffer != nil {
+		// keep any content already transferred, so that it may be resumed
+		resp.writeBuffer.Flush()
+	}
+	if closer, ok := resp.writer.(io.Closer); ok && resp.Request.File == nil {
 		closer.Close()
 	}
 	resp.writer = nil
 }
 
+// getBuffer returns a transfer buffer of the given size, reusing a buffer from
+// a previous transfer if one is available.
+func (c *Client) getBuffer(size int) *[]byte {
+	v, ok := c.bufferPools.Load(size)
+	if !ok {
+		v, _ = c.bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		})
+	}
+	return v.(*sync.Pool).Get().(*[]byte)
+}
+
+// putBuffer returns a transfer buffer obtained from getBuffer so it may be
+// reused. The buffer must not be used after calling putBuffer.
+func (c *Client) putBuffer(b *[]byte) {
+	if v, ok := c.bufferPools.Load(len(*b)); ok {
+		v.(*sync.Pool).Put(b)
+	}
+}
+
 // close finalizes the Response
 func (c *Client) closeResponse(resp *Response) stateFunc {
 	if resp.IsComplete() {
@@ -558,8 +2262,29 @@ func (c *Client) closeResponse(resp *Response) stateFunc {
 	resp.fi = nil
 	closeWriter(resp)
 	resp.closeResponseBody()
+	if resp.replaceFilename != "" {
+		// remove the temporary file of a failed transfer
+		os.Remove(resp.Filename)
+		resp.Filename, resp.replaceFilename = resp.replaceFilename, ""
+	}
+	if resp.buffer != nil {
+		c.putBuffer(resp.buffer)
+		resp.buffer = nil
+	}
+
+	if resp.stream != nil {
+		resp.stream.close(resp.err)
+	}
+	if resp.tee != nil {
+		resp.tee.close(resp.err)
+	}
 
 	resp.End = time.Now()
+	if resp.err != nil {
+		c.logf(resp, LogError, "transfer failed: %v", resp.err)
+	} else {
+		c.logf(resp, LogInfo, "transfer complete: %d bytes in %v", resp.BytesComplete(), resp.End.Sub(resp.Start))
+	}
 	close(resp.Done)
 	if resp.cancel != nil {
 		resp.cancel()
@@ -0,0 +1,240 @@
+package grab
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A ClientOption configures a Client created with NewClientWith.
+type ClientOption func(*Client) error
+
+// NewClientWith returns a new file download Client, using the default
+// configuration of NewClient modified by the given options. Options are applied
+// in the order given.
+func NewClientWith(options ...ClientOption) (*Client, error) {
+	c := NewClient()
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// httpClient returns the http.Client of the given Client. An error is returned
+// if the HTTPClient has been replaced with another implementation.
+func httpClient(c *Client) (*http.Client, error) {
+	if hc, ok := c.HTTPClient.(*http.Client); ok {
+		return hc, nil
+	}
+	return nil, errors.New("HTTPClient is not an *http.Client")
+}
+
+// transport returns the http.Transport of the given Client's HTTPClient. An
+// error is returned if the HTTPClient has been replaced with an implementation
+// that does not use an http.Transport.
+func transport(c *Client) (*http.Transport, error) {
+	if hc, ok := c.HTTPClient.(*http.Client); ok {
+		if t, ok := hc.Transport.(*http.Transport); ok {
+			return t, nil
+		}
+	}
+	return nil, errors.New("HTTPClient does not use an *http.Transport")
+}
+
+// WithTLSConfig specifies the TLS configuration used to connect to remote
+// servers, such as the root certificate authorities to trust or client
+// certificates to present.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) error {
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		t.TLSClientConfig = cfg
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify specifies whether the certificate chain and host name
+// presented by remote servers should be verified. It is applied to a copy of
+// any TLS configuration given by a preceding WithTLSConfig option.
+//
+// WARNING: disabling verification makes all downloads susceptible to
+// machine-in-the-middle attacks. It should only be used for testing or with
+// servers on a trusted network. Prefer WithTLSConfig with the server's
+// certificate authority added to RootCAs.
+func WithInsecureSkipVerify(skip bool) ClientOption {
+	return func(c *Client) error {
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		cfg := t.TLSClientConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		cfg.InsecureSkipVerify = skip
+		t.TLSClientConfig = cfg
+		return nil
+	}
+}
+
+// WithConnectTimeout specifies the maximum amount of time to wait for a
+// connection to a remote server to be established. Unlike the deadline of a
+// Request's context, it does not limit the duration of a transfer that is in
+// progress.
+func WithConnectTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d < 0 {
+			return errors.New("connect timeout must be zero or greater")
+		}
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+			return dial(ctx, network, addr)
+		}
+		return nil
+	}
+}
+
+// WithTLSHandshakeTimeout specifies the maximum amount of time to wait for a
+// TLS handshake with a remote server to complete. Zero means no timeout.
+func WithTLSHandshakeTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d < 0 {
+			return errors.New("TLS handshake timeout must be zero or greater")
+		}
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		t.TLSHandshakeTimeout = d
+		return nil
+	}
+}
+
+// WithResponseHeaderTimeout specifies the maximum amount of time to wait for
+// the response headers of a remote server after sending a request. It does not
+// limit the time taken to transfer the response body. Zero means no timeout.
+func WithResponseHeaderTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d < 0 {
+			return errors.New("response header timeout must be zero or greater")
+		}
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		t.ResponseHeaderTimeout = d
+		return nil
+	}
+}
+
+// WithMaxResponseHeaderBytes limits the size in bytes of the response headers
+// accepted from remote servers, including the status line. Requests to a
+// server that sends larger headers fail with an error, protecting against
+// untrusted servers that send excessive headers. Zero means the default limit
+// of the net/http package.
+func WithMaxResponseHeaderBytes(n int64) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return errors.New("maximum response header bytes must be zero or greater")
+		}
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		t.MaxResponseHeaderBytes = n
+		return nil
+	}
+}
+
+// WithCookieJar specifies the cookie jar used to store cookies set by remote
+// servers and to send them with subsequent requests, including requests that
+// follow a redirect. This allows downloads behind session-based
+// authentication. See also Request.Cookies.
+func WithCookieJar(jar http.CookieJar) ClientOption {
+	return func(c *Client) error {
+		hc, err := httpClient(c)
+		if err != nil {
+			return err
+		}
+		hc.Jar = jar
+		return nil
+	}
+}
+
+// WithAddressFamily specifies the network used to connect to remote servers,
+// which must be "tcp4" to connect only via IPv4, "tcp6" to connect only via
+// IPv6, or "tcp" to use either, which is the default. Forcing one address
+// family avoids delays on hosts where the other is misconfigured or broken.
+func WithAddressFamily(network string) ClientOption {
+	return func(c *Client) error {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("unsupported address family: %q", network)
+		}
+		t, err := transport(c)
+		if err != nil {
+			return err
+		}
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+		return nil
+	}
+}
+
+// WithByteQuota sets Client.ByteQuota, the maximum number of bytes the client
+// may transfer before new transfers fail with ErrQuotaExceeded. Zero means no
+// limit.
+func WithByteQuota(n int64) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return fmt.Errorf("invalid byte quota: %d", n)
+		}
+		c.ByteQuota = n
+		return nil
+	}
+}
+
+// WithMaxConcurrent sets Client.MaxOpenTransfers, limiting the number of
+// transfers the client may have in progress at once across all callers. Calls
+// to Do block until a transfer slot is free, or until the context of their
+// Request is canceled. Zero means no limit.
+//
+// The limit is independent of the number of workers given to DoBatch, which
+// only bounds the transfers of that batch. A batch with more workers than the
+// limit leaves the extra workers waiting for a slot, shared with all other
+// transfers of the client.
+func WithMaxConcurrent(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum open transfers: %d", n)
+		}
+		c.MaxOpenTransfers = n
+		return nil
+	}
+}
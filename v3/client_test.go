@@ -1,24 +1,39 @@
 package grab
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cavaliergopher/grab/v3/pkg/bps"
 	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
 )
 
@@ -202,6 +217,63 @@ func TestContentLength(t *testing.T) {
 }
 
 // TestAutoResume tests segmented downloading of a large file.
+// TestComputeChecksum tests that the checksum of a download is computed during
+// the transfer, including any resumed bytes, and reused for validation.
+func TestComputeChecksum(t *testing.T) {
+	size := 1048576
+	sum := grabtest.DefaultHandlerSHA256ChecksumBytes
+	filename := ".testComputeChecksum"
+	defer os.Remove(filename)
+
+	tests := []struct {
+		Name          string
+		ContentLength int  // of first download, resumed by the second
+		Validate      bool // share the hash with SetChecksum
+	}{
+		{"New", 0, false},
+		{"Resumed", size / 2, false},
+		{"Complete", size, false},
+		{"WithValidation", 0, true},
+		{"ResumedWithValidation", size / 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			os.Remove(filename)
+			if test.ContentLength > 0 {
+				grabtest.WithTestServer(t, func(url string) {
+					mustDo(mustNewRequest(filename, url))
+				}, grabtest.ContentLength(test.ContentLength))
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				h := sha256.New()
+				req := mustNewRequest(filename, url)
+				req.ComputeChecksum(h)
+				if test.Validate {
+					req.SetChecksum(h, sum, false)
+				}
+				resp := mustDo(req)
+				if !bytes.Equal(resp.Checksum(), sum) {
+					t.Errorf("expected checksum %x, got %x", sum, resp.Checksum())
+				}
+				if test.Validate && resp.checksumTransfer != nil {
+					t.Errorf("expected file to not be read again for validation")
+				}
+			})
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := mustDo(req)
+			if resp.Checksum() != nil {
+				t.Errorf("expected nil checksum, got %x", resp.Checksum())
+			}
+		})
+	})
+}
+
 func TestAutoResume(t *testing.T) {
 	segs := 8
 	size := 1048576
@@ -405,6 +477,221 @@ func TestBatch(t *testing.T) {
 	)
 }
 
+// TestBatchChecksumFactory tests that each request of a batch with the same
+// expected checksum is validated with its own hash from a factory.
+func TestBatchChecksumFactory(t *testing.T) {
+	tests := 16
+	size := 32768
+	sum := grabtest.MustHexDecodeString("e11360251d1173650cdcd20f111d8f1ca2e412f572e8b36a4dc067121c1799b8")
+
+	grabtest.WithTestServer(t, func(url string) {
+		var mu sync.Mutex
+		hashes := make(map[hash.Hash]bool)
+		factory := func() hash.Hash {
+			h := sha256.New()
+			mu.Lock()
+			hashes[h] = true
+			mu.Unlock()
+			return h
+		}
+
+		// each request is sent twice, with its clone
+		reqs := make([]*Request, 0, tests*2)
+		for i := 0; i < tests; i++ {
+			req := mustNewRequest("", url+fmt.Sprintf("/request_%d", i+1))
+			req.NoStore = true
+			req.SetChecksumFactory(factory, sum, false)
+			reqs = append(reqs, req, req.Clone(nil))
+		}
+		seen := make(map[hash.Hash]bool)
+		for resp := range DefaultClient.DoBatch(4, reqs...) {
+			if err := resp.Err(); err != nil {
+				t.Errorf("%s: %v", resp.Request.URL(), err)
+			}
+			h := resp.Request.hash
+			if seen[h] {
+				t.Errorf("%s: hash shared with another transfer", resp.Request.URL())
+			}
+			seen[h] = true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for h := range seen {
+			if !hashes[h] {
+				t.Errorf("expected all hashes to be created by the factory")
+			}
+		}
+	},
+		grabtest.ContentLength(size),
+	)
+}
+
+// TestBatchDependsOn tests that DoBatch starts a Request only once the
+// Requests it depends on have succeeded, and skips it if any of them failed.
+func TestBatchDependsOn(t *testing.T) {
+	notFound := grabtest.StatusCode(func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/f") {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	})
+	grabtest.WithTestServer(t, func(url string) {
+		for _, workers := range []int{1, 3, 0} {
+			names := []string{"d", "c", "b", "a", "h", "g", "f", "i"}
+			reqs := make(map[string]*Request)
+			batch := make([]*Request, 0, len(names))
+			for _, name := range names {
+				req := mustNewRequest("", url+"/"+name)
+				req.NoStore = true
+				reqs[name] = req
+				batch = append(batch, req)
+			}
+			reqs["b"].DependsOn(reqs["a"])
+			reqs["c"].DependsOn(reqs["a"])
+			reqs["d"].DependsOn(reqs["b"])
+			reqs["d"].DependsOn(reqs["c"])
+			reqs["g"].DependsOn(reqs["f"])
+			reqs["h"].DependsOn(reqs["g"])
+
+			// high priorities would start dependents first without dependencies
+			reqs["d"].Priority = 2
+			reqs["h"].Priority = 1
+
+			resps := make(map[string]*Response)
+			for resp := range DefaultClient.DoBatch(workers, batch...) {
+				resps[strings.TrimPrefix(resp.Request.URL().Path, "/")] = resp
+			}
+			if len(resps) != len(reqs) {
+				t.Fatalf("expected %d responses, got %d", len(reqs), len(resps))
+			}
+			for _, name := range []string{"a", "b", "c", "d", "i"} {
+				if err := resps[name].Err(); err != nil {
+					t.Errorf("%d workers: %s: unexpected error: %v", workers, name, err)
+				}
+			}
+			for name, deps := range map[string][]string{"b": {"a"}, "c": {"a"}, "d": {"b", "c"}} {
+				for _, dep := range deps {
+					if resps[name].Start.Before(resps[dep].End) {
+						t.Errorf("%d workers: expected %s to start after %s completed", workers, name, dep)
+					}
+				}
+			}
+			if !IsStatusCodeError(resps["f"].Err()) {
+				t.Errorf("%d workers: expected status code error for f, got %v", workers, resps["f"].Err())
+			}
+			for _, name := range []string{"g", "h"} {
+				err := resps[name].Err()
+				var statusErr StatusCodeError
+				if !errors.Is(err, ErrDependencyFailed) || !errors.As(err, &statusErr) {
+					t.Errorf("%d workers: %s: expected failed dependency, got %v", workers, name, err)
+				}
+				if resps[name].HTTPResponse != nil {
+					t.Errorf("%d workers: expected %s not to be sent", workers, name)
+				}
+			}
+		}
+	}, notFound, grabtest.ContentLength(1024))
+
+	t.Run("Cycle", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			a := mustNewRequest("", url+"/a")
+			b := mustNewRequest("", url+"/b")
+			a.DependsOn(b)
+			b.DependsOn(a)
+			for resp := range DefaultClient.DoBatch(0, a, b) {
+				if err := resp.Err(); !errors.Is(err, ErrBadRequest) {
+					t.Errorf("expected %v, got %v", ErrBadRequest, err)
+				}
+			}
+		})
+	})
+}
+
+// TestBatchFailFast tests that a batch is aborted once any transfer fails.
+func TestBatchFailFast(t *testing.T) {
+	notFound := grabtest.StatusCode(func(r *http.Request) int {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			return http.StatusNotFound
+		}
+		return http.StatusOK
+	})
+	tests := []struct {
+		Name          string
+		Workers       int
+		Priority      int // of the failing request
+		ExpectStarted int
+	}{
+		{"Concurrent", 0, -1, 8},
+		{"Queued", 1, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				reqs := make([]*Request, 8)
+				for i := 0; i < len(reqs); i++ {
+					reqs[i] = mustNewRequest("", url+fmt.Sprintf("/.testBatchFailFast%d", i))
+					reqs[i].NoStore = true
+				}
+				reqs[3] = mustNewRequest("", url+"/missing")
+				reqs[3].NoStore = true
+				reqs[3].Priority = test.Priority
+
+				start := time.Now()
+				respch, failed := DefaultClient.DoBatchFailFast(context.Background(), test.Workers, reqs...)
+				started := 0
+				for resp := range respch {
+					started++
+					err := resp.Err()
+					if resp.Request.URL().Path == "/missing" {
+						if !IsStatusCodeError(err) {
+							t.Errorf("expected status code error, got %v", err)
+						}
+					} else if err != context.Canceled {
+						t.Errorf("expected %v, got %v", context.Canceled, err)
+					}
+				}
+				if d := time.Since(start); d > 5*time.Second {
+					t.Errorf("expected batch to abort promptly, took %v", d)
+				}
+				if started != test.ExpectStarted {
+					t.Errorf("expected %d transfers started, got %d", test.ExpectStarted, started)
+				}
+				if resp := failed(); resp == nil || resp.Request.URL().Path != "/missing" {
+					t.Errorf("expected failed response for /missing, got %v", resp)
+				}
+			},
+				notFound,
+				grabtest.WithRateLimit(64*1024),
+			)
+		})
+	}
+}
+
+// TestBatchPriority tests that requests in a batch are started in order of
+// their priority.
+func TestBatchPriority(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, 8)
+		for i := range reqs {
+			reqs[i] = mustNewRequest("", url+fmt.Sprintf("/request_%d", i))
+			reqs[i].NoStore = true
+			reqs[i].Label = fmt.Sprintf("low %d", i)
+		}
+		reqs[len(reqs)-1].Priority = 1
+		reqs[len(reqs)-1].Label = "high"
+
+		var labels []string
+		for resp := range DefaultClient.DoBatch(1, reqs...) {
+			testComplete(t, resp)
+			labels = append(labels, resp.Request.Label)
+		}
+		expect := []string{"high", "low 0", "low 1", "low 2", "low 3", "low 4", "low 5", "low 6"}
+		if fmt.Sprint(labels) != fmt.Sprint(expect) {
+			t.Errorf("expected requests to start in order %v, got %v", expect, labels)
+		}
+	}, grabtest.ContentLength(1024))
+}
+
 // TestCancelContext tests that a batch of requests can be cancel using a
 // context.Context cancellation. Requests are cancelled in multiple states:
 // in-progress and unstarted.
@@ -428,8 +715,7 @@ func TestCancelContext(t *testing.T) {
 		for resp := range respch {
 			defer os.Remove(resp.Filename)
 
-			// err should be context.Canceled or http.errRequestCanceled
-			if resp.Err() == nil || !strings.Contains(resp.Err().Error(), "canceled") {
+			if !IsCanceled(resp.Err()) {
 				t.Errorf("expected '%v', got '%v'", context.Canceled, resp.Err())
 			}
 			if resp.BytesComplete() >= int64(fileSize) {
@@ -532,6 +818,28 @@ func TestRemoteTime(t *testing.T) {
 	)
 }
 
+func TestModTime(t *testing.T) {
+	filename := "./.testModTime"
+	defer os.Remove(filename)
+
+	expect := time.Unix(rand.Int63n(time.Now().Unix()), 0)
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.ModTime = expect
+		resp := mustDo(req)
+		fi, err := os.Stat(resp.Filename)
+		if err != nil {
+			panic(err)
+		}
+		actual := fi.ModTime()
+		if !actual.Equal(expect) {
+			t.Errorf("expected %v, got %v", expect, actual)
+		}
+	},
+		grabtest.LastModified(time.Now().Add(-time.Hour)),
+	)
+}
+
 func TestResponseCode(t *testing.T) {
 	filename := "./.testResponseCode"
 
@@ -666,6 +974,104 @@ func TestBeforeCopyHook(t *testing.T) {
 	})
 }
 
+// TestOnResolvedHook tests that the OnResolved hook may redirect a download to
+// another file or cancel it before any file is created.
+// TestPrecondition tests that a download is cancelled before any file is
+// written if the Request.Precondition rejects the response.
+func TestPrecondition(t *testing.T) {
+	filename := ".testPrecondition"
+	errNotZip := errors.New("not a zip file")
+	requireZip := func(resp *http.Response) error {
+		if resp.Request.Method != "GET" {
+			t.Errorf("expected precondition to be called for GET, got %s", resp.Request.Method)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/zip" {
+			return errNotZip
+		}
+		return nil
+	}
+
+	t.Run("Accept", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Precondition = requireZip
+			testComplete(t, mustDo(req))
+		},
+			grabtest.ContentType("application/zip"),
+		)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Precondition = requireZip
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != errNotZip {
+				t.Errorf("expected error '%v', got '%v'", errNotZip, err)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected file to not be created, got: %v", err)
+			}
+		},
+			grabtest.ContentType("text/html"),
+		)
+	})
+}
+
+func TestOnResolvedHook(t *testing.T) {
+	filename := "./.testOnResolved"
+	t.Run("Redirect", func(t *testing.T) {
+		redirected := filename + ".redirected"
+		defer os.RemoveAll(filename)
+		defer os.RemoveAll(redirected)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.OnResolved = func(resp *Response) error {
+				if resp.Size() != 1048576 {
+					t.Errorf("expected size 1048576 when OnResolved was called, got %d", resp.Size())
+				}
+				resp.Filename = redirected
+				return nil
+			}
+			resp := mustDo(req)
+			if resp.Filename != redirected {
+				t.Errorf("expected Response.Filename '%s', got '%s'", redirected, resp.Filename)
+			}
+			testComplete(t, resp)
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected original file to not exist, got: %v", err)
+			}
+			fi, err := os.Stat(redirected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 1048576 {
+				t.Errorf("expected redirected file size 1048576, got %d", fi.Size())
+			}
+		})
+	})
+
+	t.Run("WithError", func(t *testing.T) {
+		defer os.RemoveAll(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			testError := errors.New("test")
+			req := mustNewRequest(filename, url)
+			req.OnResolved = func(resp *Response) error {
+				return testError
+			}
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != testError {
+				t.Errorf("expected error '%v', got '%v'", testError, err)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected file to not be created, got: %v", err)
+			}
+		})
+	})
+}
+
 func TestAfterCopyHook(t *testing.T) {
 	filename := "./.testAfterCopy"
 	t.Run("Noop", func(t *testing.T) {
@@ -789,6 +1195,48 @@ func TestHeadBadStatus(t *testing.T) {
 	)
 }
 
+// TestErrorBodySize tests that the body of an error response is captured and
+// is not written to the destination.
+func TestErrorBodySize(t *testing.T) {
+	filename := ".testErrorBodySize"
+	body := `{"error":"not found"}`
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method == "GET" {
+			io.WriteString(w, body)
+		}
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		Name   string
+		Size   int
+		Expect string
+	}{
+		{"Disabled", 0, ""},
+		{"Truncated", 8, body[:8]},
+		{"Complete", 1024, body},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			req := mustNewRequest(filename, s.URL)
+			req.ErrorBodySize = test.Size
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != StatusCodeError(http.StatusNotFound) {
+				t.Errorf("expected %v, got %v", StatusCodeError(http.StatusNotFound), err)
+			}
+			if b := string(resp.ErrorBody()); b != test.Expect {
+				t.Errorf("expected error body %q, got %q", test.Expect, b)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be created", filename)
+			}
+		})
+	}
+}
+
 // TestMissingContentLength ensures that the Response.Size is correct for
 // transfers where the remote server does not send a Content-Length header.
 //
@@ -912,3 +1360,3119 @@ func TestNoStore(t *testing.T) {
 		})
 	})
 }
+
+// BenchmarkTransfer measures the overhead of transferring a file from a local
+// test server. The RateLimited case serves the file at a fixed rate so that any
+// additional time per operation can be attributed to grab.
+func BenchmarkTransfer(b *testing.B) {
+	size := 1048576
+	tests := []struct {
+		Name    string
+		Options []grabtest.HandlerOption
+	}{
+		{"Unlimited", nil},
+		{"RateLimited", []grabtest.HandlerOption{grabtest.WithRateLimit(size * 16)}},
+	}
+
+	for _, test := range tests {
+		b.Run(test.Name, func(b *testing.B) {
+			opts := append([]grabtest.HandlerOption{grabtest.ContentLength(size)}, test.Options...)
+			grabtest.WithTestServer(b, func(url string) {
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req := mustNewRequest("", url+"/.benchmarkTransfer")
+					req.NoStore = true
+					if err := DefaultClient.Do(req).Err(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}, opts...)
+		})
+	}
+}
+
+// BenchmarkChecksum compares validating the checksum of a downloaded file as
+// it is transferred to reading the file again once the transfer is complete.
+func BenchmarkChecksum(b *testing.B) {
+	filename := ".benchmarkChecksum"
+	size := 16 << 20
+	defer os.Remove(filename)
+	tests := []struct {
+		Name   string
+		ReRead bool
+	}{
+		{"Inline", false},
+		{"ReRead", true},
+	}
+	grabtest.WithTestServer(b, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.ComputeChecksum(sha256.New())
+		sum := mustDo(req).Checksum()
+		for _, test := range tests {
+			b.Run(test.Name, func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					os.Remove(filename)
+					req := mustNewRequest(filename, url)
+					req.SetChecksum(sha256.New(), sum, false)
+					if test.ReRead {
+						// a different computed hash forces the file to be
+						// read again
+						req.ComputeChecksum(md5.New())
+					}
+					if err := DefaultClient.Do(req).Err(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}, grabtest.ContentLength(size))
+}
+
+// TestResumeAfterConnectionDrop tests that a download interrupted by a dropped
+// connection can be completed by subsequent requests.
+func TestResumeAfterConnectionDrop(t *testing.T) {
+	filename := ".testResumeAfterConnectionDrop"
+	defer os.Remove(filename)
+	size := 4096
+	afterBytes := 1024
+
+	grabtest.WithTestServer(t, func(url string) {
+		for i := 1; i <= size/afterBytes; i++ {
+			req := mustNewRequest(filename, url)
+			resp := DefaultClient.Do(req)
+			err := resp.Err()
+			if i < size/afterBytes && err == nil {
+				t.Fatalf("expected error for request %d, got nil", i)
+			}
+			if i == size/afterBytes && err != nil {
+				t.Fatalf("expected no error for request %d, got: %v", i, err)
+			}
+			if expect := int64(i * afterBytes); resp.BytesComplete() != expect {
+				t.Errorf("expected Response.BytesComplete: %d, got: %d", expect, resp.BytesComplete())
+			}
+		}
+	},
+		grabtest.ContentLength(size),
+		grabtest.WithMidStreamClose(afterBytes),
+	)
+}
+
+// TestReadRetries tests that a transfer is continued from the current offset
+// when the connection is closed mid-body, until the retry budget is spent.
+func TestReadRetries(t *testing.T) {
+	size := 4096
+	afterBytes := 1024
+	tests := []struct {
+		Name    string
+		Retries int
+		Err     bool
+	}{
+		{"Complete", 3, false},
+		{"Exhausted", 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				req.ReadRetries = test.Retries
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); test.Err && err == nil {
+					t.Errorf("expected error, got nil")
+				} else if !test.Err && err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if test.Err {
+					return
+				}
+				b, err := resp.Bytes()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) != size {
+					t.Fatalf("expected %d bytes, got %d", size, len(b))
+				}
+				for i := range b {
+					if b[i] != byte(i) {
+						t.Fatalf("unexpected byte at offset %d", i)
+					}
+				}
+			},
+				grabtest.ContentLength(size),
+				grabtest.WithMidStreamClose(afterBytes),
+			)
+		})
+	}
+}
+
+// TestResumePolicy tests that each action returned by Request.ResumePolicy is
+// applied to an existing file.
+func TestResumePolicy(t *testing.T) {
+	filename := ".testResumePolicy"
+	size := 4096
+	partial := 1024
+	expectErr := errors.New("policy failed")
+
+	tests := []struct {
+		Name       string
+		Action     ResumeAction
+		Err        error
+		DidResume  bool
+		ExpectSize int
+	}{
+		{"Resume", ActionResume, nil, true, size},
+		{"Restart", ActionRestart, nil, false, size},
+		{"Skip", ActionSkip, nil, true, partial},
+		{"Fail", ActionFail, ErrFileExists, false, partial},
+		{"Error", ActionResume, expectErr, false, partial},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			b := make([]byte, partial)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			grabtest.WithTestServer(t, func(url string) {
+				called := false
+				req := mustNewRequest(filename, url)
+				req.NoResume = true // ignored in favor of the policy
+				req.ResumePolicy = func(local os.FileInfo, remote *http.Response) (ResumeAction, error) {
+					called = true
+					if local.Size() != int64(partial) {
+						t.Errorf("expected local size %d, got %d", partial, local.Size())
+					}
+					if remote == nil || remote.ContentLength != int64(size) {
+						t.Errorf("expected remote response with size %d", size)
+					}
+					if test.Err == expectErr {
+						return test.Action, expectErr
+					}
+					return test.Action, nil
+				}
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Fatalf("expected error %v, got %v", test.Err, err)
+				}
+				if !called {
+					t.Errorf("expected ResumePolicy to be called")
+				}
+				if resp.DidResume != test.DidResume {
+					t.Errorf("expected Response.DidResume: %v, got: %v", test.DidResume, resp.DidResume)
+				}
+				fi, err := os.Stat(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != int64(test.ExpectSize) {
+					t.Errorf("expected file size %d, got %d", test.ExpectSize, fi.Size())
+				}
+				if test.ExpectSize == size {
+					f, err := os.Open(filename)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer f.Close()
+					b, _ := ioutil.ReadAll(f)
+					for i := range b {
+						if b[i] != byte(i) {
+							t.Fatalf("unexpected byte at offset %d", i)
+						}
+					}
+				}
+			},
+				grabtest.ContentLength(size),
+			)
+		})
+	}
+}
+
+// TestResumeFrom tests that a transfer can be resumed from an explicit offset
+// in an existing file.
+func TestResumeFrom(t *testing.T) {
+	filename := ".testResumeFrom"
+	offset := 512
+
+	// seed a file with the first bytes of the download, followed by garbage
+	seed := func() {
+		b := make([]byte, offset*2)
+		for i := 0; i < len(b); i++ {
+			b[i] = byte(i)
+			if i >= offset {
+				b[i] = 0xFF
+			}
+		}
+		if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeFrom = int64(offset)
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if resp.bytesResumed != int64(offset) {
+				t.Errorf("expected %d bytes resumed, got %d", offset, resp.bytesResumed)
+			}
+			testComplete(t, resp)
+		})
+	})
+
+	t.Run("WithShortFile", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeFrom = int64(offset * 4)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadLength {
+				t.Errorf("expected error: %v, got: %v", ErrBadLength, err)
+			}
+		})
+	})
+
+	t.Run("WithNoResume", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.ResumeFrom = int64(offset)
+			req.NoResume = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadRequest {
+				t.Errorf("expected error: %v, got: %v", ErrBadRequest, err)
+			}
+		})
+	})
+}
+
+// TestReSign tests that an expired pre-signed URL is renewed using
+// Request.ReSign and the transfer is resumed.
+func TestReSign(t *testing.T) {
+	filename := ".testReSign"
+	defer os.Remove(filename)
+	size := 4096
+
+	// expected content and a partial download
+	content := make([]byte, size)
+	for i := 0; i < size; i++ {
+		content[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filename, content[:size/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") != "fresh" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>")
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	t.Run("WithReSign", func(t *testing.T) {
+		called := 0
+		req := mustNewRequest(filename, s.URL+"/file?signature=expired")
+		req.ReSign = func(old *url.URL) (*url.URL, error) {
+			called++
+			u := *old
+			u.RawQuery = "signature=fresh"
+			return &u, nil
+		}
+		resp := mustDo(req)
+		if called != 1 {
+			t.Errorf("expected ReSign to be called once, got %d", called)
+		}
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+		b, err := resp.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("downloaded content does not match")
+		}
+		testComplete(t, resp)
+	})
+
+	t.Run("WithoutReSign", func(t *testing.T) {
+		req := mustNewRequest(filename+"2", s.URL+"/file?signature=expired")
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != StatusCodeError(http.StatusForbidden) {
+			t.Errorf("expected error: %v, got: %v", StatusCodeError(http.StatusForbidden), err)
+		}
+	})
+}
+
+// BenchmarkBatch measures the allocations made by a batch of concurrent
+// transfers, which reuse transfer buffers via the Client's buffer pool.
+func BenchmarkBatch(b *testing.B) {
+	size := 65536
+	tests := 32
+	client := NewClient()
+	grabtest.WithTestServer(b, func(url string) {
+		reqs := make([]*Request, tests)
+		b.SetBytes(int64(size * tests))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < tests; j++ {
+				filename := fmt.Sprintf(".benchmarkBatch.%d", j+1)
+				reqs[j] = mustNewRequest(filename, url)
+				reqs[j].NoResume = true
+			}
+			for resp := range client.DoBatch(4, reqs...) {
+				if err := resp.Err(); err != nil {
+					b.Fatal(err)
+				}
+				os.Remove(resp.Filename)
+			}
+		}
+	}, grabtest.ContentLength(size))
+}
+
+// TestBufferPool tests that transfer buffers of different sizes are pooled
+// separately.
+func TestBufferPool(t *testing.T) {
+	client := NewClient()
+	for _, size := range []int{8, 32 * 1024, 8} {
+		b := client.getBuffer(size)
+		if len(*b) != size {
+			t.Errorf("expected buffer size: %d, got: %d", size, len(*b))
+		}
+		client.putBuffer(b)
+	}
+}
+
+// TestNoHead tests that transfers can be resumed without sending a HEAD request
+// to servers that fail to respond to HEAD requests.
+func TestNoHead(t *testing.T) {
+	filename := ".testNoHead"
+	size := 1048576
+
+	// seed a partially completed download
+	seed := func() {
+		b := make([]byte, size/2)
+		for i := 0; i < len(b); i++ {
+			b[i] = byte(i)
+		}
+		if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("WithResume", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.NoHead = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if resp.bytesResumed != int64(size/2) {
+				t.Errorf("expected %d bytes resumed, got %d", size/2, resp.bytesResumed)
+			}
+			testComplete(t, resp)
+		},
+			grabtest.WithHeadConnectionDrop(),
+		)
+	})
+
+	t.Run("WithoutAcceptRanges", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.NoHead = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
+			}
+			testComplete(t, resp)
+		},
+			grabtest.WithHeadConnectionDrop(),
+			grabtest.AcceptRanges(false),
+		)
+	})
+
+	t.Run("WithFilenameFromResponse", func(t *testing.T) {
+		seed()
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/"+filename)
+			req.NoHead = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if resp.Filename != filename {
+				t.Errorf("expected Response.Filename: %s, got: %s", filename, resp.Filename)
+			}
+			testComplete(t, resp)
+		},
+			grabtest.WithHeadConnectionDrop(),
+		)
+	})
+}
+
+// TestRangeProbe tests that the size of a remote file and support for ranged
+// requests are determined from a request for its first byte if the remote
+// server rejects HEAD requests.
+func TestRangeProbe(t *testing.T) {
+	filename := ".testRangeProbe"
+	size := 1048576
+	defer os.Remove(filename)
+
+	b := make([]byte, size/2)
+	for i := 0; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		resp := mustDo(req)
+		if !resp.CanResume {
+			t.Errorf("expected Response.CanResume to be true")
+		}
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+		if resp.bytesResumed != int64(size/2) {
+			t.Errorf("expected %d bytes resumed, got %d", size/2, resp.bytesResumed)
+		}
+		testComplete(t, resp)
+	},
+		grabtest.MethodWhitelist("GET"),
+	)
+}
+
+// TestTLSConfig tests that a Client can be configured to trust a server with a
+// self-signed certificate.
+func TestTLSConfig(t *testing.T) {
+	h, err := grabtest.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewTLSServer(h)
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	tests := []struct {
+		Name    string
+		Options []ClientOption
+		Match   bool
+	}{
+		{"Default", nil, false},
+		{"WithTLSConfig", []ClientOption{WithTLSConfig(&tls.Config{RootCAs: pool})}, true},
+		{"WithInsecureSkipVerify", []ClientOption{WithInsecureSkipVerify(true)}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client, err := NewClientWith(test.Options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := mustNewRequest("", s.URL+"/.testTLSConfig")
+			req.NoStore = true
+			resp := client.Do(req)
+			err = resp.Err()
+			if test.Match && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.Match && err == nil {
+				t.Errorf("expected certificate verification error")
+			}
+		})
+	}
+
+	t.Run("WithCustomTransport", func(t *testing.T) {
+		client := NewClient()
+		client.HTTPClient = &http.Client{
+			Transport: http.NewFileTransport(http.Dir(".")),
+		}
+		if err := WithInsecureSkipVerify(true)(client); err == nil {
+			t.Errorf("expected error for transport of type %T", client.HTTPClient.(*http.Client).Transport)
+		}
+	})
+}
+
+// TestRequestFile tests that transfers can be written to, and resumed into, a
+// file opened by the caller.
+func TestRequestFile(t *testing.T) {
+	size := 1048576
+	newFile := func(n int) *os.File {
+		f, err := ioutil.TempFile(".", ".testRequestFile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, n)
+		for i := 0; i < n; i++ {
+			b[i] = byte(i)
+		}
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	tests := []struct {
+		Name         string
+		SeedSize     int
+		ExpectResume bool
+	}{
+		{"New", 0, false},
+		{"Resume", size / 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			f := newFile(test.SeedSize)
+			defer os.Remove(f.Name())
+			defer f.Close()
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url+"/ignored")
+				req.File = f
+				req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+				resp := mustDo(req)
+				if resp.Filename != f.Name() {
+					t.Errorf("expected Response.Filename: %s, got: %s", f.Name(), resp.Filename)
+				}
+				if resp.DidResume != test.ExpectResume {
+					t.Errorf("expected Response.DidResume: %v, got: %v", test.ExpectResume, resp.DidResume)
+				}
+				testComplete(t, resp)
+
+				// file should remain open
+				if _, err := f.Stat(); err != nil {
+					t.Errorf("expected file to remain open, got: %v", err)
+				}
+			})
+		})
+	}
+}
+
+// TestPreallocate tests that the destination file is extended to its full size
+// before the transfer starts.
+func TestPreallocate(t *testing.T) {
+	filename := ".testPreallocate"
+	size := 1048576
+
+	t.Run("New", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Preallocate = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			req.BeforeCopy = func(resp *Response) error {
+				fi, err := os.Stat(filename)
+				if err != nil {
+					return err
+				}
+				if fi.Size() != 0 {
+					t.Errorf("expected file size before copy: 0, got: %d", fi.Size())
+				}
+				return nil
+			}
+
+			// check the file size once the transfer has started
+			checked := false
+			req.RateLimiter = rateLimiterFunc(func(ctx context.Context, n int) error {
+				if checked {
+					return nil
+				}
+				checked = true
+				fi, err := os.Stat(filename)
+				if err != nil {
+					return err
+				}
+				if fi.Size() != int64(size) {
+					t.Errorf("expected file size during copy: %d, got: %d", size, fi.Size())
+				}
+				return nil
+			})
+			resp := mustDo(req)
+			testComplete(t, resp)
+		})
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		defer os.Remove(filename)
+		b := make([]byte, size/2)
+		for i := 0; i < len(b); i++ {
+			b[i] = byte(i)
+		}
+		if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Preallocate = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			testComplete(t, resp)
+		})
+	})
+
+	t.Run("WithUnknownSize", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.Preallocate = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			testComplete(t, resp)
+		},
+			grabtest.HeaderBlacklist("Content-Length"),
+		)
+	})
+}
+
+// TestRequestClone tests that a cloned Request can be reused as a template
+// without leaking state between transfers.
+func TestRequestClone(t *testing.T) {
+	size := 1048576
+	filename := ".testRequestClone"
+	defer os.Remove(filename)
+	defer os.Remove(filename + "2")
+
+	// seed a partial file that will be resumed by the first clone
+	if err := ioutil.WriteFile(filename, make([]byte, size/2), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		template := mustNewRequest("", url)
+		template.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+
+		req1 := template.Clone(sha256.New())
+		req1.Filename = filename
+		resp1 := DefaultClient.Do(req1)
+		if err := resp1.Err(); err != ErrBadChecksum {
+			t.Errorf("expected error: %v, got: %v", ErrBadChecksum, err)
+		}
+		if !resp1.DidResume {
+			t.Errorf("expected first Response.DidResume to be true")
+		}
+		if v := resp1.Request.HTTPRequest.Header.Get("Range"); v == "" {
+			t.Errorf("expected first request to set Range header")
+		}
+
+		req2 := template.Clone(sha256.New())
+		req2.Filename = filename + "2"
+		resp2 := mustDo(req2)
+		if resp2.DidResume {
+			t.Errorf("expected second Response.DidResume to be false")
+		}
+		for _, req := range []*Request{template, req2, resp2.Request} {
+			if v := req.HTTPRequest.Header.Get("Range"); v != "" {
+				t.Errorf("expected no Range header, got: %s", v)
+			}
+		}
+		testComplete(t, resp2)
+
+		// clone without a hash
+		req3 := template.Clone(nil)
+		if req3.hash != nil || req3.checksum != nil {
+			t.Errorf("expected checksum validation to be disabled")
+		}
+	})
+}
+
+// TestClientHeader tests that default headers set on a Client are sent with
+// each request, unless overridden by the request.
+func TestClientHeader(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]http.Header)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received[r.Method+" "+r.URL.Path] = r.Header.Clone()
+		mu.Unlock()
+		w.Write([]byte("content"))
+	}))
+	defer s.Close()
+
+	client := NewClient()
+	client.Header = http.Header{
+		"Authorization": {"Bearer client"},
+		"x-client-only": {"client"},
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/default")
+		req.NoStore = true
+		if err := client.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		h := received["GET /default"]
+		mu.Unlock()
+		if v := h.Get("Authorization"); v != "Bearer client" {
+			t.Errorf("expected Authorization header: %s, got: %s", "Bearer client", v)
+		}
+		if v := h.Get("X-Client-Only"); v != "client" {
+			t.Errorf("expected X-Client-Only header: %s, got: %s", "client", v)
+		}
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/override")
+		req.NoStore = true
+		req.HTTPRequest.Header.Set("Authorization", "Bearer request")
+		if err := client.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		h := received["GET /override"]
+		mu.Unlock()
+		if v := h.Get("Authorization"); v != "Bearer request" {
+			t.Errorf("expected Authorization header: %s, got: %s", "Bearer request", v)
+		}
+		if v := h.Get("X-Client-Only"); v != "client" {
+			t.Errorf("expected X-Client-Only header: %s, got: %s", "client", v)
+		}
+	})
+
+	t.Run("Reuse", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/reuse")
+		req.NoStore = true
+		if err := client.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if v := req.HTTPRequest.Header.Get("Authorization"); v != "" {
+			t.Errorf("expected request headers not to be modified, got Authorization: %s", v)
+		}
+
+		// the same request sent by another client carries only its headers
+		other := NewClient()
+		other.Header = http.Header{"Authorization": {"Bearer other"}}
+		if err := other.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		h := received["GET /reuse"]
+		mu.Unlock()
+		if v := h.Get("Authorization"); v != "Bearer other" {
+			t.Errorf("expected Authorization header: %s, got: %s", "Bearer other", v)
+		}
+		if v := h.Get("X-Client-Only"); v != "" {
+			t.Errorf("expected no X-Client-Only header, got: %s", v)
+		}
+	})
+}
+
+// TestClientTimeouts tests that a Client can be configured to fail quickly when
+// a remote server does not respond.
+func TestClientTimeouts(t *testing.T) {
+	// listener that accepts connections but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// dialer that never connects
+	hangingDialer := func(c *Client) error {
+		c.HTTPClient.(*http.Client).Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil
+	}
+
+	timeout := 100 * time.Millisecond
+	tests := []struct {
+		Name    string
+		Scheme  string
+		Options []ClientOption
+	}{
+		{"Connect", "http", []ClientOption{hangingDialer, WithConnectTimeout(timeout)}},
+		{"TLSHandshake", "https", []ClientOption{WithTLSHandshakeTimeout(timeout)}},
+		{"ResponseHeader", "http", []ClientOption{WithResponseHeaderTimeout(timeout)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client, err := NewClientWith(test.Options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := mustNewRequest("", fmt.Sprintf("%s://%s/.testClientTimeouts", test.Scheme, l.Addr()))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*timeout)
+			defer cancel()
+			resp := client.Do(req.WithContext(ctx))
+			if err := resp.Err(); err == nil {
+				t.Errorf("expected timeout error")
+			}
+			if ctx.Err() != nil {
+				t.Errorf("expected transfer to time out before the request context")
+			}
+		})
+	}
+}
+
+// TestSingleFlight tests that concurrent requests for the same URL and
+// destination share a single transfer when Client.SingleFlight is enabled.
+func TestSingleFlight(t *testing.T) {
+	filename := ".testSingleFlight"
+	defer os.Remove(filename)
+
+	var gets int32
+	countGets := grabtest.StatusCode(func(r *http.Request) int {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		return http.StatusOK
+	})
+
+	grabtest.WithTestServer(t, func(url string) {
+		client := NewClient()
+		client.SingleFlight = true
+
+		n := 10
+		start := make(chan struct{})
+		resps := make([]*Response, n)
+		wg := sync.WaitGroup{}
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				resps[i] = client.Do(mustNewRequest(filename, url))
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		for _, resp := range resps {
+			testComplete(t, resp)
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if n := atomic.LoadInt32(&gets); n != 1 {
+			t.Errorf("expected 1 GET request, got %d", n)
+		}
+	},
+		countGets,
+		grabtest.TimeToFirstByte(100*time.Millisecond),
+	)
+}
+
+// openBodyCounter is a HTTPClient that tracks the peak number of response
+// bodies open at once.
+type openBodyCounter struct {
+	HTTPClient
+	mu   sync.Mutex
+	open int
+	peak int
+}
+
+func (c *openBodyCounter) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.open++
+	if c.open > c.peak {
+		c.peak = c.open
+	}
+	c.mu.Unlock()
+	resp.Body = &countedBody{ReadCloser: resp.Body, c: c}
+	return resp, nil
+}
+
+type countedBody struct {
+	io.ReadCloser
+	c    *openBodyCounter
+	once sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() {
+		b.c.mu.Lock()
+		b.c.open--
+		b.c.mu.Unlock()
+	})
+	return b.ReadCloser.Close()
+}
+
+// TestMaxOpenTransfers tests that a large batch with unlimited workers never
+// holds open more connections than Client.MaxOpenTransfers.
+func TestMaxOpenTransfers(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		counter := &openBodyCounter{HTTPClient: DefaultClient.HTTPClient}
+		client := NewClient()
+		client.HTTPClient = counter
+		client.MaxOpenTransfers = 3
+
+		reqs := make([]*Request, 50)
+		for i := 0; i < len(reqs); i++ {
+			reqs[i] = mustNewRequest("", url+fmt.Sprintf("/.testMaxOpenTransfers%d", i))
+			reqs[i].NoStore = true
+		}
+		for resp := range client.DoBatch(0, reqs...) {
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if counter.peak > client.MaxOpenTransfers {
+			t.Errorf("expected at most %d open transfers, got %d", client.MaxOpenTransfers, counter.peak)
+		}
+		if counter.open != 0 {
+			t.Errorf("expected no open transfers, got %d", counter.open)
+		}
+	},
+		grabtest.ContentLength(4096),
+		grabtest.TimeToFirstByte(10*time.Millisecond),
+	)
+}
+
+// idleCounter is an HTTPClient that counts calls to CloseIdleConnections.
+type idleCounter struct {
+	*http.Client
+	closed int
+}
+
+func (c *idleCounter) CloseIdleConnections() {
+	c.closed++
+	c.Client.CloseIdleConnections()
+}
+
+// TestClientClose tests that a closed Client releases its idle connections and
+// fails new transfers.
+func TestClientClose(t *testing.T) {
+	var requests int32
+	grabtest.WithTestServer(t, func(url string) {
+		hc := &idleCounter{Client: &http.Client{Transport: &http.Transport{}}}
+		client := NewClient()
+		client.HTTPClient = hc
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		if err := client.Do(req).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if hc.closed != 1 {
+			t.Errorf("expected idle connections to be closed")
+		}
+		resp := client.Do(mustNewRequest("", url))
+		if err := resp.Err(); err != ErrClientClosed {
+			t.Errorf("expected ErrClientClosed, got %v", err)
+		}
+		if n := atomic.LoadInt32(&requests); n != 1 {
+			t.Errorf("expected 1 request to be sent, got %d", n)
+		}
+	}, grabtest.ContentLength(1000), grabtest.StatusCode(func(r *http.Request) int {
+		atomic.AddInt32(&requests, 1)
+		return http.StatusOK
+	}))
+}
+
+// TestClientShutdown tests that Shutdown waits for transfers in progress, or
+// cancels them once its context is done, leaving partial files that may be
+// resumed.
+func TestClientShutdown(t *testing.T) {
+	t.Run("Finish", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			client := NewClient()
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := client.Do(req)
+			if err := client.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !resp.IsComplete() || resp.Err() != nil {
+				t.Errorf("expected transfer to finish, got %v", resp.Err())
+			}
+		}, grabtest.ContentLength(4096), grabtest.WithRateLimit(40960))
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		filename := ".testClientShutdown"
+		defer os.Remove(filename)
+		size := 100000
+		grabtest.WithTestServer(t, func(url string) {
+			client := NewClient()
+			req := mustNewRequest(filename, url)
+			req.WriteBufferSize = 64 << 10
+			resp := client.Do(req)
+			time.Sleep(300 * time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+				t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+			}
+			if !IsCanceled(resp.Err()) {
+				t.Errorf("expected transfer to be canceled, got %v", resp.Err())
+			}
+			if err := client.Do(mustNewRequest(filename, url)).Err(); err != ErrClientClosed {
+				t.Errorf("expected ErrClientClosed, got %v", err)
+			}
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() == 0 || fi.Size() >= int64(size) || fi.Size() != resp.BytesComplete() {
+				t.Fatalf("expected partial file of %d bytes, got %d", resp.BytesComplete(), fi.Size())
+			}
+
+			// resume after a restart
+			resp = mustDo(mustNewRequest(filename, url))
+			if !resp.DidResume {
+				t.Errorf("expected partial file to be resumed")
+			}
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size), grabtest.WithRateLimit(100000))
+	})
+}
+
+// TestByteQuota tests that a Client fails new transfers once it has
+// transferred the number of bytes set by WithByteQuota.
+func TestByteQuota(t *testing.T) {
+	client, err := NewClientWith(WithByteQuota(1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grabtest.WithTestServer(t, func(url string) {
+		for i, expect := range []error{nil, nil, ErrQuotaExceeded, ErrQuotaExceeded} {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := client.Do(req)
+			if err := resp.Err(); err != expect {
+				t.Fatalf("request %d: expected error %v, got %v", i+1, expect, err)
+			}
+		}
+		if n := client.BytesTransferred(); n != 2000 {
+			t.Errorf("expected 2000 bytes transferred, got %d", n)
+		}
+	}, grabtest.ContentLength(1000))
+
+	if _, err := NewClientWith(WithByteQuota(-1)); err == nil {
+		t.Errorf("expected error for negative quota")
+	}
+}
+
+// TestMaxOpenTransfersDo tests that concurrent calls to Do never hold open more
+// connections than Client.MaxOpenTransfers, and that a call waiting for a free
+// transfer slot returns once its context is canceled.
+func TestMaxOpenTransfersDo(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		counter := &openBodyCounter{HTTPClient: DefaultClient.HTTPClient}
+		client, err := NewClientWith(WithMaxConcurrent(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.HTTPClient = counter
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := mustNewRequest("", url+fmt.Sprintf("/.testMaxOpenTransfersDo%d", i))
+				req.NoStore = true
+				if err := client.Do(req).Err(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if counter.peak > client.MaxOpenTransfers {
+			t.Errorf("expected at most %d open transfers, got %d", client.MaxOpenTransfers, counter.peak)
+		}
+	},
+		grabtest.ContentLength(4096),
+		grabtest.TimeToFirstByte(10*time.Millisecond),
+	)
+
+	t.Run("CancelQueued", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			client, err := NewClientWith(WithMaxConcurrent(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := mustNewRequest("", url+"/.testMaxOpenTransfersDo")
+			req.NoStore = true
+			resp := client.Do(req)
+			defer resp.Cancel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req = mustNewRequest("", url+"/.testMaxOpenTransfersDo")
+			req.NoStore = true
+			if err := client.Do(req.WithContext(ctx)).Err(); err != context.DeadlineExceeded {
+				t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+			if resp.IsComplete() {
+				t.Errorf("expected first transfer to be in progress")
+			}
+		},
+			grabtest.RateLimiter(1024),
+		)
+	})
+
+	if _, err := NewClientWith(WithMaxConcurrent(-1)); err == nil {
+		t.Errorf("expected error for negative limit")
+	}
+}
+
+// laxHTTPClient is a HTTPClient that, unlike http.Client, does not stop reading
+// a response body at the length declared in its Content-Length header.
+type laxHTTPClient struct{}
+
+func (c laxHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	conn, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(resp.Body, br), conn}
+	return resp, nil
+}
+
+// TestTrailingBytes tests that a transfer never writes more bytes than the
+// remote server declared in the Content-Length header.
+func TestTrailingBytes(t *testing.T) {
+	size := 4096
+	filename := ".testTrailingBytes"
+	defer os.Remove(filename)
+
+	grabtest.WithTestServer(t, func(url string) {
+		client := NewClient()
+		client.HTTPClient = laxHTTPClient{}
+		resp := client.Do(mustNewRequest(filename, url))
+		if err := resp.Err(); err != ErrBadLength {
+			t.Fatalf("expected ErrBadLength, got: %v", err)
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(size) {
+			t.Errorf("expected %d bytes written, got: %d", size, fi.Size())
+		}
+	},
+		grabtest.ContentLength(size),
+		grabtest.WithTrailingBytes(128),
+	)
+}
+
+// labelRecorder is a HTTPClient that records the Label and Tag found in the
+// context of each HTTP request.
+type labelRecorder struct {
+	HTTPClient
+	mu      sync.Mutex
+	methods []string
+	labels  []string
+	tags    []interface{}
+}
+
+func (c *labelRecorder) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.methods = append(c.methods, req.Method)
+	c.labels = append(c.labels, LabelFromContext(req.Context()))
+	c.tags = append(c.tags, TagFromContext(req.Context()))
+	c.mu.Unlock()
+	return c.HTTPClient.Do(req)
+}
+
+// TestContextValues tests that the Label and Tag of a Request are available in
+// the context of every HTTP request sent by the HTTPClient.
+func TestContextValues(t *testing.T) {
+	filename := ".testContextValues"
+	defer os.Remove(filename)
+
+	grabtest.WithTestServer(t, func(url string) {
+		// create partial file so that a HEAD request is sent before resuming
+		if err := ioutil.WriteFile(filename, make([]byte, 1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := &labelRecorder{HTTPClient: DefaultClient.HTTPClient}
+		client := NewClient()
+		client.HTTPClient = recorder
+		req := mustNewRequest(filename, url)
+		req.Label = "test label"
+		req.Tag = 42
+		resp := client.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(recorder.methods) != 2 || recorder.methods[0] != "HEAD" || recorder.methods[1] != "GET" {
+			t.Fatalf("expected HEAD and GET requests, got: %v", recorder.methods)
+		}
+		for i := range recorder.methods {
+			if recorder.labels[i] != req.Label {
+				t.Errorf("expected label '%s' for %s, got '%s'", req.Label, recorder.methods[i], recorder.labels[i])
+			}
+			if recorder.tags[i] != req.Tag {
+				t.Errorf("expected tag %v for %s, got %v", req.Tag, recorder.methods[i], recorder.tags[i])
+			}
+		}
+	})
+
+	if label := LabelFromContext(context.Background()); label != "" {
+		t.Errorf("expected empty label, got '%s'", label)
+	}
+	if tag := TagFromContext(context.Background()); tag != nil {
+		t.Errorf("expected nil tag, got %v", tag)
+	}
+}
+
+// TestFilenameCollision tests each policy for handling an existing file at the
+// destination path of a Request.
+func TestFilenameCollision(t *testing.T) {
+	filename := ".testFilenameCollision.bin"
+	existing := []byte("existing file")
+	size := 4096
+	reset := func(t *testing.T) {
+		matches, _ := filepath.Glob(".testFilenameCollision*")
+		for _, name := range matches {
+			os.Remove(name)
+		}
+		if err := ioutil.WriteFile(filename, existing, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer reset(t)
+
+	t.Run("Overwrite", func(t *testing.T) {
+		reset(t)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.OnFilenameCollision = CollisionOverwrite
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected existing file to not be resumed")
+			}
+			testComplete(t, resp)
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != int64(size) {
+				t.Errorf("expected file size %d, got %d", size, fi.Size())
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		reset(t)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.OnFilenameCollision = CollisionError
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrFileExists {
+				t.Errorf("expected ErrFileExists, got: %v", err)
+			}
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, existing) {
+				t.Errorf("expected existing file to be unmodified")
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		reset(t)
+		grabtest.WithTestServer(t, func(url string) {
+			n := 5
+			reqs := make([]*Request, n)
+			for i := 0; i < n; i++ {
+				reqs[i] = mustNewRequest(filename, url)
+				reqs[i].OnFilenameCollision = CollisionRename
+			}
+			seen := make(map[string]bool)
+			for resp := range DefaultClient.DoBatch(0, reqs...) {
+				if err := resp.Err(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+					continue
+				}
+				if seen[resp.Filename] {
+					t.Errorf("duplicate filename: %s", resp.Filename)
+				}
+				seen[resp.Filename] = true
+				testComplete(t, resp)
+			}
+			for i := 1; i <= n; i++ {
+				name := fmt.Sprintf(".testFilenameCollision (%d).bin", i)
+				if !seen[name] {
+					t.Errorf("expected file: %s", name)
+				}
+			}
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, existing) {
+				t.Errorf("expected existing file to be unmodified")
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("OverwriteIfDifferent", func(t *testing.T) {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i)
+		}
+		mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		tests := []struct {
+			Name        string
+			Existing    []byte
+			NotModified bool
+		}{
+			{"Different", existing, false},
+			{"Same", content, true},
+		}
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				reset(t)
+				if err := ioutil.WriteFile(filename, test.Existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(filename, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+				grabtest.WithTestServer(t, func(url string) {
+					req := mustNewRequest(filename, url)
+					req.OnFilenameCollision = CollisionOverwriteIfDifferent
+					resp := mustDo(req)
+					testComplete(t, resp)
+					if resp.Filename != filename {
+						t.Errorf("expected filename %s, got %s", filename, resp.Filename)
+					}
+					if resp.NotModified != test.NotModified {
+						t.Errorf("expected Response.NotModified to be %v", test.NotModified)
+					}
+					b, err := ioutil.ReadFile(filename)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(b, content) {
+						t.Errorf("expected file to match the remote file")
+					}
+					fi, err := os.Stat(filename)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if fi.ModTime().Equal(mtime) != test.NotModified {
+						t.Errorf("unexpected modification time: %v", fi.ModTime())
+					}
+					if matches, _ := filepath.Glob("*.grab-*"); len(matches) > 0 {
+						t.Errorf("expected temporary files to be removed: %v", matches)
+					}
+				}, grabtest.ContentLength(size))
+			})
+		}
+	})
+}
+
+// TestSizeHeader tests that the size of a chunked response may be read from a
+// custom header named by Request.SizeHeader.
+func TestSizeHeader(t *testing.T) {
+	size := 4096
+	tests := []struct {
+		Name   string
+		Value  string
+		Expect int64 // Response.Size before transfer
+		Err    error
+	}{
+		{"Valid", "4096", 4096, nil},
+		{"Missing", "", -1, nil},
+		{"Malformed", "4kb", -1, nil},
+		{"Negative", "-1", -1, nil},
+		{"TooSmall", "4095", 4095, ErrBadLength},
+		{"TooLarge", "4097", 4097, ErrBadLength},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			options := []grabtest.HandlerOption{
+				grabtest.ContentLength(size),
+				grabtest.HeaderBlacklist("Content-Length"),
+			}
+			if test.Value != "" {
+				options = append(options, grabtest.Header("X-Content-Length", test.Value))
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				req.SizeHeader = "X-Content-Length"
+				req.BeforeCopy = func(resp *Response) error {
+					if resp.Size() != test.Expect {
+						t.Errorf("expected size %d before transfer, got %d", test.Expect, resp.Size())
+					}
+					return nil
+				}
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Fatalf("expected error %v, got: %v", test.Err, err)
+				}
+				if test.Err == nil && resp.Size() != int64(size) {
+					t.Errorf("expected size %d after transfer, got %d", size, resp.Size())
+				}
+			}, options...)
+		})
+	}
+}
+
+// TestStreamBuffer tests that a transfer may be read as it is downloaded via a
+// bounded buffer, and that the transfer waits for a slow consumer.
+func TestStreamBuffer(t *testing.T) {
+	size := 256 * 1024
+	bufferSize := 4096
+	expect := make([]byte, size)
+	for i := range expect {
+		expect[i] = byte(i)
+	}
+
+	t.Run("Backpressure", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.StreamBufferSize = bufferSize
+			resp := DefaultClient.Do(req)
+			stream := resp.Stream()
+			if stream == nil {
+				t.Fatal("expected Response.Stream to be non-nil")
+			}
+
+			// transfer should stall with a full buffer
+			time.Sleep(50 * time.Millisecond)
+			if n := resp.BytesComplete(); n > int64(bufferSize) {
+				t.Errorf("expected at most %d bytes transferred without a consumer, got %d", bufferSize, n)
+			}
+
+			b, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Fatalf("error reading stream: %v", err)
+			}
+			if !bytes.Equal(b, expect) {
+				t.Errorf("streamed content does not match")
+			}
+			if err := resp.Err(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.StreamBufferSize = bufferSize
+			resp := DefaultClient.Do(req)
+			time.Sleep(10 * time.Millisecond)
+			if err := resp.Cancel(); err != context.Canceled {
+				t.Errorf("expected context.Canceled, got: %v", err)
+			}
+			if _, err := ioutil.ReadAll(resp.Stream()); err != context.Canceled {
+				t.Errorf("expected context.Canceled reading stream, got: %v", err)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("WithChecksum", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.StreamBufferSize = bufferSize
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadRequest {
+				t.Errorf("expected ErrBadRequest, got: %v", err)
+			}
+		})
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			resp := mustDo(req)
+			if resp.Stream() != nil {
+				t.Errorf("expected Response.Stream to be nil")
+			}
+		})
+	})
+}
+
+// gaugeFunc is a bps.Gauge that reports a fixed rate.
+type gaugeFunc func() float64
+
+func (f gaugeFunc) Sample(t time.Time, n int64) {}
+
+func (f gaugeFunc) BPS() float64 { return f() }
+
+// TestNewGauge tests that a Request may provide its own transfer rate gauge.
+func TestNewGauge(t *testing.T) {
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		req.NewGauge = func() bps.Gauge {
+			return gaugeFunc(func() float64 { return 42 })
+		}
+		req.BeforeCopy = func(resp *Response) error {
+			if rate := resp.BytesPerSecond(); rate != 42 {
+				t.Errorf("expected custom gauge to report 42 B/s, got %0.2f", rate)
+			}
+			return nil
+		}
+		mustDo(req)
+	})
+}
+
+// sampleCounter is a bps.Gauge that counts the samples it is given.
+type sampleCounter int32
+
+func (c *sampleCounter) Sample(t time.Time, n int64) { atomic.AddInt32((*int32)(c), 1) }
+
+func (c *sampleCounter) BPS() float64 { return 0 }
+
+// TestSampleInterval tests that the progress of a transfer is sampled at the
+// interval given by Request.SampleInterval.
+func TestSampleInterval(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Interval time.Duration
+		Min, Max int32
+	}{
+		{"Default", 0, 1, 3},
+		{"Short", 100 * time.Millisecond, 6, 14},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				var samples sampleCounter
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				req.SampleInterval = test.Interval
+				req.NewGauge = func() bps.Gauge { return &samples }
+				mustDo(req)
+				n := atomic.LoadInt32((*int32)(&samples))
+				if n < test.Min || n > test.Max {
+					t.Errorf("expected %d to %d samples, got %d", test.Min, test.Max, n)
+				}
+			},
+				grabtest.ContentLength(10000),
+				grabtest.WithRateLimit(10000),
+			)
+		})
+	}
+
+	t.Run("DefaultGauge", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url)
+			req.NoStore = true
+			req.SampleInterval = 100 * time.Millisecond
+			resp := DefaultClient.Do(req)
+			time.Sleep(400 * time.Millisecond)
+			if bps := resp.BytesPerSecond(); bps <= 0 {
+				t.Errorf("expected transfer rate after 400ms, got %0.2f", bps)
+			}
+			resp.Cancel()
+		},
+			grabtest.ContentLength(10000),
+			grabtest.WithRateLimit(10000),
+		)
+	})
+}
+
+// TestCookies tests that cookies set on a Request, or by a remote server during
+// a redirect, are sent to the remote server.
+func TestCookies(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.Redirect(w, r, "/file?"+r.URL.RawQuery, http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range r.URL.Query()["cookie"] {
+			if _, err := r.Cookie(name); err != nil {
+				http.Error(w, "missing cookie: "+name, http.StatusForbidden)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	t.Run("Request", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/file?cookie=token")
+		req.NoStore = true
+		req.Cookies = []*http.Cookie{{Name: "token", Value: "xyz"}}
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cookie := req.HTTPRequest.Header.Get("Cookie"); cookie != "" {
+			t.Errorf("expected caller's request to be unmodified, got Cookie: %s", cookie)
+		}
+	})
+
+	t.Run("CookieJar", func(t *testing.T) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := NewClientWith(WithCookieJar(jar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := mustNewRequest("", s.URL+"/login?cookie=session")
+		req.NoStore = true
+		resp := client.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("NoCookieJar", func(t *testing.T) {
+		req := mustNewRequest("", s.URL+"/login?cookie=session")
+		req.NoStore = true
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != StatusCodeError(http.StatusForbidden) {
+			t.Fatalf("expected 403 Forbidden without a cookie jar, got: %v", err)
+		}
+	})
+}
+
+// TestUseServerDigest tests that downloads are validated using a checksum sent
+// by the remote server in a Digest header.
+func TestUseServerDigest(t *testing.T) {
+	filename := ".testUseServerDigest"
+	defer os.Remove(filename)
+	sum := base64.StdEncoding.EncodeToString(grabtest.DefaultHandlerSHA256ChecksumBytes)
+	bad := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		Name   string
+		Digest string
+		Err    error
+	}{
+		{"Match", "sha-256=" + sum, nil},
+		{"Mismatch", "sha-256=" + bad, ErrBadChecksum},
+		{"Multiple", "md5=Q2hlY2sgSW50ZWdyaXR5IQ==, SHA-256=" + sum, nil},
+		{"Unsupported", "md5=Q2hlY2sgSW50ZWdyaXR5IQ==", nil},
+		{"Malformed", "sha-256=not base64!", nil},
+		{"Missing", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			os.Remove(filename)
+			var wantDigest string
+			options := []grabtest.HandlerOption{
+				grabtest.StatusCode(func(r *http.Request) int {
+					if r.Method == "GET" {
+						wantDigest = r.Header.Get("Want-Digest")
+					}
+					return http.StatusOK
+				}),
+			}
+			if test.Digest != "" {
+				options = append(options, grabtest.Header("Digest", test.Digest))
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.UseServerDigest = true
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Errorf("expected error %v, got: %v", test.Err, err)
+				}
+				if !strings.HasPrefix(wantDigest, "sha-256") {
+					t.Errorf("expected Want-Digest header to request sha-256, got: '%s'", wantDigest)
+				}
+				if req.hash != nil {
+					t.Errorf("expected caller's request to be unmodified")
+				}
+			}, options...)
+		})
+	}
+}
+
+// TestUseContentMD5 tests that a download is validated against the MD5
+// checksum given by the remote server in a Content-MD5 header or ETag.
+func TestUseContentMD5(t *testing.T) {
+	filename := ".testUseContentMD5"
+	defer os.Remove(filename)
+	sum := grabtest.DefaultHandlerMD5Checksum
+	bad := strings.Repeat("0", len(sum))
+
+	tests := []struct {
+		Name   string
+		Header string
+		Value  string
+		Err    error
+	}{
+		{"ContentMD5", "Content-MD5", base64.StdEncoding.EncodeToString(grabtest.DefaultHandlerMD5ChecksumBytes), nil},
+		{"ContentMD5Mismatch", "Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)), ErrBadChecksum},
+		{"ETag", "ETag", `"` + sum + `"`, nil},
+		{"ETagMismatch", "ETag", `"` + bad + `"`, ErrBadChecksum},
+		{"ETagMultipart", "ETag", `"` + bad + `-3"`, nil},
+		{"ETagWeak", "ETag", `W/"` + bad + `"`, nil},
+		{"ETagOpaque", "ETag", `"5f8a-12ab"`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.UseContentMD5 = true
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Err {
+					t.Errorf("expected error %v, got: %v", test.Err, err)
+				}
+				if req.hash != nil {
+					t.Errorf("expected caller's request to be unmodified")
+				}
+			}, grabtest.Header(test.Header, test.Value))
+		})
+	}
+}
+
+// logRecorder is a Logger that records all messages.
+type logRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *logRecorder) Logf(level LogLevel, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level.String()+": "+fmt.Sprintf(format, args...))
+}
+
+// TestLogger tests that a Client sends messages describing each stage of a
+// transfer to its Logger.
+func TestLogger(t *testing.T) {
+	filename := ".testLogger"
+	defer os.Remove(filename)
+	if err := ioutil.WriteFile(filename, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	grabtest.WithTestServer(t, func(url string) {
+		logger := &logRecorder{}
+		client := NewClient()
+		client.Logger = logger
+		resp := client.Do(mustNewRequest(filename, url))
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []string{
+			"debug: " + url + ": sending HEAD request",
+			"debug: " + url + ": received HEAD response: 200 OK",
+			"info: " + url + ": resuming .testLogger from byte 1024",
+			"debug: " + url + ": sending GET request with Range: bytes=1024-",
+			"debug: " + url + ": received GET response: 206 Partial Content",
+			"debug: " + url + ": transferring to .testLogger",
+			"info: " + url + ": transfer complete: 1048576 bytes in ",
+		}
+		if len(logger.messages) != len(expect) {
+			t.Fatalf("expected %d log messages, got:\n%s", len(expect), strings.Join(logger.messages, "\n"))
+		}
+		for i, msg := range logger.messages {
+			if !strings.HasPrefix(msg, expect[i]) {
+				t.Errorf("expected log message '%s', got '%s'", expect[i], msg)
+			}
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			logger := &logRecorder{}
+			client := NewClient()
+			client.Logger = logger
+			client.Do(mustNewRequest("", url)).Err()
+			last := logger.messages[len(logger.messages)-1]
+			if expect := "error: " + url + ": transfer failed: server returned 404 Not Found"; last != expect {
+				t.Errorf("expected log message '%s', got '%s'", expect, last)
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	})
+}
+
+// TestBadDestination tests that transfers to a destination path that cannot be
+// written to fail with ErrBadDestination, before any file content is requested
+// if the path names a directory or is below a file.
+func TestBadDestination(t *testing.T) {
+	dir := ".testBadDestination"
+	if err := os.MkdirAll(filepath.Join(dir, "subdir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("content"))
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		Name     string
+		Filename string
+		URL      string
+		Requests int32
+	}{
+		{"Parent is a file", filepath.Join(dir, "file", "download"), "/download", 0},
+		{"Ancestor is a file", filepath.Join(dir, "file", "a", "b", "download"), "/download", 0},
+		{"Resolved filename is a directory", dir, "/subdir", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			req := mustNewRequest(test.Filename, s.URL+test.URL)
+			req.NoResume = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); !IsBadDestination(err) {
+				t.Fatalf("expected ErrBadDestination, got %v", err)
+			}
+			if n := atomic.LoadInt32(&requests); n != test.Requests {
+				t.Errorf("expected %d requests, got %d", test.Requests, n)
+			}
+		})
+	}
+
+	t.Run("Read-only directory", func(t *testing.T) {
+		if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+			t.Skip("directory permissions are not enforced")
+		}
+		readOnly := filepath.Join(dir, "readonly")
+		if err := os.Mkdir(readOnly, 0555); err != nil {
+			t.Fatal(err)
+		}
+		// permissions are only checked once the destination is opened
+		resp := DefaultClient.Do(mustNewRequest(filepath.Join(readOnly, "download"), s.URL+"/download"))
+		if err := resp.Err(); !IsBadDestination(err) {
+			t.Fatalf("expected ErrBadDestination, got %v", err)
+		}
+	})
+}
+
+// TestResumeVerifySize tests that a partial file is only resumed if its
+// trailing bytes match the remote file.
+func TestResumeVerifySize(t *testing.T) {
+	filename := ".testResumeVerifySize"
+	defer os.Remove(filename)
+	size := 4096
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	tests := []struct {
+		Name      string
+		Corrupt   bool
+		DidResume bool
+	}{
+		{"Match", false, true},
+		{"Mismatch", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			partial := append([]byte(nil), content[:size/2]...)
+			if test.Corrupt {
+				for i := len(partial) - 8; i < len(partial); i++ {
+					partial[i] ^= 0xFF
+				}
+			}
+			if err := ioutil.WriteFile(filename, partial, 0644); err != nil {
+				t.Fatal(err)
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.ResumeVerifySize = 64
+				resp := mustDo(req)
+				if resp.DidResume != test.DidResume {
+					t.Errorf("expected Response.DidResume to be %v", test.DidResume)
+				}
+				testComplete(t, resp)
+				b, err := ioutil.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Errorf("downloaded file does not match remote file")
+				}
+			}, grabtest.ContentLength(size))
+		})
+	}
+}
+
+// TestDoStream tests that Client.DoStream yields the content of a transfer as
+// it is written to the destination file.
+func TestDoStream(t *testing.T) {
+	filename := ".testDoStream"
+	defer os.Remove(filename)
+	size := 256 * 1024
+	bufferSize := 4096
+	expect := make([]byte, size)
+	for i := range expect {
+		expect[i] = byte(i)
+	}
+	testFile := func(t *testing.T) {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expect) {
+			t.Errorf("downloaded file does not match")
+		}
+	}
+
+	t.Run("Backpressure", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.StreamBufferSize = bufferSize
+			resp, r, err := DefaultClient.DoStream(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			// transfer should stall with a full buffer
+			time.Sleep(50 * time.Millisecond)
+			if n := resp.BytesComplete(); n > int64(bufferSize) {
+				t.Errorf("expected at most %d bytes transferred without a consumer, got %d", bufferSize, n)
+			}
+
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("error reading stream: %v", err)
+			}
+			if !bytes.Equal(b, expect) {
+				t.Errorf("streamed content does not match")
+			}
+			testComplete(t, resp)
+			testFile(t)
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.StreamBufferSize = bufferSize
+			resp, r, err := DefaultClient.DoStream(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+			testComplete(t, resp)
+			testFile(t)
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		if err := ioutil.WriteFile(filename, expect[:size/2], 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			resp, r, err := DefaultClient.DoStream(mustNewRequest(filename, url))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("error reading stream: %v", err)
+			}
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+			if !bytes.Equal(b, expect) {
+				t.Errorf("streamed content does not match")
+			}
+			testComplete(t, resp)
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("BadChecksum", func(t *testing.T) {
+		os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), make([]byte, sha256.Size), false)
+			_, r, err := DefaultClient.DoStream(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if _, err := ioutil.ReadAll(r); err != ErrBadChecksum {
+				t.Errorf("expected ErrBadChecksum, got: %v", err)
+			}
+		}, grabtest.ContentLength(size))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			_, r, err := DefaultClient.DoStream(mustNewRequest(filename, url))
+			if !IsStatusCodeError(err) {
+				t.Errorf("expected StatusCodeError, got: %v", err)
+			}
+			if r != nil {
+				t.Errorf("expected nil reader")
+			}
+		}, grabtest.StatusCodeStatic(http.StatusNotFound))
+	})
+}
+
+// TestSkipIfChecksumMatches tests that no requests are sent if an existing
+// file matches the expected checksum.
+func TestSkipIfChecksumMatches(t *testing.T) {
+	filename := ".testSkipIfChecksumMatches"
+	defer os.Remove(filename)
+	size := 4096
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	sum := sha256.Sum256(content)
+
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		Name     string
+		Local    []byte
+		Requests bool
+	}{
+		{"Match", content, false},
+		{"Mismatch", content[:size/2], true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := ioutil.WriteFile(filename, test.Local, 0644); err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&requests, 0)
+			req := mustNewRequest(filename, s.URL)
+			req.SetChecksum(sha256.New(), sum[:], false)
+			req.SkipIfChecksumMatches = true
+			resp := mustDo(req)
+			testComplete(t, resp)
+			if n := atomic.LoadInt32(&requests); (n > 0) != test.Requests {
+				t.Errorf("expected requests: %v, got %d", test.Requests, n)
+			}
+			b, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("downloaded file does not match")
+			}
+		})
+	}
+}
+
+// TestWithAddressFamily tests that clients may be restricted to connecting via
+// IPv4 or IPv6.
+func TestWithAddressFamily(t *testing.T) {
+	if _, err := NewClientWith(WithAddressFamily("udp")); err == nil {
+		t.Errorf("expected error for unsupported address family")
+	}
+
+	tests := []struct {
+		Name    string
+		Address string
+		Network string
+		OK      bool
+	}{
+		{"IPv4/tcp4", "127.0.0.1:0", "tcp4", true},
+		{"IPv4/tcp6", "127.0.0.1:0", "tcp6", false},
+		{"IPv4/tcp", "127.0.0.1:0", "tcp", true},
+		{"IPv6/tcp6", "[::1]:0", "tcp6", true},
+		{"IPv6/tcp4", "[::1]:0", "tcp4", false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			l, err := net.Listen("tcp", test.Address)
+			if err != nil {
+				t.Skipf("cannot listen on %s: %v", test.Address, err)
+			}
+			s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("content"))
+			}))
+			s.Listener.Close()
+			s.Listener = l
+			s.Start()
+			defer s.Close()
+
+			client, err := NewClientWith(WithAddressFamily(test.Network))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := mustNewRequest("", s.URL+"/file")
+			req.NoStore = true
+			err = client.Do(req).Err()
+			if test.OK && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.OK && err == nil {
+				t.Errorf("expected connection to fail")
+			}
+		})
+	}
+}
+
+// TestWithMaxResponseHeaderBytes tests that a server sending oversized response
+// headers causes a transfer to fail.
+func TestWithMaxResponseHeaderBytes(t *testing.T) {
+	client, err := NewClientWith(WithMaxResponseHeaderBytes(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url+"/.testWithMaxResponseHeaderBytes")
+		req.NoStore = true
+		if err := client.Do(req).Err(); err == nil {
+			t.Errorf("expected error for oversized response headers")
+		}
+	}, grabtest.Header("X-Padding", strings.Repeat("x", 1<<20)))
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url+"/.testWithMaxResponseHeaderBytes")
+		req.NoStore = true
+		if err := client.Do(req).Err(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	if _, err := NewClientWith(WithMaxResponseHeaderBytes(-1)); err == nil {
+		t.Errorf("expected error for negative limit")
+	}
+}
+
+// TestAllowedContentTypes tests that responses with a Content-Type that is not
+// allowed are rejected before the file is written.
+func TestAllowedContentTypes(t *testing.T) {
+	filename := ".testAllowedContentTypes"
+	defer os.Remove(filename)
+
+	tests := []struct {
+		ContentType string
+		Allowed     []string
+		OK          bool
+	}{
+		{"application/zip", []string{"application/zip"}, true},
+		{"image/png", []string{"application/zip", "image/*"}, true},
+		{"text/html; charset=utf-8", []string{"TEXT/HTML"}, true},
+		{"text/html; charset=utf-8", []string{"application/zip", "image/*"}, false},
+		{"imagery/png", []string{"image/*"}, false},
+		{"", []string{"application/zip"}, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.ContentType), func(t *testing.T) {
+			os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.AllowedContentTypes = test.Allowed
+				resp := DefaultClient.Do(req)
+				err := resp.Err()
+				if test.OK {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					testComplete(t, resp)
+					return
+				}
+				if !errors.Is(err, ErrUnexpectedContentType) {
+					t.Errorf("expected ErrUnexpectedContentType, got: %v", err)
+				}
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("expected file to not be written")
+				}
+			}, grabtest.ContentType(test.ContentType))
+		})
+	}
+}
+
+// TestURLFunc tests that Request.URLFunc is called to produce the URL of every
+// request sent for a transfer.
+func TestURLFunc(t *testing.T) {
+	filename := ".testURLFunc"
+	defer os.Remove(filename)
+
+	var mu sync.Mutex
+	var seen []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("content"))
+	}))
+	defer s.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		// resume a partial file to send both a HEAD and GET request
+		if err := ioutil.WriteFile(filename, []byte("cont"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		req := mustNewRequest(filename, s.URL+"/original")
+		req.URLFunc = func(attempt int) (string, error) {
+			return fmt.Sprintf("%s/signed?attempt=%d", s.URL, attempt), nil
+		}
+		resp := mustDo(req)
+		testComplete(t, resp)
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+		expect := []string{"HEAD /signed?attempt=0", "GET /signed?attempt=1"}
+		mu.Lock()
+		defer mu.Unlock()
+		if fmt.Sprint(seen) != fmt.Sprint(expect) {
+			t.Errorf("expected requests %v, got %v", expect, seen)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		if err := ioutil.WriteFile(filename, []byte("cont"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expect := errors.New("cannot sign URL")
+		req := mustNewRequest(filename, s.URL+"/original")
+		req.URLFunc = func(attempt int) (string, error) {
+			if attempt > 0 {
+				return "", expect
+			}
+			return s.URL + "/signed", nil
+		}
+		if err := DefaultClient.Do(req).Err(); err != expect {
+			t.Errorf("expected %v, got %v", expect, err)
+		}
+	})
+}
+
+func TestChecksumRetries(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Corrupt  int
+		Retries  int
+		Expect   error
+		Attempts int
+	}{
+		{"NoRetries", 1, 0, ErrBadChecksum, 0},
+		{"Recovered", 1, 1, nil, 1},
+		{"Exhausted", 2, 1, ErrBadChecksum, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filename := ".testChecksumRetries-" + test.Name
+			defer os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, true)
+				req.ChecksumRetries = test.Retries
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Expect {
+					t.Errorf("expected error %v, got %v", test.Expect, err)
+				}
+				if resp.checksumRetries != test.Attempts {
+					t.Errorf("expected %d retries, got %d", test.Attempts, resp.checksumRetries)
+				}
+				if test.Expect == nil {
+					testComplete(t, resp)
+				} else if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("checksum failure not cleaned up: %s", filename)
+				}
+			}, grabtest.WithCorruptBody(test.Corrupt))
+		})
+	}
+
+	t.Run("Concurrent", func(t *testing.T) {
+		// resume the first attempt, so that restarting the transfer also resets
+		// the number of bytes resumed while progress is read
+		filename := ".testChecksumRetries-Concurrent"
+		defer os.Remove(filename)
+		b := make([]byte, 4096)
+		for i := range b {
+			b[i] = byte(i)
+		}
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, true)
+			req.ChecksumRetries = 1
+			resp := DefaultClient.Do(req)
+			for !resp.IsComplete() {
+				if n := resp.BytesComplete(); n < 0 || n > resp.Size() {
+					t.Errorf("unexpected bytes complete: %d", n)
+				}
+				resp.Progress()
+				resp.BytesPerSecond()
+				resp.Snapshot()
+			}
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if resp.checksumRetries != 1 {
+				t.Errorf("expected 1 retry, got %d", resp.checksumRetries)
+			}
+			if resp.DidResume {
+				t.Error("expected restarted transfer not to resume")
+			}
+			if req.OnFilenameCollision != CollisionResume {
+				t.Errorf("Request.OnFilenameCollision was modified: %v", req.OnFilenameCollision)
+			}
+			testComplete(t, resp)
+		}, grabtest.WithCorruptBody(1))
+	})
+}
+
+func TestTrailerChecksum(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Trailer string
+		Resume  int
+		Expect  error
+		Options []grabtest.HandlerOption
+	}{
+		{"Valid", "X-Checksum-Sha256", 0, nil, nil},
+		{"Resumed", "X-Checksum-Sha256", 4096, nil, nil},
+		{"Corrupt", "X-Checksum-Sha256", 0, ErrBadChecksum, []grabtest.HandlerOption{
+			grabtest.WithCorruptBody(1),
+		}},
+		{"Missing", "X-Checksum-Sha512", 0, ErrBadChecksum, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filename := ".testTrailerChecksum-" + test.Name
+			defer os.Remove(filename)
+			if test.Resume > 0 {
+				b := make([]byte, test.Resume)
+				for i := range b {
+					b[i] = byte(i)
+				}
+				if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := append(test.Options, grabtest.WithTrailerChecksum("X-Checksum-Sha256"))
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.SetTrailerChecksum(test.Trailer, sha256.New(), true)
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Expect {
+					t.Fatalf("expected error %v, got %v", test.Expect, err)
+				}
+				if test.Expect == nil {
+					testComplete(t, resp)
+					if resp.DidResume != (test.Resume > 0) {
+						t.Errorf("expected DidResume: %v", test.Resume > 0)
+					}
+				} else if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("checksum failure not cleaned up: %s", filename)
+				}
+			}, opts...)
+		})
+	}
+}
+
+func TestSameHostRedirectsOnly(t *testing.T) {
+	filename := ".testSameHostRedirectsOnly"
+	grabtest.WithTestServer(t, func(target string) {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target+"/file", http.StatusFound)
+		}))
+		defer redirector.Close()
+
+		tests := []struct {
+			Name     string
+			SameHost bool
+			Hosts    []string
+			Expect   error
+		}{
+			{"Disabled", false, nil, nil},
+			{"Rejected", true, nil, ErrRedirectHost},
+			{"RejectedPort", true, []string{u.Hostname() + ":1"}, ErrRedirectHost},
+			{"AllowedHost", true, []string{u.Host}, nil},
+			{"AllowedHostname", true, []string{u.Hostname()}, nil},
+		}
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				defer os.Remove(filename)
+				req := mustNewRequest(filename, redirector.URL+"/redirect")
+				req.SameHostRedirectsOnly = test.SameHost
+				req.RedirectHosts = test.Hosts
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); !errors.Is(err, test.Expect) || (err != nil) != (test.Expect != nil) {
+					t.Fatalf("expected error %v, got %v", test.Expect, err)
+				}
+				if test.Expect == nil {
+					testComplete(t, resp)
+				} else if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("expected no file to be created, got: %v", err)
+				}
+			})
+		}
+	})
+}
+
+func TestExtensionFromContentType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grab-ext-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		Name        string
+		Path        string
+		ContentType string
+		Disabled    bool
+		Expect      string
+	}{
+		{"PNG", "/download", "image/png", false, "download.png"},
+		{"Preferred", "/photo", "image/jpeg", false, "photo.jpg"},
+		{"Parameters", "/notes", "text/plain; charset=utf-8", false, "notes.txt"},
+		{"HasExtension", "/file.bin", "image/png", false, "file.bin"},
+		{"OctetStream", "/blob", "application/octet-stream", false, "blob"},
+		{"Unknown", "/thing", "application/x-grab-unknown", false, "thing"},
+		{"Disabled", "/image", "image/png", true, "image"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(dir+"/", url+test.Path)
+				req.ExtensionFromContentType = !test.Disabled
+				resp := mustDo(req)
+				defer os.Remove(resp.Filename)
+				if expect := filepath.Join(dir, test.Expect); resp.Filename != expect {
+					t.Errorf("expected filename %s, got %s", expect, resp.Filename)
+				}
+			}, grabtest.ContentType(test.ContentType))
+		})
+	}
+}
+
+func TestHeadBytes(t *testing.T) {
+	filename := ".testHeadBytes"
+	tests := []struct {
+		Name    string
+		Expect  int
+		Options []grabtest.HandlerOption
+	}{
+		{"WithRanges", 16, nil},
+		{"WithoutRanges", 16, []grabtest.HandlerOption{grabtest.AcceptRanges(false)}},
+		{"ShortFile", 8, []grabtest.HandlerOption{grabtest.ContentLength(8)}},
+		{"UnknownSize", 16, []grabtest.HandlerOption{
+			grabtest.AcceptRanges(false),
+			grabtest.HeaderBlacklist("Content-Length"),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.HeadBytes = 16
+				resp := mustDo(req)
+				if resp.Size() != int64(test.Expect) {
+					t.Errorf("expected size %d, got %d", test.Expect, resp.Size())
+				}
+				b, err := ioutil.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) != test.Expect {
+					t.Fatalf("expected %d bytes, got %d", test.Expect, len(b))
+				}
+				for i := range b {
+					if b[i] != byte(i) {
+						t.Fatalf("expected byte %d to be %d, got %d", i, byte(i), b[i])
+					}
+				}
+			}, test.Options...)
+		})
+	}
+}
+
+func TestRestartIfModified(t *testing.T) {
+	filename := ".testRestartIfModified"
+	size := 1048576
+	lastmod := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	// seed a file completed from a previous, smaller version of the remote
+	// file
+	seed := func(modtime time.Time) {
+		b := make([]byte, size/2)
+		for i := 0; i < len(b); i++ {
+			b[i] = ^byte(i)
+		}
+		if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Modified", func(t *testing.T) {
+		seed(lastmod.Add(-time.Hour))
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.RestartIfModified = true
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := mustDo(req)
+			if resp.DidResume {
+				t.Errorf("expected Response.DidResume to be false")
+			}
+			testComplete(t, resp)
+		},
+			grabtest.ContentLength(size),
+			grabtest.LastModified(lastmod),
+		)
+	})
+
+	t.Run("NotModified", func(t *testing.T) {
+		seed(lastmod.Add(time.Second))
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.RestartIfModified = true
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !resp.DidResume {
+				t.Errorf("expected Response.DidResume to be true")
+			}
+		},
+			grabtest.ContentLength(size),
+			grabtest.LastModified(lastmod),
+		)
+	})
+}
+
+func TestPipe(t *testing.T) {
+	filename := ".testPipe"
+	size := 1048576
+
+	t.Run("OK", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			var b bytes.Buffer
+			req := mustNewRequest("", url+"/"+filename)
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := DefaultClient.Pipe(req, &b)
+			if err := resp.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if b.Len() != size {
+				t.Errorf("expected %d bytes written, got %d", size, b.Len())
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be created", filename)
+			}
+		})
+	})
+
+	t.Run("BadChecksum", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/"+filename)
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+			resp := DefaultClient.Pipe(req, ioutil.Discard)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Errorf("expected %v, got %v", ErrBadChecksum, err)
+			}
+		}, grabtest.WithCorruptBody(1))
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			pr, pw := io.Pipe()
+			expect := errors.New("upload failed")
+			go func() {
+				io.CopyN(ioutil.Discard, pr, 4096)
+				pr.CloseWithError(expect)
+			}()
+			req := mustNewRequest("", url+"/"+filename)
+			resp := DefaultClient.Pipe(req, pw)
+			err := resp.Err()
+			if !errors.Is(err, expect) {
+				t.Errorf("expected %v, got %v", expect, err)
+			}
+			if !IsBadDestination(err) {
+				t.Errorf("expected IsBadDestination to return true for %v", err)
+			}
+		})
+	})
+
+	t.Run("WithVerifier", func(t *testing.T) {
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest("", url+"/"+filename)
+			req.SetVerifier(NewMinisignVerifier("", ""), false)
+			if err := DefaultClient.Pipe(req, ioutil.Discard).Err(); err != ErrBadRequest {
+				t.Errorf("expected %v, got %v", ErrBadRequest, err)
+			}
+		})
+	})
+}
+
+// TestStdout tests that a request for the "-" destination streams the
+// downloaded content to standard output without creating any files.
+func TestStdout(t *testing.T) {
+	var b bytes.Buffer
+	defer func(w io.Writer) { stdout = w }(stdout)
+	stdout = &b
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(Stdout, url+"/.testStdout")
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		resp := mustDo(req)
+		if resp.DidResume {
+			t.Errorf("expected transfer not to be resumed")
+		}
+		grabtest.AssertSHA256Sum(t, grabtest.DefaultHandlerSHA256ChecksumBytes, &b)
+		for _, name := range []string{"-", ".testStdout"} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be created", name)
+				os.Remove(name)
+			}
+		}
+	})
+}
+
+func TestEmptyFile(t *testing.T) {
+	filename := ".testEmptyFile"
+	sum := grabtest.MustHexDecodeString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+
+	t.Run("Download", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), sum, false)
+			resp := mustDo(req)
+			if resp.Size() != 0 {
+				t.Errorf("expected size 0, got %d", resp.Size())
+			}
+			if p := resp.Progress(); p != 1 {
+				t.Errorf("expected progress 1, got %v", p)
+			}
+			if p := resp.Snapshot().Progress; p != 1 {
+				t.Errorf("expected snapshot progress 1, got %v", p)
+			}
+			fi, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 0 {
+				t.Errorf("expected empty file, got %d bytes", fi.Size())
+			}
+		}, grabtest.ContentLength(0))
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		defer os.Remove(filename)
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, true)
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != ErrBadChecksum {
+				t.Fatalf("expected %v, got %v", ErrBadChecksum, err)
+			}
+			if resp.Size() != 0 {
+				t.Errorf("expected size 0, got %d", resp.Size())
+			}
+			if p := resp.Progress(); p != 0 {
+				t.Errorf("expected progress 0, got %v", p)
+			}
+			if p := resp.Snapshot().Progress; p != 0 {
+				t.Errorf("expected snapshot progress 0, got %v", p)
+			}
+		}, grabtest.ContentLength(0))
+	})
+
+	t.Run("Existing", func(t *testing.T) {
+		defer os.Remove(filename)
+		if err := ioutil.WriteFile(filename, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		grabtest.WithTestServer(t, func(url string) {
+			req := mustNewRequest(filename, url)
+			req.SetChecksum(sha256.New(), sum, false)
+			resp := mustDo(req)
+			if p := resp.Progress(); p != 1 {
+				t.Errorf("expected progress 1, got %v", p)
+			}
+		}, grabtest.ContentLength(0))
+	})
+}
+
+func TestFilenameTransform(t *testing.T) {
+	suffix := func(name string) string { return name + ".downloaded" }
+	tests := []struct {
+		Name     string
+		Filename string
+		URLPath  string
+		Expect   string
+	}{
+		{"Filename", ".testFilenameTransform", "", ".testFilenameTransform.downloaded"},
+		{"Directory", ".testFilenameTransform-dir/", "/file.bin", ".testFilenameTransform-dir/file.bin.downloaded"},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.RemoveAll(".testFilenameTransform-dir")
+			defer os.Remove(test.Expect)
+			if err := os.MkdirAll(".testFilenameTransform-dir", 0777); err != nil {
+				t.Fatal(err)
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(test.Filename, url+test.URLPath)
+				req.FilenameTransform = suffix
+				resp := mustDo(req)
+				if resp.Filename != test.Expect {
+					t.Errorf("expected filename %s, got %s", test.Expect, resp.Filename)
+				}
+				if _, err := os.Stat(test.Expect); err != nil {
+					t.Error(err)
+				}
+				testComplete(t, resp)
+			})
+		})
+	}
+}
+
+// TestResumeComplete tests that a 416 response to a request to resume from the
+// end of a complete local file completes the transfer without error.
+func TestResumeComplete(t *testing.T) {
+	filename := ".testResumeComplete"
+	defer os.Remove(filename)
+	grabtest.WithTestServer(t, func(url string) {
+		testComplete(t, mustDo(mustNewRequest(filename, url)))
+
+		// resume without a HEAD request to send a range from the end of file
+		req := mustNewRequest(filename, url)
+		req.NoHead = true
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		resp := DefaultClient.Do(req)
+		if err := resp.Err(); err != nil {
+			t.Fatalf("expected nil, got %v", err)
+		}
+		if !resp.DidResume {
+			t.Errorf("expected Response.DidResume to be true")
+		}
+		if resp.HTTPResponse.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("expected a 416 response, got %d", resp.HTTPResponse.StatusCode)
+		}
+		testComplete(t, resp)
+	})
+}
+
+func TestResumeRange(t *testing.T) {
+	filename := ".testResumeRange"
+	size := int64(grabtest.DefaultHandlerContentLength)
+	tests := []struct {
+		Name              string
+		Existing          int64
+		NoHead            bool
+		Options           []grabtest.HandlerOption
+		Start, End, Total int64
+		OK                bool
+	}{
+		{"New", 0, false, nil, 0, 0, 0, false},
+		{"Resumed", 1000, false, nil, 1000, size - 1, size, true},
+		{"Complete", size, true, nil, size, size - 1, size, true},
+		{"Ignored", 1000, true, []grabtest.HandlerOption{grabtest.AcceptRanges(false)}, 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			if test.Existing > 0 {
+				b := make([]byte, test.Existing)
+				for i := range b {
+					b[i] = byte(i)
+				}
+				if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.NoHead = test.NoHead
+				resp := mustDo(req)
+				start, end, total, ok := resp.ResumeRange()
+				if start != test.Start || end != test.End || total != test.Total || ok != test.OK {
+					t.Errorf("expected range %d-%d/%d (%v), got %d-%d/%d (%v)",
+						test.Start, test.End, test.Total, test.OK, start, end, total, ok)
+				}
+				testComplete(t, resp)
+			}, test.Options...)
+		})
+	}
+}
+
+// TestResolveVia tests that the URL and filename of a download may be resolved
+// from the response to a request for an API endpoint.
+func TestResolveVia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grab-resolve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content, err := grabtest.NewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/content/", content)
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"downloadUrl": "/content/file.bin", "filename": "../report.bin"}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	resolve := func(resp *http.Response) (string, string, error) {
+		var v struct {
+			DownloadURL string `json:"downloadUrl"`
+			Filename    string `json:"filename"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&v)
+		return v.DownloadURL, v.Filename, err
+	}
+
+	t.Run("Directory", func(t *testing.T) {
+		req := mustNewRequest(dir, s.URL+"/api")
+		req.ResolveVia = resolve
+		resp := mustDo(req)
+		if expect := filepath.Join(dir, "report.bin"); resp.Filename != expect {
+			t.Errorf("expected filename %s, got %s", expect, resp.Filename)
+		}
+		if u := resp.HTTPRequest().URL.Path; u != "/content/file.bin" {
+			t.Errorf("expected content URL path /content/file.bin, got %s", u)
+		}
+		testComplete(t, resp)
+	})
+
+	t.Run("Filename", func(t *testing.T) {
+		filename := filepath.Join(dir, "explicit.bin")
+		req := mustNewRequest(filename, s.URL+"/api")
+		req.ResolveVia = resolve
+		resp := mustDo(req)
+		if resp.Filename != filename {
+			t.Errorf("expected filename %s, got %s", filename, resp.Filename)
+		}
+		testComplete(t, resp)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		testErr := errors.New("test")
+		req := mustNewRequest(dir, s.URL+"/api")
+		req.ResolveVia = func(resp *http.Response) (string, string, error) {
+			return "", "", testErr
+		}
+		if err := DefaultClient.Do(req).Err(); err != testErr {
+			t.Errorf("expected %v, got %v", testErr, err)
+		}
+	})
+}
+
+// TestTTFB tests that the time to first byte of a transfer includes the
+// latency of the remote server.
+func TestTTFB(t *testing.T) {
+	delay := 200 * time.Millisecond
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		resp := DefaultClient.Do(req)
+		if resp.Err() != nil {
+			t.Fatal(resp.Err())
+		}
+		if ttfb := resp.TTFB(); ttfb < delay || ttfb > resp.Duration() {
+			t.Errorf("expected time to first byte between %v and %v, got %v", delay, resp.Duration(), ttfb)
+		}
+	}, grabtest.TimeToFirstByte(delay))
+
+	t.Run("NoTransfer", func(t *testing.T) {
+		resp := &Response{}
+		if ttfb := resp.TTFB(); ttfb != 0 {
+			t.Errorf("expected zero time to first byte, got %v", ttfb)
+		}
+	})
+}
+
+// TestClientTrace tests that the events of requests sent for a transfer are
+// passed to Request.ClientTrace and recorded by Response.Timings.
+func TestClientTrace(t *testing.T) {
+	delay := 200 * time.Millisecond
+	grabtest.WithTestServer(t, func(url string) {
+		var firstBytes int32
+		req := mustNewRequest("", url)
+		req.NoStore = true
+		req.ClientTrace = &httptrace.ClientTrace{
+			GotFirstResponseByte: func() { atomic.AddInt32(&firstBytes, 1) },
+		}
+		resp := mustDo(req)
+		if n := atomic.LoadInt32(&firstBytes); n != 1 {
+			t.Errorf("expected 1 response to be traced, got %d", n)
+		}
+		timings := resp.Timings()
+		if timings.TTFB < delay || timings.TTFB > delay+time.Second {
+			t.Errorf("expected time to first byte of about %v, got %v", delay, timings.TTFB)
+		}
+		if timings.Connect <= 0 {
+			t.Errorf("expected connect time to be recorded")
+		}
+	}, grabtest.TimeToFirstByte(delay))
+}
+
+func TestReadWriteBufferSize(t *testing.T) {
+	filename := ".testReadWriteBufferSize"
+	defer os.Remove(filename)
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.ReadBufferSize = 4096
+		req.WriteBufferSize = 256 << 10
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		resp := mustDo(req)
+		if resp.bufferSize != req.ReadBufferSize {
+			t.Errorf("expected read buffer of %d bytes, got %d", req.ReadBufferSize, resp.bufferSize)
+		}
+		if resp.writeBuffer == nil || resp.writeBuffer.Size() != req.WriteBufferSize {
+			t.Errorf("expected write buffer of %d bytes", req.WriteBufferSize)
+		}
+		testComplete(t, resp)
+	})
+}
+
+// xorWriter inverts every byte written to w, as a trivial cipher stream.
+type xorWriter struct {
+	w      io.Writer
+	closed bool
+}
+
+func (x *xorWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	for i := range p {
+		b[i] = ^p[i]
+	}
+	return x.w.Write(b)
+}
+
+func (x *xorWriter) Close() error {
+	x.closed = true
+	return nil
+}
+
+// TestWrapWriter tests that Request.WrapWriter transforms the content written
+// to the destination file, while checksums are computed over the content sent
+// by the server.
+func TestWrapWriter(t *testing.T) {
+	filename := ".testWrapWriter"
+	defer os.Remove(filename)
+	grabtest.WithTestServer(t, func(url string) {
+		// an existing file is overwritten, rather than resumed
+		if err := ioutil.WriteFile(filename, make([]byte, 2<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var x *xorWriter
+		req := mustNewRequest(filename, url)
+		req.SetChecksum(sha256.New(), grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+		req.WrapWriter = func(w io.Writer) io.WriteCloser {
+			x = &xorWriter{w: w}
+			return x
+		}
+		resp := mustDo(req)
+		if resp.DidResume {
+			t.Errorf("expected existing file to be overwritten")
+		}
+		if p := resp.Request.OnFilenameCollision; p != CollisionResume {
+			t.Errorf("expected collision policy to be unchanged, got %v", p)
+		}
+		if x == nil || !x.closed {
+			t.Errorf("expected wrapped writer to be closed")
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != grabtest.DefaultHandlerContentLength {
+			t.Fatalf("expected %d bytes, got %d", grabtest.DefaultHandlerContentLength, len(b))
+		}
+		for i := range b {
+			if ^b[i] != byte(i) {
+				t.Fatalf("expected byte %d to be %d, got %d", i, byte(i), ^b[i])
+			}
+		}
+		testComplete(t, resp)
+
+		// wrapped content cannot be stored in memory or read again
+		req = mustNewRequest("", url)
+		req.NoStore = true
+		req.WrapWriter = func(w io.Writer) io.WriteCloser { return &xorWriter{w: w} }
+		if err := DefaultClient.Do(req).Err(); err != ErrBadRequest {
+			t.Errorf("expected ErrBadRequest with NoStore, got %v", err)
+		}
+	})
+}
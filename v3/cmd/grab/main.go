@@ -5,19 +5,24 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/cavaliergopher/grab/v3"
 	"github.com/cavaliergopher/grab/v3/pkg/grabui"
 )
 
 func main() {
 	// validate command args
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s url...\n", os.Args[0])
+	dst, urls := ".", os.Args[1:]
+	if len(urls) > 0 && urls[0] == grab.Stdout {
+		// write downloads to stdout, e.g. grab - url | tar xz
+		dst, urls = grab.Stdout, urls[1:]
+	}
+	if len(urls) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-] url...\n", os.Args[0])
 		os.Exit(1)
 	}
-	urls := os.Args[1:]
 
 	// download files
-	respch, err := grabui.GetBatch(context.Background(), 0, ".", urls...)
+	respch, err := grabui.GetBatch(context.Background(), 0, dst, urls...)
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,72 @@
+package grab
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// DefaultCompressedContentTypes lists the media types of files that are not
+// compressed again if Request.Compress is set, unless
+// Request.CompressedContentTypes is set.
+var DefaultCompressedContentTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"audio/*",
+	"video/*",
+}
+
+// compressFile compresses the named file with gzip into a new file with ".gz"
+// appended to its name, which is returned. The modification time of the
+// original file is kept and the original file is removed.
+func compressFile(ctx context.Context, filename string) (string, error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	dstname := filename + ".gz"
+	dst, err := os.OpenFile(dstname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(dst)
+	gz.Name = filepath.Base(filename)
+	gz.ModTime = fi.ModTime()
+	_, err = newTransfer(ctx, nil, gz, src, nil).copy()
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(dstname, fi.ModTime(), fi.ModTime())
+	}
+	if err != nil {
+		os.Remove(dstname)
+		return "", err
+	}
+	src.Close()
+	if err := os.Remove(filename); err != nil {
+		return "", err
+	}
+	return dstname, nil
+}
@@ -0,0 +1,87 @@
+package grab
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+func TestCompress(t *testing.T) {
+	filename := ".testCompress"
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".gz")
+	size := 32768
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	tests := []struct {
+		Name        string
+		ContentType string
+		Types       []string
+		Compressed  bool
+	}{
+		{"Compressed", "application/octet-stream", nil, true},
+		{"AlreadyCompressed", "application/zip", nil, false},
+		{"Wildcard", "video/mp4", nil, false},
+		{"CustomTypes", "application/zip", []string{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			os.Remove(filename)
+			os.Remove(filename + ".gz")
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(filename, url)
+				req.Compress = true
+				req.CompressedContentTypes = test.Types
+				resp := mustDo(req)
+				testComplete(t, resp)
+
+				if !test.Compressed {
+					if resp.Filename != filename {
+						t.Errorf("expected filename %s, got %s", filename, resp.Filename)
+					}
+					if _, err := os.Stat(filename + ".gz"); !os.IsNotExist(err) {
+						t.Errorf("expected file to not be compressed")
+					}
+					return
+				}
+				if resp.Filename != filename+".gz" {
+					t.Fatalf("expected filename %s.gz, got %s", filename, resp.Filename)
+				}
+				if _, err := os.Stat(filename); !os.IsNotExist(err) {
+					t.Errorf("expected original file to be removed")
+				}
+
+				// decompress
+				f, err := os.Open(resp.Filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gz.Name != filename {
+					t.Errorf("expected gzip name %s, got %s", filename, gz.Name)
+				}
+				b, err := ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Errorf("decompressed file does not match")
+				}
+			},
+				grabtest.ContentLength(size),
+				grabtest.ContentType(test.ContentType),
+			)
+		})
+	}
+}
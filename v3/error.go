@@ -1,6 +1,7 @@
 package grab
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -25,6 +26,58 @@ var (
 
 	// ErrFileExists indicates that the destination path already exists.
 	ErrFileExists = errors.New("file exists")
+
+	// ErrNoSpace indicates that a transfer failed because there is no space
+	// left on the destination device. The error returned by Response.Err wraps
+	// both ErrNoSpace and the underlying error from the file system.
+	ErrNoSpace = errors.New("no space left on device")
+
+	// ErrBadDestination indicates that a transfer could not be stored at the
+	// destination path, because the path names a directory or its directory is
+	// not writable, or that a write to the destination given to Client.Pipe
+	// failed. The error returned by Response.Err wraps both ErrBadDestination
+	// and the underlying error.
+	ErrBadDestination = errors.New("bad destination")
+
+	// ErrSymlinkDestination indicates that the destination path is a symbolic
+	// link, which is not followed unless Request.FollowSymlinks is set.
+	ErrSymlinkDestination = errors.New("destination is a symbolic link")
+
+	// ErrUnexpectedContentType indicates that the Content-Type of the server
+	// response is not in Request.AllowedContentTypes.
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+
+	// ErrUnsupportedArchive indicates that a downloaded file could not be
+	// extracted because it is not in a supported archive format.
+	ErrUnsupportedArchive = errors.New("unsupported archive format")
+
+	// ErrNotInProgress indicates that a file transfer could not be paused or
+	// resumed because it has already finished.
+	ErrNotInProgress = errors.New("transfer not in progress")
+
+	// ErrRedirectHost indicates that the server redirected a request with
+	// Request.SameHostRedirectsOnly set to a host that is not allowed. The
+	// error returned by Response.Err is a *url.Error wrapping ErrRedirectHost.
+	ErrRedirectHost = errors.New("redirect to a different host")
+
+	// ErrQuotaExceeded indicates that a transfer was not started because the
+	// Client has already transferred the number of bytes set by
+	// Client.ByteQuota.
+	ErrQuotaExceeded = errors.New("byte quota exceeded")
+
+	// ErrClientClosed indicates that a transfer was not started because the
+	// Client has been closed.
+	ErrClientClosed = errors.New("client closed")
+
+	// ErrDependencyFailed indicates that a Request was not sent by
+	// Client.DoBatch because a Request it depends on failed. The error returned
+	// by Response.Err wraps both ErrDependencyFailed and the error of the
+	// failed dependency.
+	ErrDependencyFailed = errors.New("dependency failed")
+
+	// ErrBadRequest indicates that a Request has conflicting or invalid
+	// options set.
+	ErrBadRequest = errors.New("bad request")
 )
 
 // StatusCodeError indicates that the server response had a status code that
@@ -40,3 +93,88 @@ func IsStatusCodeError(err error) bool {
 	_, ok := err.(StatusCodeError)
 	return ok
 }
+
+// noSpaceError wraps an error caused by a lack of space on the destination
+// device so that it matches ErrNoSpace.
+type noSpaceError struct {
+	err error
+}
+
+func (err *noSpaceError) Error() string {
+	return err.err.Error()
+}
+
+func (err *noSpaceError) Unwrap() error {
+	return err.err
+}
+
+func (err *noSpaceError) Is(target error) bool {
+	return target == ErrNoSpace
+}
+
+// IsNoSpace returns true if the given error was caused by a lack of space on
+// the destination device.
+func IsNoSpace(err error) bool {
+	return errors.Is(err, ErrNoSpace)
+}
+
+// IsCanceled returns true if the given error was caused by the cancelation of
+// a Request's context or of its Response. It returns false for errors caused by
+// an expired context deadline.
+func IsCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// badDestinationError wraps an error caused by a destination path that cannot
+// be written to so that it matches ErrBadDestination.
+type badDestinationError struct {
+	err error
+}
+
+func (err *badDestinationError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrBadDestination, err.err)
+}
+
+func (err *badDestinationError) Unwrap() error {
+	return err.err
+}
+
+func (err *badDestinationError) Is(target error) bool {
+	return target == ErrBadDestination
+}
+
+// IsBadDestination returns true if the given error was caused by a destination
+// path that cannot be written to.
+func IsBadDestination(err error) bool {
+	return errors.Is(err, ErrBadDestination)
+}
+
+// dependencyError wraps the error of a failed dependency of a Request so that
+// it matches ErrDependencyFailed.
+type dependencyError struct {
+	err error
+}
+
+func (err *dependencyError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrDependencyFailed, err.err)
+}
+
+func (err *dependencyError) Unwrap() error {
+	return err.err
+}
+
+func (err *dependencyError) Is(target error) bool {
+	return target == ErrDependencyFailed
+}
+
+// contentTypeError indicates that the server response had a Content-Type that
+// is not allowed, so that it matches ErrUnexpectedContentType.
+type contentTypeError string
+
+func (err contentTypeError) Error() string {
+	return fmt.Sprintf("%v: %q", ErrUnexpectedContentType, string(err))
+}
+
+func (err contentTypeError) Is(target error) bool {
+	return target == ErrUnexpectedContentType
+}
@@ -2,6 +2,9 @@ package grab
 
 import (
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"sync"
 )
 
@@ -93,3 +96,37 @@ func ExampleClient_DoBatch() {
 		fmt.Printf("Downloaded %s to %s\n", resp.Request.URL(), resp.Filename)
 	}
 }
+
+// This example uses Pipe to upload a file as multipart form data to another
+// service as it is downloaded, without storing it on the local file system.
+func ExampleClient_Pipe() {
+	req, err := NewRequest("", "http://example.com/example.zip")
+	if err != nil {
+		panic(err)
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", "example.zip")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		// a failed download aborts the upload
+		if err := NewClient().Pipe(req, part).Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	// a failed upload closes the pipe, which aborts the download
+	resp, err := http.Post("http://example.com/upload", mw.FormDataContentType(), pr)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	fmt.Println("Upload completed with status", resp.Status)
+}
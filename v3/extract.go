@@ -0,0 +1,182 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readerAtCloser is a downloaded archive that may be read in any order.
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openArchive opens a completed download for random access and returns its
+// size.
+func openArchive(resp *Response) (readerAtCloser, int64, error) {
+	if resp.Request.NoStore {
+		b := resp.storeBuffer.Bytes()
+		return nopReaderAtCloser{bytes.NewReader(b)}, int64(len(b)), nil
+	}
+	f, err := os.Open(resp.Filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+type nopReaderAtCloser struct {
+	io.ReaderAt
+}
+
+func (nopReaderAtCloser) Close() error { return nil }
+
+// extractArchive extracts the tar, gzip or bzip2 compressed tar, or zip archive
+// downloaded by resp into dir and returns the paths of all extracted files. The
+// archive format is detected from its content.
+func extractArchive(ctx context.Context, resp *Response, dir string) ([]string, error) {
+	ra, size, err := openArchive(resp)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+
+	var magic [262]byte
+	n, _ := ra.ReadAt(magic[:], 0)
+	r := io.NewSectionReader(ra, 0, size)
+	switch {
+	case bytes.HasPrefix(magic[:n], []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return nil, err
+		}
+		return extractZip(ctx, zr, dir)
+
+	case bytes.HasPrefix(magic[:n], []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return extractTar(ctx, gr, dir)
+
+	case bytes.HasPrefix(magic[:n], []byte("BZh")):
+		return extractTar(ctx, bzip2.NewReader(r), dir)
+
+	case n == len(magic) && string(magic[257:262]) == "ustar":
+		return extractTar(ctx, r, dir)
+	}
+	return nil, ErrUnsupportedArchive
+}
+
+// extractPath returns the path in dir at which the archive entry with the
+// given name should be extracted. An error is returned if the name would
+// escape dir, such as "../evil".
+func extractPath(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	path := filepath.Join(dir, name)
+	if path != dir && !strings.HasPrefix(path, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return path, nil
+}
+
+// extractFile writes the content of a regular file in an archive to path.
+func extractFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractTar extracts the regular files and directories of a tar archive into
+// dir. Links and other special files are skipped.
+func extractTar(ctx context.Context, r io.Reader, dir string) ([]string, error) {
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		path, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return files, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0777)
+		case tar.TypeReg, tar.TypeRegA:
+			if err = extractFile(path, tr, hdr.FileInfo().Mode()); err == nil {
+				files = append(files, path)
+			}
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+}
+
+// extractZip extracts the regular files and directories of a zip archive into
+// dir. Links and other special files are skipped.
+func extractZip(ctx context.Context, zr *zip.Reader, dir string) ([]string, error) {
+	var files []string
+	for _, zf := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return files, err
+		}
+		path, err := extractPath(dir, zf.Name)
+		if err != nil {
+			return files, err
+		}
+		mode := zf.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return files, err
+		}
+		err = extractFile(path, rc, mode)
+		rc.Close()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
@@ -0,0 +1,178 @@
+package grab
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testArchiveFiles are the contents of each archive used in tests.
+var testArchiveFiles = map[string]string{
+	"a.txt":     "hello",
+	"dir/b.txt": "world",
+}
+
+// testTarBzip2 is a bzip2 compressed tar archive of testArchiveFiles, as the
+// standard library cannot write bzip2.
+const testTarBzip2 = "" +
+	"QlpoOTFBWSZTWXRLKBcAAJN7hMkAAGBAAf+AAIh2ZJ7AAACASCAAlISpkk9T0AjRj0hpMIFUVNND" +
+	"1NAeoGgA9TytLSlkeJBjfCIhWtVCi5K81pRAo5HKTFJSfQeBxEQAZogVhnlASgsePdEUgJgJnEYp" +
+	"HiBliNPufbY7wFDrYJHC3G50XLJWflm3goiD+LuSKcKEg6JZQLg="
+
+func mustTar(files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range sortedKeys(files) {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func mustGzip(b []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		panic(err)
+	}
+	if err := gw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func mustZip(files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range sortedKeys(files) {
+		w, err := zw.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			panic(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestExtractDir(t *testing.T) {
+	bz2, err := base64.StdEncoding.DecodeString(testTarBzip2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Name    string
+		Archive []byte
+		NoStore bool
+		Err     error
+	}{
+		{"Tar", mustTar(testArchiveFiles), false, nil},
+		{"TarGzip", mustGzip(mustTar(testArchiveFiles)), false, nil},
+		{"TarBzip2", bz2, false, nil},
+		{"Zip", mustZip(testArchiveFiles), false, nil},
+		{"ZipNoStore", mustZip(testArchiveFiles), true, nil},
+		{"Unsupported", []byte("not an archive"), false, ErrUnsupportedArchive},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir := ".testExtractDir" + test.Name
+			filename := dir + ".archive"
+			defer os.RemoveAll(dir)
+			defer os.Remove(filename)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(test.Archive)
+			}))
+			defer s.Close()
+
+			req := mustNewRequest(filename, s.URL)
+			req.NoStore = test.NoStore
+			req.ExtractDir = dir
+			resp := DefaultClient.Do(req)
+			if err := resp.Err(); err != test.Err {
+				t.Fatalf("expected error %v, got: %v", test.Err, err)
+			}
+			if test.Err != nil {
+				return
+			}
+
+			extracted := resp.ExtractedFiles()
+			sort.Strings(extracted)
+			names := sortedKeys(testArchiveFiles)
+			if len(extracted) != len(names) {
+				t.Fatalf("expected %d extracted files, got: %v", len(names), extracted)
+			}
+			for i, name := range names {
+				path := filepath.Join(dir, name)
+				if extracted[i] != path {
+					t.Errorf("expected extracted file %s, got %s", path, extracted[i])
+				}
+				b, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != testArchiveFiles[name] {
+					t.Errorf("expected %s to contain '%s', got '%s'", name, testArchiveFiles[name], b)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractPathTraversal(t *testing.T) {
+	dir := ".testExtractPathTraversal"
+	defer os.RemoveAll(dir)
+	evil := map[string]string{"../evil.txt": "evil"}
+	for name, archive := range map[string][]byte{
+		"Tar": mustTar(evil),
+		"Zip": mustZip(evil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(archive)
+			}))
+			defer s.Close()
+
+			req := mustNewRequest("", s.URL+"/archive")
+			req.NoStore = true
+			req.ExtractDir = dir
+			if err := DefaultClient.Do(req).Err(); err == nil {
+				t.Errorf("expected error extracting file outside of ExtractDir")
+			}
+			if _, err := os.Stat("evil.txt"); !os.IsNotExist(err) {
+				os.Remove("evil.txt")
+				t.Errorf("expected file outside of ExtractDir to not be created")
+			}
+		})
+	}
+}
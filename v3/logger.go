@@ -0,0 +1,52 @@
+package grab
+
+import "fmt"
+
+// A LogLevel indicates the severity of a message sent to a Logger.
+type LogLevel int
+
+const (
+	// LogDebug indicates a message describing the progress of a transfer, such
+	// as each HTTP request sent.
+	LogDebug LogLevel = iota
+
+	// LogInfo indicates a message describing a significant event in a
+	// transfer, such as the decision to resume a partial download or the
+	// completion of a transfer.
+	LogInfo
+
+	// LogError indicates a message describing the failure of a transfer.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// A Logger receives messages describing each stage of the transfers made by a
+// Client. See Client.Logger.
+//
+// Logf is called synchronously from the goroutine performing each transfer,
+// so implementations must be safe for concurrent use and should never block
+// unnecessarily.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// logf sends a message about the given Response to the Client's Logger, if
+// set. Each message is prefixed with the URL of the request.
+func (c *Client) logf(resp *Response, level LogLevel, format string, args ...interface{}) {
+	if c.Logger == nil {
+		return
+	}
+	args = append([]interface{}{resp.Request.URL()}, args...)
+	c.Logger.Logf(level, "%s: "+format, args...)
+}
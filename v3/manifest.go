@@ -0,0 +1,58 @@
+package grab
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// ManifestEntry describes the outcome of a single transfer in a manifest
+// written by WriteManifest.
+type ManifestEntry struct {
+	// URL is the URL that was requested.
+	URL string `json:"url"`
+
+	// Filename is the path of the downloaded file, if it was stored.
+	Filename string `json:"filename,omitempty"`
+
+	// Size is the size of the downloaded file in bytes, or -1 if unknown.
+	Size int64 `json:"size"`
+
+	// Checksum is the hex encoded checksum of the downloaded file, if it was
+	// computed via Request.ComputeChecksum or SetChecksum.
+	Checksum string `json:"checksum,omitempty"`
+
+	// Status is "ok" if the transfer succeeded, or "error" if it failed.
+	Status string `json:"status"`
+
+	// Error is the error returned by Response.Err, if the transfer failed.
+	Error string `json:"error,omitempty"`
+}
+
+// WriteManifest waits for all of the given responses to complete and writes a
+// JSON array describing their outcomes to w, with one ManifestEntry per
+// response in the order given. This is useful to record the results of a
+// batch, such as for reproducible build attestations.
+func WriteManifest(w io.Writer, resps []*Response) error {
+	entries := make([]ManifestEntry, 0, len(resps))
+	for _, resp := range resps {
+		entry := ManifestEntry{
+			URL:    resp.Request.URL().String(),
+			Size:   resp.Size(),
+			Status: "ok",
+		}
+		if err := resp.Err(); err != nil {
+			entry.Status = "error"
+			entry.Error = err.Error()
+		} else if !resp.Request.NoStore {
+			entry.Filename = resp.Filename
+		}
+		if sum := resp.Checksum(); sum != nil {
+			entry.Checksum = hex.EncodeToString(sum)
+		}
+		entries = append(entries, entry)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
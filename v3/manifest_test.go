@@ -0,0 +1,79 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+// TestWriteManifest tests that the outcomes of a batch are written to a JSON
+// manifest.
+func TestWriteManifest(t *testing.T) {
+	size := 4096
+	grabtest.WithTestServer(t, func(url string) {
+		reqs := make([]*Request, 3)
+		for i := range reqs {
+			reqs[i] = mustNewRequest(fmt.Sprintf(".testWriteManifest%d", i), fmt.Sprintf("%s/%d", url, i))
+			reqs[i].ComputeChecksum(sha256.New())
+			defer os.Remove(reqs[i].Filename)
+		}
+		reqs[2] = mustNewRequest("", url+"/missing")
+		resps := make([]*Response, 0, len(reqs))
+		for resp := range DefaultClient.DoBatch(2, reqs...) {
+			resps = append(resps, resp)
+		}
+
+		var buf bytes.Buffer
+		if err := WriteManifest(&buf, resps); err != nil {
+			t.Fatal(err)
+		}
+		var entries []ManifestEntry
+		if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+			t.Fatalf("invalid manifest: %v\n%s", err, buf.String())
+		}
+		if len(entries) != len(resps) {
+			t.Fatalf("expected %d entries, got %d", len(resps), len(entries))
+		}
+		sum := sha256.New()
+		for i := 0; i < size; i++ {
+			sum.Write([]byte{byte(i)})
+		}
+		checksum := fmt.Sprintf("%x", sum.Sum(nil))
+		for i, entry := range entries {
+			resp := resps[i]
+			if entry.URL != resp.Request.URL().String() {
+				t.Errorf("expected URL %s, got %s", resp.Request.URL(), entry.URL)
+			}
+			if resp.Request.URL().Path == "/missing" {
+				if entry.Status != "error" || entry.Error == "" || entry.Filename != "" {
+					t.Errorf("expected failed entry, got %+v", entry)
+				}
+				continue
+			}
+			if entry.Status != "ok" || entry.Error != "" {
+				t.Errorf("expected successful entry, got %+v", entry)
+			}
+			if entry.Filename != resp.Filename || entry.Size != int64(size) {
+				t.Errorf("expected %s of %d bytes, got %s of %d bytes",
+					resp.Filename, size, entry.Filename, entry.Size)
+			}
+			if entry.Checksum != checksum {
+				t.Errorf("expected checksum %s, got %s", checksum, entry.Checksum)
+			}
+		}
+	},
+		grabtest.ContentLength(size),
+		grabtest.StatusCode(func(r *http.Request) int {
+			if r.URL.Path == "/missing" {
+				return http.StatusNotFound
+			}
+			return http.StatusOK
+		}),
+	)
+}
@@ -0,0 +1,173 @@
+package grab
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrBadSignature indicates that a downloaded file failed to pass signature
+// validation.
+var ErrBadSignature = errors.New("signature mismatch")
+
+// MinisignVerifier is a Verifier that validates downloaded files using a
+// detached minisign signature. See https://jedisct1.github.io/minisign/.
+type MinisignVerifier struct {
+	// PublicKey specifies the minisign public key of the signer, either as a
+	// base64 encoded key or the content of a minisign public key file.
+	PublicKey string
+
+	// SignatureURL specifies the URL of the detached signature file.
+	SignatureURL string
+
+	// Client specifies the Client used to download the signature file. If nil,
+	// DefaultClient is used.
+	Client *Client
+
+	// NewPrehash returns a new BLAKE2b-512 hash, such as blake2b.New512 from
+	// golang.org/x/crypto/blake2b. It is required to validate prehashed
+	// signatures, which are created by default since minisign 0.10. Legacy
+	// signatures can be validated without it.
+	NewPrehash func() hash.Hash
+}
+
+// NewMinisignVerifier returns a MinisignVerifier for the given public key and
+// signature URL.
+func NewMinisignVerifier(pubkey, sigURL string) *MinisignVerifier {
+	return &MinisignVerifier{
+		PublicKey:    pubkey,
+		SignatureURL: sigURL,
+	}
+}
+
+// Verify downloads the signature file and validates the given file against it.
+// ErrBadSignature is returned if the signature is not valid.
+func (c *MinisignVerifier) Verify(file io.Reader) error {
+	keyID, pub, err := parseMinisignPublicKey(c.PublicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := c.fetchSignature()
+	if err != nil {
+		return err
+	}
+
+	// validate the trusted comment before reading the file
+	if !bytes.Equal(sig.keyID, keyID) {
+		return fmt.Errorf("minisign signature was created with a different key")
+	}
+	global := append(append([]byte(nil), sig.signature...), sig.trustedComment...)
+	if !ed25519.Verify(pub, global, sig.globalSignature) {
+		return ErrBadSignature
+	}
+
+	var msg []byte
+	switch sig.algorithm {
+	case "Ed":
+		msg, err = ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+
+	case "ED":
+		if c.NewPrehash == nil {
+			return errors.New("minisign signature is prehashed but no BLAKE2b-512 hash was provided")
+		}
+		h := c.NewPrehash()
+		if _, err := io.Copy(h, file); err != nil {
+			return err
+		}
+		msg = h.Sum(nil)
+
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm: %q", sig.algorithm)
+	}
+	if !ed25519.Verify(pub, msg, sig.signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// fetchSignature downloads and parses the signature file.
+func (c *MinisignVerifier) fetchSignature() (*minisignSignature, error) {
+	client := c.Client
+	if client == nil {
+		client = DefaultClient
+	}
+	req, err := NewRequest("", c.SignatureURL)
+	if err != nil {
+		return nil, err
+	}
+	req.NoStore = true
+	b, err := client.Do(req).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("error downloading minisign signature: %v", err)
+	}
+	return parseMinisignSignature(string(b))
+}
+
+// minisignSignature is a parsed minisign signature file.
+type minisignSignature struct {
+	algorithm       string
+	keyID           []byte
+	signature       []byte
+	trustedComment  []byte
+	globalSignature []byte
+}
+
+// parseMinisignPublicKey returns the key ID and Ed25519 public key of a
+// minisign public key, which may include an untrusted comment line.
+func parseMinisignPublicKey(s string) (keyID []byte, pub ed25519.PublicKey, err error) {
+	lines := minisignLines(s)
+	if len(lines) == 0 {
+		return nil, nil, errors.New("minisign public key is empty")
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, nil, errors.New("invalid minisign public key")
+	}
+	return b[2:10], ed25519.PublicKey(b[10:]), nil
+}
+
+// parseMinisignSignature parses the content of a minisign signature file.
+func parseMinisignSignature(s string) (*minisignSignature, error) {
+	lines := minisignLines(s)
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "trusted comment: ") {
+		return nil, errors.New("invalid minisign signature file")
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(b) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, errors.New("invalid minisign global signature")
+	}
+	return &minisignSignature{
+		algorithm:       string(b[:2]),
+		keyID:           b[2:10],
+		signature:       b[10:],
+		trustedComment:  []byte(strings.TrimPrefix(lines[1], "trusted comment: ")),
+		globalSignature: global,
+	}, nil
+}
+
+// minisignLines returns the non-empty lines of a minisign file, excluding any
+// untrusted comment.
+func minisignLines(s string) []string {
+	lines := make([]string, 0, 4)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,123 @@
+package grab
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+// testMinisignKey is a minisign key pair used for testing.
+type testMinisignKey struct {
+	id   []byte
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+func newTestMinisignKey() *testMinisignKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return &testMinisignKey{
+		id:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		pub:  pub,
+		priv: priv,
+	}
+}
+
+// PublicKey returns the key encoded as a minisign public key file.
+func (c *testMinisignKey) PublicKey() string {
+	b := append([]byte("Ed"), c.id...)
+	b = append(b, c.pub...)
+	return "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(b) + "\n"
+}
+
+// Sign returns a minisign signature file for the given message. If h is not
+// nil, the message is prehashed using h.
+func (c *testMinisignKey) Sign(msg []byte, h hash.Hash) string {
+	alg := "Ed"
+	if h != nil {
+		alg = "ED"
+		h.Write(msg)
+		msg = h.Sum(nil)
+	}
+	sig := ed25519.Sign(c.priv, msg)
+	comment := "timestamp:0"
+	global := ed25519.Sign(c.priv, append(append([]byte(nil), sig...), comment...))
+	b := append([]byte(alg), c.id...)
+	b = append(b, sig...)
+	return fmt.Sprintf(
+		"untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(b),
+		comment,
+		base64.StdEncoding.EncodeToString(global))
+}
+
+func TestMinisignVerifier(t *testing.T) {
+	key := newTestMinisignKey()
+	content := make([]byte, 4096)
+	for i := 0; i < len(content); i++ {
+		content[i] = byte(i)
+	}
+	signatures := map[string]string{
+		"/legacy.minisig":    key.Sign(content, nil),
+		"/prehashed.minisig": key.Sign(content, sha512.New()),
+		"/other.minisig":     newTestMinisignKey().Sign(content, nil),
+		"/corrupt.minisig":   key.Sign(content[1:], nil),
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(signatures[r.URL.Path]))
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		Name       string
+		Path       string
+		NewPrehash func() hash.Hash
+		Match      bool
+	}{
+		{"Legacy", "/legacy.minisig", nil, true},
+		{"Prehashed", "/prehashed.minisig", sha512.New, true},
+		{"PrehashedWithoutHash", "/prehashed.minisig", nil, false},
+		{"OtherKey", "/other.minisig", nil, false},
+		{"Corrupt", "/corrupt.minisig", nil, false},
+		{"Missing", "/missing.minisig", nil, false},
+	}
+
+	filename := ".testMinisignVerifier"
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				v := NewMinisignVerifier(key.PublicKey(), s.URL+test.Path)
+				v.NewPrehash = test.NewPrehash
+				req := mustNewRequest(filename, url)
+				req.SetVerifier(v, true)
+				resp := DefaultClient.Do(req)
+				err := resp.Err()
+				if test.Match && err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if !test.Match {
+					if err == nil {
+						t.Errorf("expected verification error")
+					}
+					if _, err := os.Stat(filename); !os.IsNotExist(err) {
+						t.Errorf("file that failed verification was not deleted")
+					}
+				}
+				testComplete(t, resp)
+			}, grabtest.ContentLength(len(content)))
+		})
+	}
+}
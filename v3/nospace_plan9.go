@@ -0,0 +1,7 @@
+package grab
+
+// isNoSpace returns true if the given error was caused by a lack of space on
+// the destination device. It is not supported on Plan 9.
+func isNoSpace(err error) bool {
+	return false
+}
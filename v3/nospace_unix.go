@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package grab
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isNoSpace returns true if the given error was caused by a lack of space on
+// the destination device.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package grab
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fullWriter is an io.Writer that fails as if the destination device is full.
+type fullWriter struct{}
+
+func (fullWriter) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+}
+
+func TestNoSpace(t *testing.T) {
+	tr := newTransfer(
+		context.Background(),
+		nil,
+		fullWriter{},
+		strings.NewReader("some content"),
+		nil)
+	_, err := tr.copy()
+	if !IsNoSpace(err) {
+		t.Errorf("expected IsNoSpace to return true for %T: %v", err, err)
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected error to wrap %v, got: %v", syscall.ENOSPC, err)
+	}
+	if IsNoSpace(errors.New("some other error")) {
+		t.Errorf("expected IsNoSpace to return false for unrelated errors")
+	}
+}
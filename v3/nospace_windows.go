@@ -0,0 +1,19 @@
+package grab
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorHandleDiskFull syscall.Errno = 39  // ERROR_HANDLE_DISK_FULL
+	errorDiskFull       syscall.Errno = 112 // ERROR_DISK_FULL
+)
+
+// isNoSpace returns true if the given error was caused by a lack of space on
+// the destination device.
+func isNoSpace(err error) bool {
+	return errors.Is(err, errorDiskFull) ||
+		errors.Is(err, errorHandleDiskFull) ||
+		errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,64 @@
+package bps
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// NewEWMA returns a gauge that uses an Exponentially Weighted Moving Average to
+// measure the bytes per second of a byte stream.
+//
+// Each new sample contributes the rate observed since the previous sample,
+// weighted according to the time elapsed between them, so that the influence
+// of a rate decays by a factor of e for every period of the given window.
+// Compared to a Simple Moving Average, an EWMA gives smoother readings on
+// volatile streams, as old samples fade gradually rather than being dropped.
+//
+// The gauge reports the first rate as soon as two samples are taken.
+func NewEWMA(window time.Duration) Gauge {
+	if window <= 0 {
+		panic("window must be greater than zero")
+	}
+	return &ewma{window: window.Seconds()}
+}
+
+type ewma struct {
+	mu       sync.Mutex
+	window   float64
+	rate     float64
+	hasRate  bool
+	hasPrior bool
+	lastT    time.Time
+	lastN    int64
+}
+
+func (c *ewma) Sample(t time.Time, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.hasPrior {
+		c.lastT, c.lastN = t, n
+		c.hasPrior = true
+		return
+	}
+	seconds := t.Sub(c.lastT).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	rate := float64(n-c.lastN) / seconds
+	c.lastT, c.lastN = t, n
+	if !c.hasRate {
+		c.rate = rate
+		c.hasRate = true
+		return
+	}
+	alpha := 1 - math.Exp(-seconds/c.window)
+	c.rate += alpha * (rate - c.rate)
+}
+
+func (c *ewma) BPS() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rate
+}
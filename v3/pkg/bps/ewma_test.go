@@ -0,0 +1,58 @@
+package bps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEWMA_SimpleSteadyCase(t *testing.T) {
+	test := &SampleSetTest{
+		Interval: time.Second,
+		Samples:  getSimpleSamples(100000, 3),
+	}
+	t.Run("ShortWindow", func(t *testing.T) {
+		test.Gauge = NewEWMA(time.Second)
+		test.Run(t)
+	})
+	t.Run("LongWindow", func(t *testing.T) {
+		test.Gauge = NewEWMA(time.Minute)
+		test.Run(t)
+	})
+}
+
+// TestRateChange tests that gauges with a shorter window respond faster to a
+// change in the transfer rate.
+func TestRateChange(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Short Gauge
+		Long  Gauge
+	}{
+		{"SMA", NewSMA(2), NewSMA(6)},
+		{"EWMA", NewEWMA(time.Second), NewEWMA(5 * time.Second)},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			// 100 B/s for ten seconds then 1000 B/s for two seconds
+			ts := time.Unix(0, 0)
+			var n int64
+			for i := 0; i <= 12; i++ {
+				test.Short.Sample(ts, n)
+				test.Long.Sample(ts, n)
+				ts = ts.Add(time.Second)
+				if i < 10 {
+					n += 100
+				} else {
+					n += 1000
+				}
+			}
+			short, long := test.Short.BPS(), test.Long.BPS()
+			if short <= long {
+				t.Errorf("expected shorter window to respond faster: short %0.2f, long %0.2f", short, long)
+			}
+			if short > 1000 {
+				t.Errorf("expected at most 1000 B/s, got %0.2f", short)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package grabtest
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,12 +26,21 @@ type handler struct {
 	statusCodeFunc     StatusCodeFunc
 	methodWhitelist    []string
 	headerBlacklist    []string
+	header             http.Header
 	contentLength      int
 	acceptRanges       bool
 	attachmentFilename string
+	contentType        string
 	lastModified       time.Time
 	ttfb               time.Duration
 	rateLimiter        *time.Ticker
+	bytesPerSecond     int
+	closeMidStream     bool
+	closeAfterBytes    int
+	headConnectionDrop bool
+	trailingBytes      int
+	corruptRequests    int32
+	trailerChecksum    string
 }
 
 func NewHandler(options ...HandlerOption) (http.Handler, error) {
@@ -46,7 +58,7 @@ func NewHandler(options ...HandlerOption) (http.Handler, error) {
 	return h, nil
 }
 
-func WithTestServer(t *testing.T, f func(url string), options ...HandlerOption) {
+func WithTestServer(t testing.TB, f func(url string), options ...HandlerOption) {
 	h, err := NewHandler(options...)
 	if err != nil {
 		t.Fatalf("unable to create test server handler: %v", err)
@@ -85,6 +97,12 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// drop HEAD requests
+	if r.Method == "HEAD" && h.headConnectionDrop {
+		closeConn(w)
+		return
+	}
+
 	// set server options
 	if h.acceptRanges {
 		w.Header().Set("Accept-Ranges", "bytes")
@@ -98,6 +116,11 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		)
 	}
 
+	// set content type
+	if h.contentType != "" {
+		w.Header().Set("Content-Type", h.contentType)
+	}
+
 	// set last modified timestamp
 	lastMod := time.Now()
 	if !h.lastModified.IsZero() {
@@ -106,20 +129,39 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Last-Modified", lastMod.Format(http.TimeFormat))
 
 	// set content-length
-	offset := 0
+	offset, end := 0, h.contentLength
+	ranged := false
 	if h.acceptRanges {
 		if reqRange := r.Header.Get("Range"); reqRange != "" {
-			if _, err := fmt.Sscanf(reqRange, "bytes=%d-", &offset); err != nil {
+			last := 0
+			n, _ := fmt.Sscanf(reqRange, "bytes=%d-%d", &offset, &last)
+			if n == 0 {
 				httpError(w, http.StatusBadRequest)
 				return
 			}
 			if offset >= h.contentLength {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", h.contentLength))
 				httpError(w, http.StatusRequestedRangeNotSatisfiable)
 				return
 			}
+			if n == 2 && last < end-1 {
+				end = last + 1
+			}
+			ranged = offset > 0 || end < h.contentLength
 		}
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", h.contentLength-offset))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", end-offset))
+
+	// set additional headers
+	for key, values := range h.header {
+		w.Header()[key] = values
+	}
+
+	// declare checksum trailer, which requires a chunked response body
+	if h.trailerChecksum != "" && r.Method == "GET" {
+		w.Header().Set("Trailer", h.trailerChecksum)
+		w.Header().Del("Content-Length")
+	}
 
 	// apply header blacklist
 	for _, key := range h.headerBlacklist {
@@ -127,14 +169,41 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// send header and status code
-	w.WriteHeader(h.statusCodeFunc(r))
+	code := h.statusCodeFunc(r)
+	if ranged && code == http.StatusOK {
+		w.Header().Set(
+			"Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", offset, end-1, h.contentLength),
+		)
+		code = http.StatusPartialContent
+	}
+	w.WriteHeader(code)
 
 	// send body
 	if r.Method == "GET" {
+		corrupt := atomic.AddInt32(&h.corruptRequests, -1) >= 0
+
 		// use buffered io to reduce overhead on the reader
 		bw := bufio.NewWriterSize(w, 4096)
-		for i := offset; !isRequestClosed(r) && i < h.contentLength; i++ {
-			bw.Write([]byte{byte(i)})
+		start := time.Now()
+		chunkSize := h.chunkSize()
+		for i := offset; !isRequestClosed(r) && i < end; i++ {
+			if h.closeMidStream && i-offset == h.closeAfterBytes {
+				bw.Flush()
+				w.(http.Flusher).Flush()
+				closeConn(w)
+				return
+			}
+			if corrupt && i == offset {
+				bw.WriteByte(^byte(i))
+			} else {
+				bw.WriteByte(byte(i))
+			}
+			if n := i - offset + 1; h.bytesPerSecond > 0 && (n%chunkSize == 0 || i == h.contentLength-1) {
+				h.pace(r, start, n)
+				bw.Flush()
+				w.(http.Flusher).Flush()
+			}
 			if h.rateLimiter != nil {
 				bw.Flush()
 				w.(http.Flusher).Flush() // force the server to send the data to the client
@@ -147,7 +216,78 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if !isRequestClosed(r) {
 			bw.Flush()
 		}
+
+		// send checksum of the entire content in the declared trailer
+		if h.trailerChecksum != "" {
+			w.Header().Set(h.trailerChecksum, h.checksum())
+		}
+
+		// send bytes beyond the declared content length
+		if h.trailingBytes > 0 && !isRequestClosed(r) {
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			b := make([]byte, h.trailingBytes)
+			for i := range b {
+				b[i] = byte(h.contentLength + i)
+			}
+			conn.Write(b)
+		}
+	}
+}
+
+// checksum returns the hex encoded SHA-256 checksum of the entire content
+// served by the handler.
+func (h *handler) checksum() string {
+	sum := sha256.New()
+	bw := bufio.NewWriterSize(sum, 4096)
+	for i := 0; i < h.contentLength; i++ {
+		bw.WriteByte(byte(i))
+	}
+	bw.Flush()
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// chunkSize returns the number of bytes to send between each pause when
+// throttling the response body with WithRateLimit. Chunks are sized to give
+// roughly ten pauses per second.
+func (h *handler) chunkSize() int {
+	n := h.bytesPerSecond / 10
+	if n < 1 {
+		return 1
+	}
+	if n > 4096 {
+		return 4096
+	}
+	return n
+}
+
+// pace blocks until n bytes may have been sent since start without exceeding
+// the limit set by WithRateLimit, or the request is canceled.
+func (h *handler) pace(r *http.Request, start time.Time, n int) {
+	d := time.Duration(n)*time.Second/time.Duration(h.bytesPerSecond) - time.Since(start)
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+// closeConn hijacks and closes the underlying connection of the given
+// ResponseWriter. Any buffered response data must be flushed first.
+func closeConn(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
 	}
+	conn.Close()
 }
 
 // isRequestClosed returns true if the client request has been canceled.
@@ -40,6 +40,17 @@ func HeaderBlacklist(headers ...string) HandlerOption {
 	}
 }
 
+// Header sets an additional header in all responses.
+func Header(key, value string) HandlerOption {
+	return func(h *handler) error {
+		if h.header == nil {
+			h.header = make(http.Header)
+		}
+		h.header.Set(key, value)
+		return nil
+	}
+}
+
 func ContentLength(n int) HandlerOption {
 	return func(h *handler) error {
 		if n < 0 {
@@ -84,9 +95,101 @@ func RateLimiter(bps int) HandlerOption {
 	}
 }
 
+// WithRateLimit limits the throughput of each response body to the given number
+// of bytes per second. Unlike RateLimiter, the limit applies to each connection
+// independently and the body is written in chunks, making it suitable for
+// benchmarking transfers at high rates. For range requests, the limit applies
+// only to the bytes that are actually sent.
+func WithRateLimit(bytesPerSec int) HandlerOption {
+	return func(h *handler) error {
+		if bytesPerSec < 1 {
+			return errors.New("bytes per second must be greater than zero")
+		}
+		h.bytesPerSecond = bytesPerSec
+		return nil
+	}
+}
+
 func AttachmentFilename(filename string) HandlerOption {
 	return func(h *handler) error {
 		h.attachmentFilename = filename
 		return nil
 	}
 }
+
+func ContentType(contentType string) HandlerOption {
+	return func(h *handler) error {
+		h.contentType = contentType
+		return nil
+	}
+}
+
+// WithMidStreamClose closes the underlying connection after afterBytes bytes of
+// a response body have been sent. The client will observe an unexpected EOF.
+//
+// The byte count applies to each response individually. If AcceptRanges is
+// enabled, a client that resumes the transfer with a Range request will receive
+// up to afterBytes more bytes before the connection is closed again. If
+// AcceptRanges is disabled, each request starts from the first byte and will
+// never complete if afterBytes is less than the content length.
+func WithMidStreamClose(afterBytes int) HandlerOption {
+	return func(h *handler) error {
+		if afterBytes < 0 {
+			return errors.New("byte count must be zero or greater")
+		}
+		h.closeAfterBytes = afterBytes
+		h.closeMidStream = true
+		return nil
+	}
+}
+
+// WithHeadConnectionDrop closes the underlying connection for all HEAD requests
+// without sending a response, so that the client observes an EOF. GET requests
+// are unaffected.
+func WithHeadConnectionDrop() HandlerOption {
+	return func(h *handler) error {
+		h.headConnectionDrop = true
+		return nil
+	}
+}
+
+// WithTrailingBytes sends n more bytes after the end of each response body
+// than are declared in the Content-Length header, and then closes the
+// connection. This emulates a buggy or malicious server. Note that the
+// http.Client discards any bytes beyond the declared length.
+func WithTrailingBytes(n int) HandlerOption {
+	return func(h *handler) error {
+		if n < 0 {
+			return errors.New("trailing byte count must be zero or greater")
+		}
+		h.trailingBytes = n
+		return nil
+	}
+}
+
+// WithCorruptBody corrupts the first byte of the response body of the first n
+// GET requests, so that the transferred content fails checksum validation.
+// Subsequent requests receive the correct content.
+func WithCorruptBody(n int) HandlerOption {
+	return func(h *handler) error {
+		if n < 0 {
+			return errors.New("request count must be zero or greater")
+		}
+		h.corruptRequests = int32(n)
+		return nil
+	}
+}
+
+// WithTrailerChecksum sends the hex encoded SHA-256 checksum of the entire
+// content in an HTTP trailer with the given name after the body of each GET
+// response. As trailers require a chunked response body, no Content-Length
+// header is sent with GET responses.
+func WithTrailerChecksum(name string) HandlerOption {
+	return func(h *handler) error {
+		if name == "" {
+			return errors.New("trailer name must not be empty")
+		}
+		h.trailerChecksum = name
+		return nil
+	}
+}
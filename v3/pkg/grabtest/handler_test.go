@@ -1,8 +1,11 @@
 package grabtest
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -53,6 +56,15 @@ func TestHandlerHeaderBlacklist(t *testing.T) {
 	)
 }
 
+func TestHandlerHeader(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseHeader(t, resp, "X-Content-Length", "%d", 4096)
+	},
+		Header("X-Content-Length", "4096"),
+	)
+}
+
 func TestHandlerStatusCodeFuncs(t *testing.T) {
 	expect := 418 // I'm a teapot
 	WithTestServer(t, func(url string) {
@@ -110,18 +122,46 @@ func TestHandlerAcceptRanges(t *testing.T) {
 			req := MustHTTPNewRequest("GET", url, nil)
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n/2))
 			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusPartialContent)
 			AssertHTTPResponseHeader(t, resp, header, "bytes")
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes %d-%d/%d", n/2, n-1, n)
 			AssertHTTPResponseContentLength(t, resp, int64(n/2))
 		},
 			ContentLength(n),
 		)
 	})
 
+	t.Run("Bounded", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", "bytes=0-0")
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusPartialContent)
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes 0-0/%d", n)
+			AssertHTTPResponseContentLength(t, resp, 1)
+		},
+			ContentLength(n),
+		)
+	})
+
+	t.Run("Unsatisfiable", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n))
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusRequestedRangeNotSatisfiable)
+			AssertHTTPResponseHeader(t, resp, "Content-Range", "bytes */%d", n)
+		},
+			ContentLength(n),
+		)
+	})
+
 	t.Run("Disabled", func(t *testing.T) {
 		WithTestServer(t, func(url string) {
 			req := MustHTTPNewRequest("GET", url, nil)
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n/2))
 			resp := MustHTTPDo(req)
+			AssertHTTPResponseStatusCode(t, resp, http.StatusOK)
 			AssertHTTPResponseHeader(t, resp, header, "")
 			AssertHTTPResponseContentLength(t, resp, int64(n))
 		},
@@ -141,6 +181,16 @@ func TestHandlerAttachmentFilename(t *testing.T) {
 	)
 }
 
+func TestHandlerContentType(t *testing.T) {
+	contentType := "application/zip"
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseHeader(t, resp, "Content-Type", "%s", contentType)
+	},
+		ContentType(contentType),
+	)
+}
+
 func TestHandlerLastModified(t *testing.T) {
 	WithTestServer(t, func(url string) {
 		resp := MustHTTPDoWithClose(MustHTTPNewRequest("GET", url, nil))
@@ -149,3 +199,148 @@ func TestHandlerLastModified(t *testing.T) {
 		LastModified(time.Unix(123456789, 0)),
 	)
 }
+
+func TestHandlerWithRateLimit(t *testing.T) {
+	n := 4096
+	bps := 16384
+	t.Run("Full", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			start := time.Now()
+			resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			AssertHTTPResponseContentLength(t, resp, int64(n))
+			if d := time.Since(start); d < 250*time.Millisecond {
+				t.Errorf("expected transfer to take >250ms, took %v", d)
+			}
+		},
+			ContentLength(n),
+			WithRateLimit(bps),
+		)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		WithTestServer(t, func(url string) {
+			req := MustHTTPNewRequest("GET", url, nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n/2))
+			start := time.Now()
+			resp := MustHTTPDo(req)
+			AssertHTTPResponseContentLength(t, resp, int64(n/2))
+			if d := time.Since(start); d < 125*time.Millisecond {
+				t.Errorf("expected transfer to take >125ms, took %v", d)
+			}
+		},
+			ContentLength(n),
+			WithRateLimit(bps),
+		)
+	})
+}
+
+func TestHandlerWithMidStreamClose(t *testing.T) {
+	n := 4096
+	afterBytes := 1024
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+		defer resp.Body.Close()
+		AssertHTTPResponseStatusCode(t, resp, http.StatusOK)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("expected error: %v, got: %v", io.ErrUnexpectedEOF, err)
+		}
+		if len(b) != afterBytes {
+			t.Errorf("expected body length: %d, got: %d", afterBytes, len(b))
+		}
+
+		// resume from where the connection was dropped
+		req := MustHTTPNewRequest("GET", url, nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", n-afterBytes))
+		AssertHTTPResponseContentLength(t, MustHTTPDo(req), int64(afterBytes))
+	},
+		ContentLength(n),
+		WithMidStreamClose(afterBytes),
+	)
+}
+
+func TestHandlerWithHeadConnectionDrop(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		_, err := http.DefaultClient.Do(MustHTTPNewRequest("HEAD", url, nil))
+		if err == nil {
+			t.Error("expected HEAD request to fail")
+		}
+		resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+		AssertHTTPResponseContentLength(t, resp, int64(DefaultHandlerContentLength))
+	},
+		WithHeadConnectionDrop(),
+	)
+}
+
+func TestHandlerWithTrailingBytes(t *testing.T) {
+	n := 4096
+	trailing := 128
+	WithTestServer(t, func(url string) {
+		// read the raw response, as http.Client will discard trailing bytes
+		u := MustHTTPNewRequest("GET", url, nil).URL
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", u.Host)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(n) {
+			t.Errorf("expected content length: %d, got: %d", n, resp.ContentLength)
+		}
+		AssertHTTPResponseBodyLength(t, resp, int64(n))
+		b, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != trailing {
+			t.Errorf("expected %d trailing bytes, got: %d", trailing, len(b))
+		}
+	},
+		ContentLength(n),
+		WithTrailingBytes(trailing),
+	)
+}
+
+func TestHandlerWithCorruptBody(t *testing.T) {
+	n := 4096
+	WithTestServer(t, func(url string) {
+		for i := 0; i < 3; i++ {
+			resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+			b, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != n {
+				t.Fatalf("expected body length: %d, got: %d", n, len(b))
+			}
+			corrupt := b[0] != 0
+			if expect := i < 2; corrupt != expect {
+				t.Errorf("request %d: expected corrupt body: %v", i+1, expect)
+			}
+		}
+	},
+		ContentLength(n),
+		WithCorruptBody(2),
+	)
+}
+
+func TestHandlerWithTrailerChecksum(t *testing.T) {
+	WithTestServer(t, func(url string) {
+		resp := MustHTTPDo(MustHTTPNewRequest("GET", url, nil))
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		if v := resp.Trailer.Get("X-Checksum-Sha256"); v != DefaultHandlerSHA256Checksum {
+			t.Errorf("expected trailer checksum %s, got: %s", DefaultHandlerSHA256Checksum, v)
+		}
+	},
+		WithTrailerChecksum("X-Checksum-Sha256"),
+	)
+}
@@ -3,6 +3,7 @@ package grabui
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -11,6 +12,10 @@ import (
 )
 
 type ConsoleClient struct {
+	// Output is the writer to which progress is printed. If nil, os.Stdout is
+	// used.
+	Output io.Writer
+
 	mu                            sync.Mutex
 	client                        *grab.Client
 	succeeded, failed, inProgress int
@@ -43,7 +48,7 @@ func (c *ConsoleClient) Do(
 			c.client = grab.DefaultClient
 		}
 
-		fmt.Printf("Downloading %d files...\n", len(reqs))
+		fmt.Fprintf(c.output(), "Downloading %d files...\n", len(reqs))
 		respch := c.client.DoBatch(workers, reqs...)
 		t := time.NewTicker(200 * time.Millisecond)
 		defer t.Stop()
@@ -73,7 +78,8 @@ func (c *ConsoleClient) Do(
 		c.refresh()
 		close(pump)
 
-		fmt.Printf(
+		fmt.Fprintf(
+			c.output(),
 			"Finished %d successful, %d failed, %d incomplete.\n",
 			c.succeeded,
 			c.failed,
@@ -82,28 +88,42 @@ func (c *ConsoleClient) Do(
 	return pump
 }
 
+// output returns the writer to which progress is printed.
+func (c *ConsoleClient) output() io.Writer {
+	if c.Output == nil {
+		return os.Stdout
+	}
+	return c.Output
+}
+
 // refresh prints the progress of all downloads to the terminal
 func (c *ConsoleClient) refresh() {
 	// clear lines for incomplete downloads
 	if c.inProgress > 0 {
-		fmt.Printf("\033[%dA\033[K", c.inProgress)
+		fmt.Fprintf(c.output(), "\033[%dA\033[K", c.inProgress)
 	}
 
 	// print newly completed downloads
+	snapshots := make([]grab.ResponseSnapshot, len(c.responses))
 	for i, resp := range c.responses {
-		if resp != nil && resp.IsComplete() {
-			if resp.Err() != nil {
+		if resp == nil {
+			continue
+		}
+		s := resp.Snapshot()
+		snapshots[i] = s
+		if s.Phase == grab.PhaseDone {
+			if s.Err != nil {
 				c.failed++
 				fmt.Fprintf(os.Stderr, "Error downloading %s: %v\n",
 					resp.Request.URL(),
-					resp.Err())
+					s.Err)
 			} else {
 				c.succeeded++
-				fmt.Printf("Finished %s %s / %s (%d%%)\n",
+				fmt.Fprintf(c.output(), "Finished %s %s / %s (%d%%)\n",
 					resp.Filename,
-					byteString(resp.BytesComplete()),
-					byteString(resp.Size()),
-					int(100*resp.Progress()))
+					byteString(s.BytesComplete),
+					byteString(s.Size),
+					int(100*s.Progress))
 			}
 			c.responses[i] = nil
 		}
@@ -111,17 +131,28 @@ func (c *ConsoleClient) refresh() {
 
 	// print progress for incomplete downloads
 	c.inProgress = 0
-	for _, resp := range c.responses {
-		if resp != nil {
-			fmt.Printf("Downloading %s %s / %s (%d%%) - %s ETA: %s \033[K\n",
+	for i, resp := range c.responses {
+		if resp == nil {
+			continue
+		}
+		s := snapshots[i]
+		// most checksums are computed as the file is written, so the file is
+		// only read again, and reported as being verified, if that was not
+		// possible or to compare an existing file
+		if s.Phase == grab.PhaseChecksum {
+			fmt.Fprintf(c.output(), "Verifying %s (%d%%) \033[K\n",
+				resp.Filename,
+				int(100*s.ChecksumProgress))
+		} else {
+			fmt.Fprintf(c.output(), "Downloading %s %s / %s (%d%%) - %s ETA: %s \033[K\n",
 				resp.Filename,
-				byteString(resp.BytesComplete()),
-				byteString(resp.Size()),
-				int(100*resp.Progress()),
-				bpsString(resp.BytesPerSecond()),
-				etaString(resp.ETA()))
-			c.inProgress++
+				byteString(s.BytesComplete),
+				byteString(s.Size),
+				int(100*s.Progress),
+				bpsString(s.BytesPerSecond),
+				etaString(s.ETA))
 		}
+		c.inProgress++
 	}
 }
 
@@ -2,6 +2,7 @@ package grabui
 
 import (
 	"context"
+	"os"
 
 	"github.com/cavaliergopher/grab/v3"
 )
@@ -23,5 +24,11 @@ func GetBatch(
 	}
 
 	ui := NewConsoleClient(grab.DefaultClient)
+	if dst == grab.Stdout {
+		// keep progress out of the downloaded content and write each file in
+		// turn
+		ui.Output = os.Stderr
+		workers = 1
+	}
 	return ui.Do(ctx, workers, reqs...), nil
 }
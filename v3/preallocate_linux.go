@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package grab
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocates disk space for the given file up to size bytes, so that
+// the file is less likely to be fragmented and the transfer fails early if
+// there is insufficient space. If the file system does not support fallocate,
+// the file is extended with Truncate instead.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
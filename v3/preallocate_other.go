@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package grab
+
+import "os"
+
+// preallocate extends the given file to size bytes. On this platform, disk
+// space is not necessarily allocated until it is written.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
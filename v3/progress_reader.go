@@ -0,0 +1,72 @@
+package grab
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/cavaliergopher/grab/v3/pkg/bps"
+)
+
+// ProgressReader wraps an io.Reader to report the number of bytes read and the
+// rate at which they are read, and to optionally limit that rate, in the same
+// way as grab does for file transfers. This allows grab's transfer machinery
+// to be used with sources other than HTTP responses, such as an existing
+// network connection.
+//
+// N and BPS are safe to call from other goroutines while Read is in progress.
+type ProgressReader struct {
+	t      *transfer
+	cancel context.CancelFunc
+}
+
+// NewProgressReader returns a ProgressReader that reads from r. Reads fail with
+// the error of ctx once it is canceled. If lim is not nil, each read waits for
+// lim to permit the number of bytes read before returning, so the size of the
+// buffers passed to Read should be well below the rate limit.
+//
+// The transfer rate is measured in another goroutine until Close is called or
+// ctx is canceled.
+func NewProgressReader(ctx context.Context, r io.Reader, lim RateLimiter) *ProgressReader {
+	ctx, cancel := context.WithCancel(ctx)
+	t := newTransfer(ctx, lim, nil, r, nil)
+	go bps.Watch(ctx, t.gauge, t.N, time.Second)
+	return &ProgressReader{t: t, cancel: cancel}
+}
+
+// Read reads from the underlying reader, waiting for the rate limiter if one
+// was given.
+func (r *ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = r.t.read(p)
+	if n > 0 {
+		atomic.AddInt64(&r.t.n, int64(n))
+		if r.t.lim != nil {
+			if errw := r.t.lim.WaitN(r.t.ctx, n); errw != nil && err == nil {
+				err = errw
+			}
+		}
+	}
+	return n, err
+}
+
+// N returns the number of bytes read so far.
+func (r *ProgressReader) N() int64 {
+	return r.t.N()
+}
+
+// BPS returns the current rate at which bytes are read, in bytes per second,
+// using a simple moving average.
+func (r *ProgressReader) BPS() float64 {
+	return r.t.BPS()
+}
+
+// Close stops measuring the transfer rate and closes the underlying reader if
+// it implements io.Closer. Subsequent reads fail with context.Canceled.
+func (r *ProgressReader) Close() error {
+	r.cancel()
+	if c, ok := r.t.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package grab
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	src := bytes.Repeat([]byte{0xFF}, 4096)
+
+	t.Run("Read", func(t *testing.T) {
+		r := NewProgressReader(context.Background(), bytes.NewReader(src), nil)
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, src) {
+			t.Errorf("content does not match source")
+		}
+		if r.N() != int64(len(src)) {
+			t.Errorf("expected %d bytes read, got %d", len(src), r.N())
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := NewProgressReader(ctx, bytes.NewReader(src), nil)
+		defer r.Close()
+		if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if _, err := r.Read(make([]byte, 1024)); err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+		if r.N() != 1024 {
+			t.Errorf("expected 1024 bytes read, got %d", r.N())
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		r := NewProgressReader(context.Background(), bytes.NewReader(src), nil)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(make([]byte, 1024)); err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("RateLimiter", func(t *testing.T) {
+		// read 512 bytes, 64 bytes at a time, at 2048 bytes per second
+		lim := &testRateLimiter{r: 2048}
+		r := NewProgressReader(context.Background(), bytes.NewReader(src[:512]), lim)
+		defer r.Close()
+		start := time.Now()
+		if _, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{r}, make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 250*time.Millisecond {
+			t.Errorf("expected read to take at least 250ms, took %v", d)
+		}
+		if lim.n != 512 {
+			t.Errorf("expected 512 bytes permitted by the rate limiter, got %d", lim.n)
+		}
+	})
+}
@@ -1,12 +1,169 @@
 package grab
 
-import "context"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 // RateLimiter is an interface that must be satisfied by any third-party rate
 // limiters that may be used to limit download transfer speeds.
 //
 // A recommended token bucket implementation can be found at
 // https://godoc.org/golang.org/x/time/rate#Limiter.
+//
+// If a RateLimiter also has a method
+//
+//	Limit() float64
+//
+// returning its sustained limit in bytes per second, the limit is used to
+// estimate the time at which a transfer will complete, as reported by
+// Response.ETA.
 type RateLimiter interface {
 	WaitN(ctx context.Context, n int) (err error)
 }
+
+// limiter is a RateLimiter that reports its limit in bytes per second.
+type limiter interface {
+	Limit() float64
+}
+
+// expectedRate returns the rate in bytes per second at which a transfer
+// limited by lim is expected to continue, given its measured rate. The limit of
+// lim caps the measured rate, which may overshoot the limit in bursts, and
+// replaces it until a rate has been measured. If lim does not report its limit,
+// the measured rate is returned.
+func expectedRate(lim RateLimiter, measured float64) float64 {
+	l, ok := lim.(limiter)
+	if !ok {
+		return measured
+	}
+	limit := l.Limit()
+	if limit <= 0 {
+		return measured
+	}
+	if measured == 0 || measured > limit {
+		return limit
+	}
+	return measured
+}
+
+// A RateWindow is a daily period during which a ScheduledRateLimiter limits
+// transfers to a given rate. Start and End are offsets from midnight in the
+// local time zone of the limiter's clock. If End is before Start, the window
+// wraps past midnight, such as from 22:00 to 06:00.
+type RateWindow struct {
+	Start, End time.Duration
+
+	// BytesPerSecond is the rate limit during the window. Zero or less means
+	// no limit.
+	BytesPerSecond float64
+}
+
+// contains returns true if the given offset from midnight is in the window.
+func (w RateWindow) contains(d time.Duration) bool {
+	if w.Start <= w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
+// ScheduledRateLimiter is a RateLimiter whose limit depends on the time of
+// day, such as to throttle downloads during business hours and allow full
+// speed overnight. The limit is re-evaluated on every call to WaitN, so a long
+// transfer changes its rate as it crosses into another window.
+//
+// A ScheduledRateLimiter is safe for concurrent use and may be shared by
+// several requests, in which case the limit applies to their combined rate.
+type ScheduledRateLimiter struct {
+	// BytesPerSecond is the rate limit outside all windows. Zero or less means
+	// no limit.
+	BytesPerSecond float64
+
+	// Schedule is the list of windows with a different rate limit. If windows
+	// overlap, the first in the list applies.
+	Schedule []RateWindow
+
+	mu   sync.Mutex
+	next time.Time // time at which all bytes waited for are within the limit
+
+	// now and sleep may be replaced to simulate the passing of time.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewScheduledRateLimiter returns a RateLimiter that limits transfers to the
+// rate of the first window of schedule that contains the current time of day,
+// or to bytesPerSecond outside all windows.
+func NewScheduledRateLimiter(bytesPerSecond float64, schedule ...RateWindow) *ScheduledRateLimiter {
+	return &ScheduledRateLimiter{
+		BytesPerSecond: bytesPerSecond,
+		Schedule:       schedule,
+	}
+}
+
+// WaitN blocks until n more bytes may be transferred within the current limit,
+// or ctx is canceled.
+func (l *ScheduledRateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.clock()
+	limit := l.limitAt(now)
+	if l.next.Before(now) || limit <= 0 {
+		l.next = now
+	}
+	if limit > 0 {
+		l.next = l.next.Add(time.Duration(float64(n) / limit * float64(time.Second)))
+	}
+	d := l.next.Sub(now)
+	sleep := l.sleep
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	return sleep(ctx, d)
+}
+
+// Limit returns the current limit in bytes per second, or zero if there is no
+// limit.
+func (l *ScheduledRateLimiter) Limit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit := l.limitAt(l.clock()); limit > 0 {
+		return limit
+	}
+	return 0
+}
+
+func (l *ScheduledRateLimiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// limitAt returns the limit in bytes per second at the given time.
+func (l *ScheduledRateLimiter) limitAt(t time.Time) float64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	d := t.Sub(midnight)
+	for _, w := range l.Schedule {
+		if w.contains(d) {
+			return w.BytesPerSecond
+		}
+	}
+	return l.BytesPerSecond
+}
+
+// sleepContext blocks for the given duration, or until ctx is canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -27,6 +27,18 @@ func (c *testRateLimiter) WaitN(ctx context.Context, n int) (err error) {
 	return
 }
 
+// Limit returns the limit of the rate limiter in bytes per second.
+func (c *testRateLimiter) Limit() float64 {
+	return float64(c.r)
+}
+
+// rateLimiterFunc is a RateLimiter that calls itself for each call to WaitN.
+type rateLimiterFunc func(ctx context.Context, n int) error
+
+func (f rateLimiterFunc) WaitN(ctx context.Context, n int) error {
+	return f(ctx, n)
+}
+
 func TestRateLimiter(t *testing.T) {
 	// download a 128 byte file, 8 bytes at a time, with a naive 512bps limiter
 	// should take > 250ms
@@ -55,6 +67,39 @@ func TestRateLimiter(t *testing.T) {
 	}, grabtest.ContentLength(filesize))
 }
 
+// TestRateLimiterETA tests that the ETA of a rate limited transfer is
+// estimated using the limit of the rate limiter.
+func TestRateLimiterETA(t *testing.T) {
+	filesize := 16384
+	filename := ".testRateLimiterETA"
+	defer os.Remove(filename)
+
+	grabtest.WithTestServer(t, func(url string) {
+		req := mustNewRequest(filename, url)
+		req.BufferSize = 1024
+		req.RateLimiter = &testRateLimiter{r: filesize} // one second
+
+		resp := DefaultClient.Do(req)
+		expect := resp.Start.Add(time.Second)
+		tolerance := 250 * time.Millisecond
+		for _, d := range []time.Duration{
+			100 * time.Millisecond,
+			300 * time.Millisecond,
+			600 * time.Millisecond,
+		} {
+			time.Sleep(time.Until(resp.Start.Add(d)))
+			eta := resp.ETA()
+			if eta.IsZero() {
+				t.Fatalf("expected ETA after %v", d)
+			}
+			if diff := eta.Sub(expect); diff < -tolerance || diff > tolerance {
+				t.Errorf("expected ETA within %v of the expected end after %v, got %v", tolerance, d, diff)
+			}
+		}
+		testComplete(t, resp)
+	}, grabtest.ContentLength(filesize))
+}
+
 func ExampleRateLimiter() {
 	req, _ := NewRequest("", "http://www.golang-book.com/public/pdf/gobook.pdf")
 
@@ -67,3 +112,84 @@ func ExampleRateLimiter() {
 		log.Fatal(err)
 	}
 }
+
+// fakeClock is a clock for a ScheduledRateLimiter that advances only when the
+// limiter sleeps, recording each sleep.
+type fakeClock struct {
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) error {
+	c.t = c.t.Add(d)
+	c.sleeps = append(c.sleeps, d)
+	return nil
+}
+
+// TestScheduledRateLimiter tests that the rate of a ScheduledRateLimiter
+// changes as a transfer crosses into another window of its schedule.
+func TestScheduledRateLimiter(t *testing.T) {
+	// 4000 B/s outside business hours, 1000 B/s from 09:00 until 17:00
+	clock := &fakeClock{t: time.Date(2020, 1, 1, 8, 59, 59, 0, time.UTC)}
+	lim := NewScheduledRateLimiter(4000, RateWindow{
+		Start:          9 * time.Hour,
+		End:            17 * time.Hour,
+		BytesPerSecond: 1000,
+	})
+	lim.now, lim.sleep = clock.now, clock.sleep
+	if l := lim.Limit(); l != 4000 {
+		t.Errorf("expected limit 4000 before 09:00, got %v", l)
+	}
+	for i := 0; i < 8; i++ {
+		if err := lim.WaitN(context.Background(), 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []time.Duration{
+		250 * time.Millisecond, // 08:59:59.25
+		250 * time.Millisecond, // 08:59:59.5
+		250 * time.Millisecond, // 08:59:59.75
+		250 * time.Millisecond, // 09:00:00
+		time.Second,            // 09:00:01
+		time.Second,
+		time.Second,
+		time.Second,
+	}
+	if len(clock.sleeps) != len(expect) {
+		t.Fatalf("expected %d sleeps, got %v", len(expect), clock.sleeps)
+	}
+	for i, d := range expect {
+		if clock.sleeps[i] != d {
+			t.Errorf("expected sleep %d to be %v, got %v", i, d, clock.sleeps[i])
+		}
+	}
+	if l := lim.Limit(); l != 1000 {
+		t.Errorf("expected limit 1000 after 09:00, got %v", l)
+	}
+
+	t.Run("Overnight", func(t *testing.T) {
+		lim := NewScheduledRateLimiter(0, RateWindow{
+			Start:          22 * time.Hour,
+			End:            6 * time.Hour,
+			BytesPerSecond: 500,
+		})
+		for hour, expect := range map[int]float64{21: 0, 22: 500, 3: 500, 6: 0} {
+			clock := &fakeClock{t: time.Date(2020, 1, 1, hour, 0, 0, 0, time.UTC)}
+			lim.now = clock.now
+			if l := lim.Limit(); l != expect {
+				t.Errorf("expected limit %v at %02d:00, got %v", expect, hour, l)
+			}
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		lim := NewScheduledRateLimiter(1)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := lim.WaitN(ctx, 1000); err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
@@ -3,8 +3,14 @@ package grab
 import (
 	"context"
 	"hash"
+	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"time"
+
+	"github.com/cavaliergopher/grab/v3/pkg/bps"
 )
 
 // A Hook is a user provided callback function that can be called by grab at
@@ -18,16 +24,82 @@ import (
 // download from a callback, simply return a non-nil error.
 type Hook func(*Response) error
 
+// A CollisionPolicy specifies how a Client handles a file that already exists
+// at the destination path of a Request.
+type CollisionPolicy int
+
+const (
+	// CollisionResume compares the existing file to the remote file and
+	// resumes the transfer if the existing file is incomplete. This is the
+	// default.
+	CollisionResume CollisionPolicy = iota
+
+	// CollisionOverwrite replaces the contents of the existing file.
+	CollisionOverwrite
+
+	// CollisionError causes ErrFileExists to be returned without modifying the
+	// existing file.
+	CollisionError
+
+	// CollisionRename downloads the file to a new path, derived from the
+	// destination path by appending " (1)", " (2)", etc. before the file
+	// extension, as web browsers do. The new path is reserved atomically so
+	// that concurrent transfers never choose the same path. Response.Filename
+	// is updated to the new path.
+	CollisionRename
+
+	// CollisionOverwriteIfDifferent downloads the file to a temporary file in
+	// the same directory as the existing file. Once the transfer is complete and
+	// validated, the existing file is replaced by the temporary file only if
+	// their contents differ. Otherwise, the temporary file is removed, the
+	// existing file is left unmodified, including its modification time, and
+	// Response.NotModified is set.
+	CollisionOverwriteIfDifferent
+)
+
+// A ResumeAction specifies how a Client handles an existing file at the
+// destination path of a Request, as returned by Request.ResumePolicy.
+type ResumeAction int
+
+const (
+	// ActionResume resumes the transfer from the end of the existing file, or
+	// considers the file complete if it matches the size of the remote file.
+	ActionResume ResumeAction = iota
+
+	// ActionRestart overwrites the contents of the existing file.
+	ActionRestart
+
+	// ActionSkip considers the existing file complete without transferring
+	// anything. Any checksum set via SetChecksum is still validated.
+	ActionSkip
+
+	// ActionFail causes ErrFileExists to be returned without modifying the
+	// existing file.
+	ActionFail
+)
+
 // A Request represents an HTTP file transfer request to be sent by a Client.
 type Request struct {
 	// Label is an arbitrary string which may used to label a Request with a
 	// user friendly name.
+	//
+	// The Label is also available to the HTTPClient via the context of each
+	// http.Request sent for the Request. See LabelFromContext.
 	Label string
 
 	// Tag is an arbitrary interface which may be used to relate a Request to
 	// other data.
+	//
+	// The Tag is also available to the HTTPClient via the context of each
+	// http.Request sent for the Request. See TagFromContext.
 	Tag interface{}
 
+	// Priority specifies the order in which Requests are started by
+	// Client.DoBatch. Requests with a higher Priority are started before any
+	// Requests with a lower Priority, while Requests with equal Priority are
+	// started in the order they were given.
+	Priority int
+
 	// HTTPRequest specifies the http.Request to be sent to the remote server to
 	// initiate a file transfer. It includes request configuration such as URL,
 	// protocol version, HTTP method, request headers and authentication.
@@ -41,21 +113,144 @@ type Request struct {
 	// directory.
 	Filename string
 
+	// FilenameTransform, if set, is called with the base name of the
+	// destination file once it is known, whether it was given in Filename or
+	// resolved from the server response, and returns the base name to use
+	// instead. This allows a suffix or prefix to be applied to all downloaded
+	// files. The transformed name is subject to OnFilenameCollision and is
+	// passed to OnResolved. FilenameTransform is ignored if File is set.
+	FilenameTransform func(name string) string
+
+	// ExtensionFromContentType specifies that, if the filename resolved from
+	// the server response has no extension, the extension registered for the
+	// Content-Type of the response is appended, such as ".png" for image/png.
+	// Where several extensions are registered for a type, the most common is
+	// used. Filenames given by the caller are never changed.
+	ExtensionFromContentType bool
+
+	// File specifies an open file to which the transfer will be written,
+	// instead of opening the file named by Filename. This allows the caller to
+	// download into files opened with special flags or preallocated in advance.
+	//
+	// If File is set, Filename is ignored and grab will not create directories
+	// or resolve a filename from the server response. If File is not empty,
+	// grab will resume the transfer from the end of the file, or from
+	// ResumeFrom if set. Set NoResume to overwrite its contents instead. File
+	// is never truncated or closed by grab; the caller remains responsible for
+	// it. File cannot be combined with NoStore.
+	File *os.File
+
 	// SkipExisting specifies that ErrFileExists should be returned if the
 	// destination path already exists. The existing file will not be checked for
 	// completeness.
 	SkipExisting bool
 
+	// SkipIfChecksumMatches specifies that, if a file already exists at the
+	// destination path and an expected checksum was set via SetChecksum, the
+	// checksum of the existing file should be computed before any requests are
+	// sent to the remote server. If it matches, the file is assumed to be
+	// complete and the transfer finishes without contacting the remote server.
+	// Otherwise, the existing file is handled as usual.
+	SkipIfChecksumMatches bool
+
+	// OnFilenameCollision specifies how an existing file at the destination path
+	// is handled, such as when multiple Requests resolve to the same filename.
+	// By default, the existing file is assumed to be a previous download of the
+	// same file and is resumed. See CollisionPolicy. OnFilenameCollision is
+	// ignored if File is set.
+	OnFilenameCollision CollisionPolicy
+
+	// FollowSymlinks specifies that the destination path may be a symbolic
+	// link, in which case the file it links to is resumed or written to. By
+	// default, a transfer to a symbolic link fails with ErrSymlinkDestination,
+	// so that a link planted in a shared directory cannot redirect the write
+	// to another file. Links to directories are always followed. FollowSymlinks
+	// is ignored if File is set.
+	FollowSymlinks bool
+
 	// NoResume specifies that a partially completed download will be restarted
 	// without attempting to resume any existing file. If the download is already
 	// completed in full, it will not be restarted.
 	NoResume bool
 
+	// ResumePolicy, if not nil, is called to decide how an existing file at the
+	// destination path is handled, in place of SkipExisting, NoResume and
+	// RestartIfModified. It is given the FileInfo of the local file and the
+	// response to the HEAD request sent to the remote server, which is nil if
+	// NoHead is set. Returning a non-nil error cancels the transfer with that
+	// error. ResumePolicy is not called if the destination does not exist.
+	ResumePolicy func(local os.FileInfo, remote *http.Response) (ResumeAction, error)
+
+	// RestartIfModified specifies that an existing file is overwritten, rather
+	// than resumed or considered complete, if the Last-Modified header of the
+	// remote file is later than the modification time of the local file. This
+	// prevents the content of a new version of the remote file from being
+	// appended to a file that was downloaded from a previous version. Since
+	// grab sets the timestamp of completed files to the remote Last-Modified
+	// time, this also detects completed files that have since been replaced
+	// remotely. A HEAD request is always sent for existing files, unless NoHead
+	// is set.
+	RestartIfModified bool
+
+	// ResumeVerifySize specifies the number of trailing bytes of a partially
+	// completed file that are compared to the same range of the remote file
+	// before the transfer is resumed. If the bytes do not match, the existing
+	// file may have been truncated or corrupted and the transfer is restarted
+	// from the beginning instead. If zero, existing files are resumed without
+	// verification.
+	ResumeVerifySize int64
+
+	// NoHead specifies that grab should not send a HEAD request to determine
+	// the capabilities of the remote server before downloading. Instead, if a
+	// partially completed file exists at Filename, the transfer is resumed with
+	// a ranged GET request and restarted from the beginning if the server
+	// responds with the entire file instead of 206 Partial Content.
+	//
+	// If Filename is empty or a directory, the filename is resolved from the
+	// GET response and any existing file is overwritten.
+	NoHead bool
+
+	// ResumeFrom specifies the byte offset from which to resume the transfer,
+	// instead of resuming from the end of any existing file at Filename. The
+	// first ResumeFrom bytes of the existing file are kept and any remaining
+	// content is replaced by the transfer.
+	//
+	// Filename must name an existing file that is at least ResumeFrom bytes
+	// long, otherwise ErrBadLength is returned. ResumeFrom cannot be combined
+	// with NoResume or NoStore.
+	ResumeFrom int64
+
 	// NoStore specifies that grab should not write to the local file system.
 	// Instead, the download will be stored in memory and accessible only via
 	// Response.Open or Response.Bytes.
 	NoStore bool
 
+	// StreamBufferSize specifies that the download should not be stored, but
+	// written to a bounded buffer of the given size in bytes, from which it may
+	// be read as it is transferred via Response.Stream. When the buffer is full,
+	// the transfer waits for the consumer to read from it. StreamBufferSize
+	// implies NoStore, though Response.Open and Response.Bytes are unavailable.
+	// It cannot be combined with checksum validation or a Verifier, as the
+	// downloaded content cannot be read again, but see ComputeChecksum.
+	StreamBufferSize int
+
+	// Preallocate specifies that disk space for the entire file should be
+	// allocated before the transfer starts, if the size of the file is known.
+	// This reduces fragmentation and causes the transfer to fail early if there
+	// is insufficient space.
+	//
+	// A preallocated file has its full size from the start of the transfer, so
+	// if the transfer is interrupted, the file cannot be resumed automatically.
+	// Use ResumeFrom to resume such a file from a known offset.
+	Preallocate bool
+
+	// Sparse specifies that blocks of the file that contain only zero bytes
+	// should be skipped instead of written, so that the file is stored as a
+	// sparse file on file systems that support them. This saves disk space for
+	// files with large runs of zeros, such as virtual machine images. Sparse
+	// has no effect if Preallocate, NoStore or File are set.
+	Sparse bool
+
 	// NoCreateDirectories specifies that any missing directories in the given
 	// Filename path should not be created automatically, if they do not already
 	// exist.
@@ -66,27 +261,198 @@ type Request struct {
 	// status code to be within the 2XX range (after following redirects).
 	IgnoreBadStatusCodes bool
 
+	// ErrorBodySize specifies the maximum number of bytes of the response body
+	// to capture if the remote server responds with a status code outside the
+	// 2XX range, such as an error message in JSON. The captured body is
+	// available via Response.ErrorBody once the transfer has failed with a
+	// StatusCodeError, and is never written to the destination. ErrorBodySize
+	// is ignored if IgnoreBadStatusCodes is set.
+	ErrorBodySize int
+
 	// IgnoreRemoteTime specifies that grab should not attempt to set the
 	// timestamp of the local file to match the remote file.
 	IgnoreRemoteTime bool
 
+	// ModTime, if non-zero, specifies the modification time to set on the
+	// completed file. It takes precedence over the Last-Modified header of the
+	// remote server and is applied after checksum validation and after any
+	// temporary file has replaced the destination.
+	ModTime time.Time
+
+	// UseServerDigest specifies that the remote server should be asked for a
+	// checksum of the file via the Want-Digest header described in RFC 3230. If
+	// the server responds with a SHA-256 or SHA-512 checksum in a Digest
+	// header, the downloaded file is validated against it as if it were set via
+	// SetChecksum. If the server does not provide a supported checksum, or a
+	// checksum was already set via SetChecksum, no validation is added.
+	UseServerDigest bool
+
+	// UseContentMD5 specifies that the downloaded file is validated against
+	// the MD5 checksum of the remote file, if the server provides one, as if
+	// it were set via SetChecksum. Many object stores send this checksum in a
+	// base64 encoded Content-MD5 header, or as a hex encoded ETag. Composite
+	// ETags of multipart uploads, which contain a "-", and weak ETags are
+	// ignored, as is the Content-MD5 header of a partial response. If no MD5
+	// checksum is provided, or a checksum was already set, no validation is
+	// added.
+	UseContentMD5 bool
+
+	// ChecksumRetries specifies the number of times a transfer that fails
+	// checksum validation is restarted from the beginning, discarding any
+	// downloaded content, before ErrBadChecksum is returned. This allows for
+	// mirrors that occasionally serve a stale or corrupt copy of a file.
+	// Transfers that are read via Response.Stream or Client.DoStream are never
+	// restarted, as their content has already been consumed.
+	//
+	// A restarted transfer replaces Response.HTTPResponse and clears
+	// Response.DidResume, so these fields should only be read once the
+	// transfer is complete. Accessors such as Response.BytesComplete and
+	// Response.Progress may be called at any time and report the progress of
+	// the current attempt.
+	ChecksumRetries int
+
+	// ReadRetries specifies the number of times a transfer that ends before
+	// all expected bytes are received, such as when a proxy closes a kept-alive
+	// connection mid-body, is continued with a Range request from the current
+	// offset before the error is returned. The remote server must support
+	// range requests.
+	ReadRetries int
+
+	// ExtractDir specifies a directory into which the downloaded file should be
+	// extracted once it has passed any checksum validation or verification.
+	// The archive format is detected from the content of the file and may be a
+	// tar archive, optionally compressed with gzip or bzip2, or a zip archive.
+	// Only regular files and directories are extracted. If the format is not
+	// supported, ErrUnsupportedArchive is returned. If any file in the archive
+	// would be extracted outside of ExtractDir, extraction stops and an error
+	// is returned. The extracted files are listed by Response.ExtractedFiles.
+	ExtractDir string
+
+	// Compress specifies that the downloaded file should be compressed with
+	// gzip once it has passed any checksum validation or verification and been
+	// extracted to ExtractDir. The compressed file is written to Filename with
+	// ".gz" appended, the original file is removed and Response.Filename is
+	// updated to the compressed file. Files that are already compressed, as
+	// indicated by a Content-Type in CompressedContentTypes, are left as they
+	// are. Compress has no effect if NoStore or File are set.
+	Compress bool
+
+	// CompressedContentTypes specifies the media types of files that are
+	// already compressed and should not be compressed again if Compress is
+	// set. A type may end with a wildcard subtype, such as "video/*". If nil,
+	// DefaultCompressedContentTypes is used.
+	CompressedContentTypes []string
+
+	// Cookies specifies cookies to be sent with each HTTP request made for this
+	// Request, in addition to any already set on HTTPRequest or stored in the
+	// cookie jar of the Client. See WithCookieJar.
+	Cookies []*http.Cookie
+
+	// HeadBytes, if greater than zero, specifies that only the first HeadBytes
+	// bytes of the remote file are downloaded, using a ranged request where
+	// the remote server supports it. The transfer completes once HeadBytes
+	// bytes have been written, or at the end of a shorter file, and any
+	// remaining content sent by the server is discarded.
+	HeadBytes int64
+
 	// Size specifies the expected size of the file transfer if known. If the
 	// server response size does not match, the transfer is cancelled and
 	// ErrBadLength returned.
 	Size int64
 
+	// SizeHeader specifies the name of a response header from which the size of
+	// the response body should be read if the remote server does not send a
+	// Content-Length header, such as an X-Content-Length header sent alongside
+	// chunked transfer encoding. If the header is missing or cannot be parsed,
+	// the size remains unknown. If the size is known, a transfer of any other
+	// length fails with ErrBadLength.
+	SizeHeader string
+
 	// BufferSize specifies the size in bytes of the buffer that is used for
 	// transferring the requested file. Larger buffers may result in faster
 	// throughput but will use more memory and result in less frequent updates
 	// to the transfer progress statistics. If a RateLimiter is configured,
 	// BufferSize should be much lower than the rate limit. Default: 32KB.
+	//
+	// As each read is written to the destination as it is received, BufferSize
+	// sets the size of both reads and writes, unless ReadBufferSize or
+	// WriteBufferSize are set.
 	BufferSize int
 
+	// ReadBufferSize specifies the size in bytes of the buffer that is used to
+	// read from the remote server, overriding BufferSize.
+	ReadBufferSize int
+
+	// WriteBufferSize specifies that writes to the destination should be
+	// buffered and made in chunks of the given size in bytes, independently of
+	// the size of each read from the remote server. This may improve throughput
+	// where the destination favours larger writes than the network delivers.
+	WriteBufferSize int
+
+	// WrapWriter, if set, wraps the destination file so that the content of
+	// the transfer is transformed before it is written, such as to encrypt it
+	// at rest via a cipher stream. The returned writer is closed once the
+	// transfer is complete, before the destination file is closed.
+	//
+	// Checksums set via SetChecksum or ComputeChecksum are computed over the
+	// content received from the server, before it is wrapped, as the file is
+	// transferred. As grab cannot read the wrapped content of an existing file,
+	// an existing file at the destination is overwritten rather than resumed,
+	// unless OnFilenameCollision is set to another policy. WrapWriter cannot
+	// be combined with NoStore, File, ResumeFrom, a Verifier, ExtractDir or a
+	// checksum that would require the file to be read again.
+	WrapWriter func(w io.Writer) io.WriteCloser
+
 	// RateLimiter allows the transfer rate of a download to be limited. The given
 	// Request.BufferSize determines how frequently the RateLimiter will be
 	// polled.
 	RateLimiter RateLimiter
 
+	// AllowedContentTypes specifies the media types that the response to the
+	// GET request for the file may declare in its Content-Type header, such as
+	// "application/zip". A type may end with a wildcard subtype, such as
+	// "image/*", to allow all subtypes. If the Content-Type of the response is
+	// missing or not allowed, the request is cancelled without writing a file
+	// and an error matching ErrUnexpectedContentType is returned on the
+	// Response object. If empty, all content types are allowed.
+	AllowedContentTypes []string
+
+	// Precondition is a user provided callback that is called with the
+	// response to the GET request for the file once its headers have been
+	// received, before any of the response body is transferred. It may be used
+	// to reject responses that do not match what the caller expects, such as an
+	// HTML error page served with status 200 in place of the requested file. If
+	// Precondition returns an error, the request is cancelled without writing
+	// a file and the same error is returned on the Response object.
+	//
+	// Precondition is not called if the file was already completely downloaded.
+	Precondition func(*http.Response) error
+
+	// OnResolved is a user provided callback that is called once the remote
+	// server has responded and Response.Filename and Response.Size are known,
+	// but before the destination file is created or opened. The hook may change
+	// Response.Filename to redirect the download to another path. If OnResolved
+	// returns an error, the request is cancelled without creating a file and the
+	// same error is returned on the Response object.
+	OnResolved Hook
+
+	// NewGauge is a user provided constructor for the gauge used to measure
+	// the transfer rate reported by Response.BytesPerSecond. The gauge is
+	// sampled once per second. This allows the averaging window to be tuned,
+	// for example using bps.NewSMA(3) to respond more quickly to changes in the
+	// transfer rate, or bps.NewEWMA for smoother readings on volatile links.
+	// Default: a five second simple moving average, bps.NewSMA(6).
+	NewGauge func() bps.Gauge
+
+	// SampleInterval specifies how often the progress of the transfer is
+	// sampled to measure the transfer rate reported by Response.BytesPerSecond.
+	// Shorter intervals suit short downloads and fine-grained progress
+	// displays, while longer intervals reduce overhead on long downloads. The
+	// default gauge is sized to keep a five second window for any interval,
+	// but a gauge returned by NewGauge should be sized as described by
+	// bps.NewSMA. Default: one second.
+	SampleInterval time.Duration
+
 	// BeforeCopy is a user provided callback that is called immediately before
 	// a request starts downloading. If BeforeCopy returns an error, the request
 	// is cancelled and the same error is returned on the Response object.
@@ -99,17 +465,109 @@ type Request struct {
 	// the Response object.
 	AfterCopy Hook
 
+	// ReSign is a user provided callback that is called if the remote server
+	// responds with 403 Forbidden and a body indicating that the signature of a
+	// pre-signed URL (such as those issued by S3 or Google Cloud Storage) has
+	// expired. ReSign is given the expired URL and should return a freshly
+	// signed replacement, which is then used to retry the request, including
+	// any Range header set to resume the transfer. ReSign is called at most
+	// once per Response. If ReSign returns an error, the request is canceled
+	// and the same error is returned on the Response object.
+	ReSign func(old *url.URL) (*url.URL, error)
+
+	// URLFunc, if not nil, is called before each HTTP request is sent for the
+	// transfer, including HEAD requests, GET requests and any requests sent to
+	// resume the transfer, to produce the URL of the request. This allows
+	// signed or templated URLs to be regenerated for every attempt. attempt is
+	// the number of requests already sent for the transfer. The URL returned
+	// by URLFunc takes precedence over the URL of HTTPRequest and any URL
+	// returned by ReSign. If URLFunc returns an error, the request is
+	// cancelled and the same error is returned on the Response object.
+	URLFunc func(attempt int) (string, error)
+
+	// ClientTrace, if set, receives the events of every HTTP request sent for
+	// the transfer, such as DNS lookups, connections and the first byte of each
+	// response, for debugging slow servers. The timings of key events are also
+	// recorded by Response.Timings, whether or not ClientTrace is set.
+	ClientTrace *httptrace.ClientTrace
+
+	// ResolveVia, if set, is called with the response to a GET request for the
+	// URL of HTTPRequest before the transfer starts, to resolve the URL of the
+	// file content from it, such as from a JSON envelope returned by an API
+	// endpoint. The content is then downloaded from the returned URL, which
+	// may be relative to the first URL. If ResolveVia returns an empty URL, the
+	// content is downloaded from the first URL as usual.
+	//
+	// If the returned filename is not empty, its base name is used as the
+	// name of the destination file, unless Filename names a file rather than
+	// a directory. The body of the response is closed once ResolveVia
+	// returns. If ResolveVia returns an error, the request is canceled and the
+	// same error is returned on the Response object.
+	ResolveVia func(resp *http.Response) (url, filename string, err error)
+
+	// SameHostRedirectsOnly specifies that redirects to a host other than the
+	// host of the requested URL, or one of RedirectHosts, are rejected with
+	// ErrRedirectHost. Hosts are compared including any port. This protects
+	// downloads of untrusted URLs from being redirected to internal services.
+	//
+	// The redirect policy of the Client's HTTPClient is still applied to
+	// redirects that are allowed. If the HTTPClient is not an *http.Client,
+	// the request fails with ErrBadRequest.
+	SameHostRedirectsOnly bool
+
+	// RedirectHosts specifies additional hosts that may be redirected to when
+	// SameHostRedirectsOnly is set. Each host may include a port, otherwise any
+	// port is allowed.
+	RedirectHosts []string
+
 	// hash, checksum and deleteOnError - set via SetChecksum.
 	hash          hash.Hash
 	checksum      []byte
 	deleteOnError bool
 
+	// hashFactory - set via SetChecksumFactory.
+	hashFactory func() hash.Hash
+
+	// trailerChecksum - set via SetTrailerChecksum.
+	trailerChecksum string
+
+	// archive and archiveName - set via SetArchive.
+	archive     ArchiveWriter
+	archiveName string
+
+	// computeHash - set via ComputeChecksum.
+	computeHash hash.Hash
+
+	// teeBufferSize - set via Client.DoStream.
+	teeBufferSize int
+
+	// pipe - set via Client.Pipe.
+	pipe io.Writer
+
+	// dependsOn - set via DependsOn.
+	dependsOn []*Request
+
+	// verifier and deleteOnVerifyError - set via SetVerifier.
+	verifier            Verifier
+	deleteOnVerifyError bool
+
 	// Context for cancellation and timeout - set via WithContext
 	ctx context.Context
 }
 
+// Stdout is the destination name that causes NewRequest to write the
+// downloaded content to standard output.
+const Stdout = "-"
+
+// stdout is the writer used for requests to the Stdout destination.
+var stdout io.Writer = os.Stdout
+
 // NewRequest returns a new file transfer Request suitable for use with
 // Client.Do.
+//
+// If dst is "-", the downloaded content is written to standard output as it is
+// transferred, as if the request were sent via Client.Pipe. NoStore is set, so
+// no file is resumed, created or named from the server response.
 func NewRequest(dst, urlStr string) (*Request, error) {
 	if dst == "" {
 		dst = "."
@@ -118,10 +576,15 @@ func NewRequest(dst, urlStr string) (*Request, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Request{
+	r := &Request{
 		HTTPRequest: req,
 		Filename:    dst,
-	}, nil
+	}
+	if dst == Stdout {
+		r.pipe = stdout
+		r.NoStore = true
+	}
+	return r, nil
 }
 
 // Context returns the request's context. To change the context, use
@@ -152,11 +615,56 @@ func (r *Request) WithContext(ctx context.Context) *Request {
 	return r2
 }
 
+// Clone returns a copy of r that may be sent by a Client independently of r,
+// such that a Request can be used as a template for multiple transfers. The
+// HTTPRequest, including its URL and headers, is deep copied so that changes
+// made by grab during a transfer, such as setting a Range header, do not affect
+// r or any other clones.
+//
+// A hash.Hash cannot be shared by multiple transfers, so the checksum set via
+// SetChecksum is copied, but will be computed with the given hash h, which
+// should be a new instance of the same algorithm. If h is nil or r has no
+// checksum set, checksum validation is disabled for the clone. The given hash
+// must not be used by any other request or goroutines. A checksum set via
+// SetChecksumFactory is copied with its factory, regardless of h.
+//
+// Likewise, a checksum computed via ComputeChecksum is computed with h, unless
+// r uses a different hash for checksum validation, in which case it is
+// disabled for the clone.
+func (r *Request) Clone(h hash.Hash) *Request {
+	r2 := new(Request)
+	*r2 = *r
+	r2.HTTPRequest = r.HTTPRequest.Clone(r.HTTPRequest.Context())
+	r2.SetChecksum(nil, nil, false)
+	r2.ComputeChecksum(nil)
+	if r.hashFactory != nil {
+		r2.SetChecksumFactory(r.hashFactory, append([]byte(nil), r.checksum...), r.deleteOnError)
+	} else if h != nil && r.hash != nil {
+		r2.SetChecksum(h, append([]byte(nil), r.checksum...), r.deleteOnError)
+	}
+	if h != nil && r.computeHash != nil && (r.hash == nil || r.hash == r.computeHash) {
+		r2.ComputeChecksum(h)
+	}
+	return r2
+}
+
 // URL returns the URL to be downloaded.
 func (r *Request) URL() *url.URL {
 	return r.HTTPRequest.URL
 }
 
+// DependsOn specifies that r must not be started by Client.DoBatch until the
+// other Request has completed successfully. If other fails, r is not sent and
+// its Response fails with an error that matches ErrDependencyFailed. A Request
+// may depend on many others, and dependencies on Requests that are not in the
+// same batch are ignored. Requests that depend on each other in a cycle fail
+// with ErrBadRequest.
+//
+// Dependencies are only respected by Client.DoBatch.
+func (r *Request) DependsOn(other *Request) {
+	r.dependsOn = append(r.dependsOn, other)
+}
+
 // SetChecksum sets the desired hashing algorithm and checksum value to validate
 // a downloaded file. Once the download is complete, the given hashing algorithm
 // will be used to compute the actual checksum of the downloaded file. If the
@@ -166,12 +674,199 @@ func (r *Request) URL() *url.URL {
 // If deleteOnError is true, the downloaded file will be deleted automatically
 // if it fails checksum validation.
 //
+// The checksum is computed as the file is transferred, including any bytes
+// resumed from an existing file, so the downloaded file is not read again. The
+// file is only read to compute the checksum if it was already complete, or if
+// a different hash was given to ComputeChecksum.
+//
 // To prevent corruption of the computed checksum, the given hash must not be
-// used by any other request or goroutines.
+// used by any other request or goroutines. To set the same checksum on many
+// requests, use SetChecksumFactory.
 //
 // To disable checksum validation, call SetChecksum with a nil hash.
 func (r *Request) SetChecksum(h hash.Hash, sum []byte, deleteOnError bool) {
 	r.hash = h
 	r.checksum = sum
 	r.deleteOnError = deleteOnError
+	r.hashFactory = nil
+	r.trailerChecksum = ""
+}
+
+// SetChecksumFactory sets the desired hashing algorithm and checksum value to
+// validate a downloaded file, as SetChecksum does, except that a new hash is
+// created by calling f each time the request is sent. This allows the same
+// expected checksum to be set on many requests, such as in a batch, or a
+// request to be sent more than once, without any hash being shared between
+// transfers. For example:
+//
+//	req.SetChecksumFactory(sha256.New, sum, false)
+//
+// To disable checksum validation, call SetChecksum with a nil hash.
+func (r *Request) SetChecksumFactory(f func() hash.Hash, sum []byte, deleteOnError bool) {
+	if f == nil {
+		r.SetChecksum(nil, nil, false)
+		return
+	}
+	r.SetChecksum(f(), sum, deleteOnError)
+	r.hashFactory = f
+}
+
+// SetTrailerChecksum sets the desired hashing algorithm to validate a
+// downloaded file against a checksum sent by the remote server in the HTTP
+// trailer with the given name, such as "X-Checksum-Sha256". The trailer value
+// may be hex or base64 encoded and must be the checksum of the entire file.
+//
+// As the expected checksum is only received once the response body has been
+// read, the checksum is computed as the file is transferred. If the server
+// does not send the trailer, or sends a malformed value, the download fails
+// with ErrBadChecksum. If the file was already complete and nothing was
+// transferred, no trailer is received and validation is skipped.
+//
+// If deleteOnError is true, the downloaded file will be deleted automatically
+// if it fails checksum validation.
+//
+// To disable checksum validation, call SetChecksum with a nil hash.
+func (r *Request) SetTrailerChecksum(name string, h hash.Hash, deleteOnError bool) {
+	r.SetChecksum(h, nil, deleteOnError)
+	if h != nil {
+		r.trailerChecksum = name
+	}
+}
+
+// SetChecksumSRI sets the desired hashing algorithm and checksum value to
+// validate a downloaded file from Subresource Integrity metadata, such as the
+// value of the integrity attribute of an HTML script element, for example
+// "sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC".
+// If multiple values are given, separated by spaces, the strongest supported
+// algorithm of sha256, sha384 and sha512 is used.
+//
+// An error is returned if the metadata is malformed or if no supported
+// algorithm is found, in which case the request is not modified. Otherwise,
+// SetChecksumSRI behaves as SetChecksum.
+func (r *Request) SetChecksumSRI(integrity string, deleteOnError bool) error {
+	h, sum, err := parseSRI(integrity)
+	if err != nil {
+		return err
+	}
+	r.SetChecksum(h, sum, deleteOnError)
+	return nil
+}
+
+// SetChecksumMultihash sets the desired hashing algorithm and checksum value
+// to validate a downloaded file from a hex or base58btc encoded multihash, as
+// used by content-addressed systems such as IPFS. A version 1 CID of raw
+// content, in base32 or base58btc, is also accepted. Supported hash functions
+// are sha1, sha2-256, sha2-384, sha2-512 and md5.
+//
+// The multihash must be the digest of the file content itself. Other CIDs,
+// including version 0 CIDs, address the encoded DAG of a file rather than its
+// content, and cannot be used to validate a download.
+//
+// An error is returned if the multihash is malformed or uses an unsupported
+// hash function, in which case the request is not modified. Otherwise,
+// SetChecksumMultihash behaves as SetChecksum.
+func (r *Request) SetChecksumMultihash(mh string, deleteOnError bool) error {
+	h, sum, err := parseMultihash(mh)
+	if err != nil {
+		return err
+	}
+	r.SetChecksum(h, sum, deleteOnError)
+	return nil
+}
+
+// ComputeChecksum sets a hashing algorithm used to compute the checksum of a
+// downloaded file, without validating it against an expected value. The
+// checksum is computed as the file is transferred, rather than by reading the
+// file again once the transfer is complete, and is returned by the associated
+// Response.Checksum method.
+//
+// If the same hash is also given to SetChecksum, the computed checksum is used
+// for validation and the downloaded file is not read again.
+//
+// To prevent corruption of the computed checksum, the given hash must not be
+// used by any other request or goroutines.
+//
+// To disable checksum computation, call ComputeChecksum with a nil hash.
+func (r *Request) ComputeChecksum(h hash.Hash) {
+	r.computeHash = h
+}
+
+// SetArchive specifies that the downloaded file should be added as an entry
+// with the given name to the archive w, rather than stored at Filename. If name
+// is empty, the name is resolved from the server response, as it would be for a
+// download to a directory.
+//
+// SetArchive implies NoStore, as the content is kept in memory until it has
+// passed any checksum validation or verification, and only then is written to
+// the archive, so that failed downloads never leave a partial entry. Entries are
+// written one at a time, even by concurrent transfers such as in a batch.
+//
+// To write the downloaded file to Filename instead, call SetArchive with a nil
+// ArchiveWriter.
+func (r *Request) SetArchive(w ArchiveWriter, name string) {
+	r.archive = w
+	r.archiveName = name
+}
+
+// SetVerifier sets a Verifier to validate a downloaded file, such as by
+// checking a detached signature published alongside it. Once the download is
+// complete and has passed any checksum validation set via SetChecksum, the
+// file is passed to the Verifier. If verification fails, the error will be
+// returned by the associated Response.Err method.
+//
+// If deleteOnError is true, the downloaded file will be deleted automatically
+// if it fails verification.
+//
+// To disable verification, call SetVerifier with a nil Verifier.
+func (r *Request) SetVerifier(v Verifier, deleteOnError bool) {
+	r.verifier = v
+	r.deleteOnVerifyError = deleteOnError
+}
+
+// contextKey is a value for use with context.WithValue. It's used as a pointer
+// so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "grab context value " + k.name }
+
+var (
+	// LabelContextKey is a context key. It can be used by a HTTPClient, such
+	// as an instrumented http.RoundTripper, with Context.Value to access the
+	// Label of the Request that an http.Request was sent for. The associated
+	// value will be of type string.
+	LabelContextKey = &contextKey{"label"}
+
+	// TagContextKey is a context key. It can be used by a HTTPClient with
+	// Context.Value to access the Tag of the Request that an http.Request was
+	// sent for. The associated value will be of type interface{}.
+	TagContextKey = &contextKey{"tag"}
+)
+
+// withRequestValues returns a copy of ctx carrying the Label and Tag of req,
+// if set.
+func withRequestValues(ctx context.Context, req *Request) context.Context {
+	if req.Label != "" {
+		ctx = context.WithValue(ctx, LabelContextKey, req.Label)
+	}
+	if req.Tag != nil {
+		ctx = context.WithValue(ctx, TagContextKey, req.Tag)
+	}
+	return ctx
+}
+
+// LabelFromContext returns the Label of the Request that an http.Request was
+// sent for, given the context of the http.Request. It returns an empty string
+// if ctx carries no Label.
+func LabelFromContext(ctx context.Context) string {
+	label, _ := ctx.Value(LabelContextKey).(string)
+	return label
+}
+
+// TagFromContext returns the Tag of the Request that an http.Request was sent
+// for, given the context of the http.Request. It returns nil if ctx carries no
+// Tag.
+func TagFromContext(ctx context.Context) interface{} {
+	return ctx.Value(TagContextKey)
 }
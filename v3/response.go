@@ -1,16 +1,54 @@
 package grab
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// A Phase describes the stage of a file transfer that a Response has reached.
+type Phase int32
+
+const (
+	// PhaseTransfer indicates that the file is being requested from the remote
+	// server or transferred to its destination.
+	PhaseTransfer Phase = iota
+
+	// PhaseChecksum indicates that the destination file is being read to
+	// validate its checksum. Once the transfer has finished, this is only
+	// required if the checksum could not be computed as the file was written,
+	// such as when Request.ComputeChecksum is given a different hash than
+	// Request.SetChecksum. Otherwise, the Response moves from PhaseTransfer
+	// directly to PhaseDone. An existing file is also read in PhaseChecksum
+	// before the transfer starts if Request.SkipIfChecksumMatches is set.
+	PhaseChecksum
+
+	// PhaseDone indicates that the Response is complete, successfully or
+	// otherwise.
+	PhaseDone
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseTransfer:
+		return "transfer"
+	case PhaseChecksum:
+		return "checksum"
+	case PhaseDone:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int32(p))
+}
+
 // Response represents the response to a completed or in-progress download
 // request.
 //
@@ -51,6 +89,11 @@ type Response struct {
 	// transfer.
 	DidResume bool
 
+	// NotModified specifies that the downloaded file was identical to the
+	// existing file at the destination path, which was left unmodified, if
+	// Request.OnFilenameCollision is CollisionOverwriteIfDifferent.
+	NotModified bool
+
 	// Done is closed once the transfer is finalized, either successfully or with
 	// errors. Errors are available via Response.Err
 	Done chan struct{}
@@ -70,6 +113,37 @@ type Response struct {
 	// capabilities of the remote server are known.
 	optionsKnown bool
 
+	// replaceFilename is the path of an existing file to be replaced by the
+	// temporary file at Filename once the transfer is complete, if
+	// Request.OnFilenameCollision is CollisionOverwriteIfDifferent.
+	replaceFilename string
+
+	// checksumRetries is the number of times the transfer was restarted after
+	// failing checksum validation.
+	checksumRetries int
+
+	// checkedLocal indicates that the checksum of an existing local file has
+	// already been compared to the expected checksum.
+	checkedLocal bool
+
+	// httpRequest is the last GET request sent to the remote server.
+	httpRequest *http.Request
+
+	// attempts is the number of HTTP requests sent for the transfer.
+	attempts int
+
+	// filenameTransformed indicates that Request.FilenameTransform has been
+	// applied to Filename.
+	filenameTransformed bool
+
+	// rangeProbed indicates that HTTPResponse is the response to a request for
+	// the first byte of the file, sent in place of a HEAD request.
+	rangeProbed bool
+
+	// didReSign indicates that Request.ReSign has already been called to renew
+	// an expired URL.
+	didReSign bool
+
 	// writer is the file handle used to write the downloaded file to local
 	// storage
 	writer io.Writer
@@ -78,22 +152,148 @@ type Response struct {
 	// enabled.
 	storeBuffer bytes.Buffer
 
+	// stream receives the contents of the transfer if Request.StreamBufferSize
+	// is set.
+	stream *streamBuffer
+
+	// tee receives a copy of the contents of the transfer if the transfer was
+	// started via Client.DoStream.
+	tee *streamBuffer
+
+	// extracted lists the files extracted to Request.ExtractDir.
+	extracted []string
+
+	// errorBody is the start of the body of a response with a bad status code,
+	// if Request.ErrorBodySize is set.
+	errorBody []byte
+
+	// reconnectBody is the body of the last response received to replace a
+	// connection after the transfer was paused.
+	reconnectBody io.ReadCloser
+
 	// bytesCompleted specifies the number of bytes which were already
-	// transferred before this transfer began.
+	// transferred before this transfer began. It must be written atomically
+	// once the transfer has started.
 	bytesResumed int64
 
 	// transfer is responsible for copying data from the remote server to a local
 	// file, tracking progress and allowing for cancelation.
 	transfer *transfer
 
+	// phase is the Phase of the Response before it is completed. It must be
+	// accessed atomically.
+	phase int32
+
+	// checksumTransfer is responsible for reading the destination file into the
+	// checksum hash. It must not be read before phase is PhaseChecksum.
+	checksumTransfer *transfer
+
+	// checksum is the checksum computed with the hash set via
+	// Request.ComputeChecksum.
+	checksum []byte
+
 	// bufferSize specifies the size in bytes of the transfer buffer.
 	bufferSize int
 
+	// writeBuffer buffers writes to the destination if Request.WriteBufferSize
+	// is set.
+	writeBuffer *bufio.Writer
+
+	// wrapWriter is the writer returned by Request.WrapWriter, until it is
+	// closed.
+	wrapWriter io.WriteCloser
+
+	// timings records the latency of requests sent for the transfer.
+	timingsMu sync.Mutex
+	timings   Timings
+
+	// buffer is the transfer buffer obtained from the Client's buffer pool. It
+	// is returned to the pool when the Response is closed.
+	buffer *[]byte
+
 	// Error contains any error that may have occurred during the file transfer.
 	// This should not be read until IsComplete returns true.
 	err error
 }
 
+// HTTPRequest returns the last http.Request that was sent to the remote server
+// to transfer the file content, after following any redirects. It includes the
+// final URL, method and any headers set by grab, such as User-Agent and Range.
+//
+// HEAD requests sent to determine the capabilities of the remote server are not
+// returned. If no GET request was sent, such as when an existing file was
+// already complete, HTTPRequest returns nil.
+func (c *Response) HTTPRequest() *http.Request {
+	return c.httpRequest
+}
+
+// ResumeRange returns the byte range that was negotiated with the remote server
+// by the Range header of the last request returned by HTTPRequest, such as to
+// resume a partial download, and the Content-Range header of its response.
+// start and end are the offsets of the first and last byte sent by the server
+// and total is the size of the remote file, or -1 if the server did not give
+// it. If the server rejected the range with 416 Range Not Satisfiable because
+// the local file was already complete, start is the requested offset and end
+// is start-1, as no bytes were sent.
+//
+// ok is false if no range was requested, or the server ignored the Range
+// header and sent the entire file.
+func (c *Response) ResumeRange() (start, end, total int64, ok bool) {
+	req, hresp := c.httpRequest, c.HTTPResponse
+	if req == nil || hresp == nil || req.Header.Get("Range") == "" {
+		return 0, 0, 0, false
+	}
+	cr := hresp.Header.Get("Content-Range")
+	switch hresp.StatusCode {
+	case http.StatusPartialContent:
+		return parseContentRange(cr)
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		if _, err := fmt.Sscanf(cr, "bytes */%d", &total); err != nil {
+			return 0, 0, 0, false
+		}
+		if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+			return 0, 0, 0, false
+		}
+		return start, start - 1, total, true
+	}
+	return 0, 0, 0, false
+}
+
+// Timings returns the latency of the HTTP requests sent for the transfer so
+// far. DNS, Connect and TLSHandshake are zero if no new connection was needed,
+// such as when a connection was reused from an earlier request.
+func (c *Response) Timings() Timings {
+	c.timingsMu.Lock()
+	defer c.timingsMu.Unlock()
+	return c.timings
+}
+
+// TTFB returns the time to first byte of the transfer, between Start and the
+// time at which the first byte of the response body was read. Unlike
+// Timings().TTFB, which measures the latency of the remote server to respond
+// with headers, TTFB includes all requests and any delay before the body was
+// read, such as a BeforeCopy hook. TTFB returns zero if no bytes have been read,
+// such as when the file was already complete.
+func (c *Response) TTFB() time.Duration {
+	t := c.transfer.FirstByte()
+	if t.IsZero() {
+		return 0
+	}
+	return t.Sub(c.Start)
+}
+
+// ErrorBody returns up to Request.ErrorBodySize bytes of the body of the
+// response from the remote server if the transfer failed with a
+// StatusCodeError. It returns nil if the transfer has not failed, or if
+// Request.ErrorBodySize is not set.
+func (c *Response) ErrorBody() []byte {
+	if !c.IsComplete() {
+		return nil
+	}
+	return c.errorBody
+}
+
 // IsComplete returns true if the download has completed. If an error occurred
 // during the download, it can be returned via Err.
 func (c *Response) IsComplete() bool {
@@ -105,6 +305,40 @@ func (c *Response) IsComplete() bool {
 	}
 }
 
+// Pause suspends an in-progress file transfer until Resume is called. The
+// connection to the remote server is kept open while paused, so that the
+// transfer can continue where it left off. If the transfer is paused for more
+// than 30 seconds, or the remote server drops the idle connection, grab
+// reconnects on resume using a range request from the current offset. This
+// fails if the remote server does not support range requests.
+//
+// ErrNotInProgress is returned if the file transfer has already finished.
+func (c *Response) Pause() error {
+	if c.IsComplete() || c.transfer == nil || c.Phase() != PhaseTransfer {
+		return ErrNotInProgress
+	}
+	c.transfer.pause()
+	return nil
+}
+
+// Resume continues a file transfer that was suspended by Pause. Resume has no
+// effect if the file transfer is not paused.
+//
+// ErrNotInProgress is returned if the file transfer has already finished.
+func (c *Response) Resume() error {
+	if c.IsComplete() || c.transfer == nil {
+		return ErrNotInProgress
+	}
+	c.transfer.resume()
+	return nil
+}
+
+// IsPaused returns true if the file transfer was suspended by Pause and has
+// not yet been resumed.
+func (c *Response) IsPaused() bool {
+	return !c.IsComplete() && c.transfer.isPaused()
+}
+
 // Cancel cancels the file transfer by canceling the underlying Context for
 // this Response. Cancel blocks until the transfer is closed and returns any
 // error - typically context.Canceled.
@@ -137,7 +371,7 @@ func (c *Response) Size() int64 {
 // the destination, including any bytes that were resumed from a previous
 // download.
 func (c *Response) BytesComplete() int64 {
-	return c.bytesResumed + c.transfer.N()
+	return atomic.LoadInt64(&c.bytesResumed) + c.transfer.N()
 }
 
 // BytesPerSecond returns the number of bytes per second transferred using a
@@ -150,10 +384,52 @@ func (c *Response) BytesPerSecond() float64 {
 	return c.transfer.BPS()
 }
 
+// Phase returns the current stage of the file transfer.
+func (c *Response) Phase() Phase {
+	if c.IsComplete() {
+		return PhaseDone
+	}
+	return Phase(atomic.LoadInt32(&c.phase))
+}
+
+// ChecksumProgress returns the ratio of bytes in the destination file that
+// have been read to validate its checksum in PhaseChecksum. It returns zero
+// if the Response has not reached PhaseChecksum, which is the case for most
+// transfers with checksum validation, as the checksum is computed as the file
+// is written.
+func (c *Response) ChecksumProgress() float64 {
+	if atomic.LoadInt32(&c.phase) < int32(PhaseChecksum) {
+		return 0
+	}
+	size := c.Size()
+	if size <= 0 {
+		return 0
+	}
+	return float64(c.checksumTransfer.N()) / float64(size)
+}
+
+// Checksum blocks the calling goroutine until the underlying file transfer is
+// completed and then returns the checksum of the downloaded file, computed
+// using the hash given to Request.ComputeChecksum. If checksum computation was
+// not enabled or the transfer failed, nil is returned.
+func (c *Response) Checksum() []byte {
+	if err := c.Err(); err != nil {
+		return nil
+	}
+	return c.checksum
+}
+
 // Progress returns the ratio of total bytes that have been downloaded. Multiply
-// the returned value by 100 to return the percentage completed.
+// the returned value by 100 to return the percentage completed. The progress
+// of an empty file is 1 once the transfer has completed successfully.
 func (c *Response) Progress() float64 {
 	size := c.Size()
+	if size == 0 && c.IsComplete() {
+		if c.Err() != nil {
+			return 0
+		}
+		return 1
+	}
 	if size <= 0 {
 		return 0
 	}
@@ -175,17 +451,120 @@ func (c *Response) Duration() time.Duration {
 // ETA returns the estimated time at which the the download will complete, given
 // the current BytesPerSecond. If the transfer has already completed, the actual
 // end time will be returned.
+//
+// If Request.RateLimiter reports its limit, the limit caps the current
+// BytesPerSecond and is used as the expected rate until a rate has been
+// measured. See RateLimiter.
 func (c *Response) ETA() time.Time {
 	if c.IsComplete() {
 		return c.End
 	}
 	bt := c.BytesComplete()
-	bps := c.transfer.BPS()
+	bps := expectedRate(c.Request.RateLimiter, c.transfer.BPS())
 	if bps == 0 {
 		return time.Time{}
 	}
 	secs := float64(c.Size()-bt) / bps
-	return time.Now().Add(time.Duration(secs) * time.Second)
+	return time.Now().Add(time.Duration(secs * float64(time.Second)))
+}
+
+// A ResponseSnapshot describes the progress of a file transfer at a single
+// instant. See Response.Snapshot.
+type ResponseSnapshot struct {
+	// Time is the time at which the snapshot was taken.
+	Time time.Time
+
+	// Phase is the stage of the file transfer.
+	Phase Phase
+
+	// Err is the error returned by Response.Err, if the transfer is complete.
+	Err error
+
+	// Size is the size of the file transfer, or -1 if unknown.
+	Size int64
+
+	// BytesComplete is the number of bytes copied to the destination,
+	// including any bytes resumed from a previous download.
+	BytesComplete int64
+
+	// BytesPerSecond is the current transfer rate, or the average transfer
+	// rate if the transfer is complete.
+	BytesPerSecond float64
+
+	// Progress is the ratio of BytesComplete to Size, or zero if Size is not
+	// known. The progress of an empty file is 1 once the transfer has
+	// completed successfully.
+	Progress float64
+
+	// ChecksumProgress is the ratio of the destination file that has been read
+	// to validate its checksum, as returned by Response.ChecksumProgress.
+	ChecksumProgress float64
+
+	// Duration is the duration of the file transfer so far, or of the entire
+	// transfer if it is complete.
+	Duration time.Duration
+
+	// ETA is the estimated time at which the transfer will complete, or the
+	// time at which it completed. It is the zero time if unknown.
+	ETA time.Time
+}
+
+// Snapshot returns the progress of the file transfer at the current instant.
+// Unlike calling the individual accessors such as BytesComplete, Size and ETA
+// in turn, all values of a snapshot are read together and describe the same
+// Phase: if the transfer moves to another phase while the snapshot is taken,
+// such as when it completes, the snapshot is taken again. A completed transfer
+// is therefore never reported with the byte count, rate or ETA of a transfer
+// in progress. Within a phase, the values are read approximately
+// simultaneously without stopping the transfer, so BytesComplete may advance
+// slightly between the reading of Size, BytesComplete and BytesPerSecond.
+// Snapshot is preferred for displaying progress, while the individual
+// accessors remain for convenience.
+func (c *Response) Snapshot() ResponseSnapshot {
+	for {
+		s := c.snapshot()
+		if c.Phase() == s.Phase {
+			return s
+		}
+	}
+}
+
+// snapshot reads the progress of the file transfer, which may change phase
+// while it is read.
+func (c *Response) snapshot() ResponseSnapshot {
+	s := ResponseSnapshot{
+		Time:  time.Now(),
+		Phase: c.Phase(),
+		Size:  c.Size(),
+	}
+	n := c.transfer.N()
+	s.BytesComplete = atomic.LoadInt64(&c.bytesResumed) + n
+	if s.Phase == PhaseDone {
+		s.Err = c.err
+		s.Duration = c.End.Sub(c.Start)
+		s.ETA = c.End
+		if secs := s.Duration.Seconds(); secs > 0 {
+			s.BytesPerSecond = float64(n) / secs
+		}
+	} else {
+		s.Duration = s.Time.Sub(c.Start)
+		s.BytesPerSecond = c.transfer.BPS()
+		if bps := expectedRate(c.Request.RateLimiter, s.BytesPerSecond); bps > 0 && s.Size >= 0 {
+			secs := float64(s.Size-s.BytesComplete) / bps
+			s.ETA = s.Time.Add(time.Duration(secs * float64(time.Second)))
+		}
+	}
+	if s.Size == 0 && s.Phase == PhaseDone {
+		if s.Err == nil {
+			s.Progress = 1
+		}
+	} else if s.Size > 0 {
+		s.Progress = float64(s.BytesComplete) / float64(s.Size)
+		if atomic.LoadInt32(&c.phase) >= int32(PhaseChecksum) {
+			s.ChecksumProgress = float64(c.checksumTransfer.N()) / float64(s.Size)
+		}
+	}
+	return s
 }
 
 // Open blocks the calling goroutine until the underlying file transfer is
@@ -209,6 +588,30 @@ func (c *Response) openUnsafe() (io.ReadCloser, error) {
 	return os.Open(c.Filename)
 }
 
+// ExtractedFiles blocks the calling goroutine until the underlying file
+// transfer is completed and then returns the paths of all files extracted from
+// the downloaded archive into Request.ExtractDir. If extraction failed, the
+// files extracted before the failure are returned, and the error is returned
+// by Response.Err.
+func (c *Response) ExtractedFiles() []string {
+	<-c.Done
+	return c.extracted
+}
+
+// Stream returns a Reader for the contents of the transfer as it is
+// downloaded, if Request.StreamBufferSize was set. Otherwise, it returns nil.
+//
+// Reads block until more of the file is transferred. Once the transfer is
+// complete, Read returns io.EOF, or the error returned by Response.Err if the
+// transfer failed. The caller must read the stream to completion or cancel the
+// transfer, as the transfer cannot complete while the buffer is full.
+func (c *Response) Stream() io.Reader {
+	if c.stream == nil {
+		return nil
+	}
+	return c.stream
+}
+
 // Bytes blocks the calling goroutine until the underlying file transfer is
 // completed and then reads all bytes from the completed tranafer. If
 // Request.NoStore was enabled, the bytes will be read from memory.
@@ -229,6 +632,103 @@ func (c *Response) Bytes() ([]byte, error) {
 	return ioutil.ReadAll(f)
 }
 
+// AggregateProgress returns the combined progress of the given Responses, such
+// as those returned by Client.DoBatch. It is safe to call while the transfers
+// are in progress.
+//
+// bytesComplete and totalSize are the sums of Response.BytesComplete and
+// Response.Size. If the size of a transfer is not yet known, the bytes
+// transferred so far are counted towards totalSize instead. Responses that
+// completed with an error are excluded entirely so that the ratio of
+// bytesComplete to totalSize only reflects transfers that may still succeed.
+//
+// bps is the sum of the current transfer rate of all incomplete transfers.
+func AggregateProgress(resps []*Response) (bytesComplete, totalSize int64, bps float64) {
+	for _, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		if resp.IsComplete() {
+			if resp.Err() != nil {
+				continue
+			}
+		} else {
+			bps += resp.BytesPerSecond()
+		}
+		n := resp.BytesComplete()
+		bytesComplete += n
+		if size := resp.Size(); size >= 0 {
+			totalSize += size
+		} else {
+			totalSize += n
+		}
+	}
+	return
+}
+
+// WaitAny blocks the calling goroutine until any of the given Responses has
+// completed, successfully or otherwise, and returns that Response and its index
+// in resps. If multiple Responses are already complete, the one with the
+// lowest index is returned. Nil Responses are ignored. If no Responses are
+// given, WaitAny returns nil and -1 immediately.
+//
+// WaitAny does not cancel the remaining Responses. The caller is responsible
+// for cancelling them via Response.Cancel if their transfers are no longer
+// required, such as when racing multiple mirrors of the same file.
+func WaitAny(resps ...*Response) (*Response, int) {
+	// prefer Responses that are already complete
+	n := 0
+	for i, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		if resp.IsComplete() {
+			return resp, i
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, -1
+	}
+
+	done := make(chan int, n)
+	stop := make(chan struct{})
+	defer close(stop)
+	for i, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		go func(i int, resp *Response) {
+			select {
+			case <-resp.Done:
+				done <- i
+			case <-stop:
+			}
+		}(i, resp)
+	}
+	i := <-done
+	return resps[i], i
+}
+
+// streamed returns true if the downloaded content is consumed as it is
+// transferred and cannot be read again, as with Request.StreamBufferSize or
+// Client.Pipe.
+func (c *Response) streamed() bool {
+	return c.stream != nil || c.Request.pipe != nil
+}
+
+// collisionPolicy returns the policy applied to an existing file at the
+// destination. Wrapped content cannot be resumed, and a transfer restarted
+// after failing checksum validation replaces the content of its previous
+// attempt, so both overwrite the file rather than resume it.
+func (c *Response) collisionPolicy() CollisionPolicy {
+	p := c.Request.OnFilenameCollision
+	if c.checksumRetries > 0 || p == CollisionResume && c.Request.WrapWriter != nil {
+		return CollisionOverwrite
+	}
+	return p
+}
+
 func (c *Response) requestMethod() string {
 	if c == nil || c.HTTPResponse == nil || c.HTTPResponse.Request == nil {
 		return ""
@@ -236,21 +736,28 @@ func (c *Response) requestMethod() string {
 	return c.HTTPResponse.Request.Method
 }
 
-func (c *Response) checksumUnsafe() ([]byte, error) {
+func (c *Response) checksumUnsafe(h hash.Hash) ([]byte, error) {
 	f, err := c.openUnsafe()
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	t := newTransfer(c.Request.Context(), nil, c.Request.hash, f, nil)
+	h.Reset()
+	t := newTransfer(c.Request.Context(), nil, h, f, nil)
+	c.checksumTransfer = t
+	atomic.StoreInt32(&c.phase, int32(PhaseChecksum))
 	if _, err = t.copy(); err != nil {
 		return nil, err
 	}
-	sum := c.Request.hash.Sum(nil)
+	sum := h.Sum(nil)
 	return sum, nil
 }
 
 func (c *Response) closeResponseBody() error {
+	if c.reconnectBody != nil {
+		c.reconnectBody.Close()
+		c.reconnectBody = nil
+	}
 	if c.HTTPResponse == nil || c.HTTPResponse.Body == nil {
 		return nil
 	}
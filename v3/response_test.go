@@ -2,7 +2,13 @@ package grab
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"hash"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -116,3 +122,310 @@ func TestResponseBytes(t *testing.T) {
 		)
 	})
 }
+
+func TestAggregateProgress(t *testing.T) {
+	size := 4096
+	grabtest.WithTestServer(t, func(url string) {
+		good := mustDo(mustNewRequest("", url+"/.testAggregateProgress"))
+		defer os.Remove(good.Filename)
+
+		bad := mustNewRequest("", url+"/.testAggregateProgressBad")
+		bad.Size = int64(size * 2)
+		badResp := DefaultClient.Do(bad)
+		if err := badResp.Err(); err != ErrBadLength {
+			t.Fatalf("expected error: %v, got: %v", ErrBadLength, err)
+		}
+
+		bytesComplete, totalSize, bps := AggregateProgress([]*Response{good, badResp, nil})
+		if bytesComplete != int64(size) {
+			t.Errorf("expected bytes complete: %d, got: %d", size, bytesComplete)
+		}
+		if totalSize != int64(size) {
+			t.Errorf("expected total size: %d, got: %d", size, totalSize)
+		}
+		if bps != 0 {
+			t.Errorf("expected bytes per second: 0, got: %v", bps)
+		}
+	},
+		grabtest.ContentLength(size),
+	)
+}
+
+// phaseHash is a hash.Hash that calls f before each write.
+type phaseHash struct {
+	hash.Hash
+	f func()
+}
+
+func (c *phaseHash) Write(p []byte) (int, error) {
+	c.f()
+	return c.Hash.Write(p)
+}
+
+// TestResponsePhase tests that the destination file is only read again in
+// PhaseChecksum if the checksum could not be computed as it was transferred.
+func TestResponsePhase(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Reread   bool
+		Expect   []Phase
+		Progress float64
+	}{
+		{"Inline", false, []Phase{PhaseTransfer, PhaseDone}, 0},
+		{"Reread", true, []Phase{PhaseTransfer, PhaseChecksum, PhaseDone}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			filename := ".testResponsePhase-" + test.Name
+			defer os.Remove(filename)
+			grabtest.WithTestServer(t, func(url string) {
+				var resp *Response
+				var phases []Phase
+				record := func(phase Phase) {
+					if len(phases) == 0 || phases[len(phases)-1] != phase {
+						phases = append(phases, phase)
+					}
+				}
+				h := &phaseHash{Hash: sha256.New(), f: func() {
+					phase := resp.Phase()
+					record(phase)
+					if phase != PhaseChecksum {
+						return
+					}
+					if p := resp.ChecksumProgress(); p < 0 || p >= 1 {
+						t.Errorf("expected checksum progress in [0, 1), got: %v", p)
+					}
+				}}
+				req := mustNewRequest(filename, url)
+				req.BufferSize = 4096
+				req.SetChecksum(h, grabtest.DefaultHandlerSHA256ChecksumBytes, false)
+				if test.Reread {
+					// computing a different hash during the transfer requires
+					// the file to be read again for validation
+					req.ComputeChecksum(sha256.New())
+				}
+				req.BeforeCopy = func(r *Response) error {
+					resp = r
+					record(r.Phase())
+					return nil
+				}
+				mustDo(req)
+				record(resp.Phase())
+				if !reflect.DeepEqual(phases, test.Expect) {
+					t.Errorf("expected phases: %v, got: %v", test.Expect, phases)
+				}
+				if p := resp.ChecksumProgress(); p != test.Progress {
+					t.Errorf("expected checksum progress: %v, got: %v", test.Progress, p)
+				}
+			})
+		})
+	}
+}
+
+func TestResponseHTTPRequest(t *testing.T) {
+	filename := ".testResponseHTTPRequest"
+	defer os.Remove(filename)
+
+	grabtest.WithTestServer(t, func(url string) {
+		// redirect to the test server
+		s := httptest.NewServer(http.RedirectHandler(url+"/redirected", http.StatusFound))
+		defer s.Close()
+
+		resp := mustDo(mustNewRequest(filename, s.URL+"/original"))
+		req := resp.HTTPRequest()
+		if req == nil {
+			t.Fatal("expected Response.HTTPRequest to be non-nil")
+		}
+		if req.Method != "GET" {
+			t.Errorf("expected method: GET, got: %s", req.Method)
+		}
+		if expect := url + "/redirected"; req.URL.String() != expect {
+			t.Errorf("expected URL: %s, got: %s", expect, req.URL)
+		}
+		if v := req.Header.Get("User-Agent"); v != DefaultClient.UserAgent {
+			t.Errorf("expected User-Agent: %s, got: %s", DefaultClient.UserAgent, v)
+		}
+
+		// no GET request is sent for a completed file
+		resp = mustDo(mustNewRequest(filename, s.URL+"/original"))
+		if req := resp.HTTPRequest(); req != nil {
+			t.Errorf("expected Response.HTTPRequest to be nil, got: %v %v", req.Method, req.URL)
+		}
+	})
+}
+
+// TestResponsePause tests that a transfer can be paused and resumed, both on the
+// same connection and by reconnecting after a long pause.
+func TestResponsePause(t *testing.T) {
+	size := 64 * 1024
+	expect := make([]byte, size)
+	for i := range expect {
+		expect[i] = byte(i)
+	}
+
+	tests := []struct {
+		Name       string
+		Threshold  time.Duration
+		ExpectGETs int32
+	}{
+		{"SameConnection", time.Minute, 1},
+		{"Reconnect", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			defer func(d time.Duration) { pauseReconnectThreshold = d }(pauseReconnectThreshold)
+			pauseReconnectThreshold = test.Threshold
+
+			var gets int32
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest("", url)
+				req.NoStore = true
+				req.BufferSize = 1024
+				resp := DefaultClient.Do(req)
+				for resp.BytesComplete() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				if err := resp.Pause(); err != nil {
+					t.Fatalf("error pausing transfer: %v", err)
+				}
+				if !resp.IsPaused() {
+					t.Errorf("expected Response.IsPaused to be true")
+				}
+
+				// allow any in-flight read to complete
+				time.Sleep(50 * time.Millisecond)
+				n := resp.BytesComplete()
+				time.Sleep(100 * time.Millisecond)
+				if resp.BytesComplete() != n {
+					t.Errorf("expected no progress while paused")
+				}
+				if n == int64(size) {
+					t.Fatalf("transfer completed before it was paused")
+				}
+
+				if err := resp.Resume(); err != nil {
+					t.Fatalf("error resuming transfer: %v", err)
+				}
+				if resp.IsPaused() {
+					t.Errorf("expected Response.IsPaused to be false")
+				}
+				b, err := resp.Bytes()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !bytes.Equal(b, expect) {
+					t.Errorf("downloaded content does not match")
+				}
+				if n := atomic.LoadInt32(&gets); n != test.ExpectGETs {
+					t.Errorf("expected %d GET requests, got %d", test.ExpectGETs, n)
+				}
+				if err := resp.Pause(); err != ErrNotInProgress {
+					t.Errorf("expected ErrNotInProgress pausing a complete transfer, got: %v", err)
+				}
+			},
+				grabtest.ContentLength(size),
+				grabtest.WithRateLimit(128*1024),
+				grabtest.StatusCode(func(r *http.Request) int {
+					if r.Method == "GET" {
+						atomic.AddInt32(&gets, 1)
+					}
+					return http.StatusOK
+				}),
+			)
+		})
+	}
+}
+
+func TestWaitAny(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// delay the body after the transfer has started
+		d, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		w.Header().Set("Content-Length", "7")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer s.Close()
+
+	delays := []string{"500ms", "50ms", "1s"}
+	resps := make([]*Response, len(delays))
+	for i, delay := range delays {
+		req := mustNewRequest("", s.URL+"/file?delay="+delay)
+		req.NoStore = true
+		resps[i] = DefaultClient.Do(req)
+	}
+	defer func() {
+		for _, resp := range resps {
+			resp.Cancel()
+		}
+	}()
+
+	resp, i := WaitAny(nil, resps[0], resps[1], resps[2])
+	if i != 2 || resp != resps[1] {
+		t.Fatalf("expected response 2 to complete first, got %d", i)
+	}
+	testComplete(t, resp)
+	for _, resp := range []*Response{resps[0], resps[2]} {
+		if resp.IsComplete() {
+			t.Errorf("expected %s to be incomplete", resp.Request.URL())
+		}
+	}
+
+	// returns complete responses immediately
+	if _, i := WaitAny(resps...); i != 1 {
+		t.Errorf("expected complete response 1, got %d", i)
+	}
+	if resp, i := WaitAny(); resp != nil || i != -1 {
+		t.Errorf("expected nil and -1 for no responses, got %v and %d", resp, i)
+	}
+}
+
+func TestResponseSnapshot(t *testing.T) {
+	filename := ".testResponseSnapshot"
+	defer os.Remove(filename)
+	size := 1024 * 64
+
+	grabtest.WithTestServer(t, func(url string) {
+		resp := DefaultClient.Do(mustNewRequest(filename, url))
+
+		// snapshots of a transfer in progress are consistent
+		for !resp.IsComplete() {
+			s := resp.Snapshot()
+			if s.Size != int64(size) {
+				t.Fatalf("expected size %d, got %d", size, s.Size)
+			}
+			if p := float64(s.BytesComplete) / float64(s.Size); s.Progress != p {
+				t.Fatalf("expected progress %v, got %v", p, s.Progress)
+			}
+			if s.Phase == PhaseDone && s.BytesComplete != s.Size {
+				t.Fatalf("expected completed transfer to have %d bytes, got %d", s.Size, s.BytesComplete)
+			}
+			if s.Phase == PhaseDone && !s.ETA.Equal(resp.End) {
+				t.Fatalf("expected ETA of completed transfer to be its end time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		s := resp.Snapshot()
+		if s.Phase != PhaseDone {
+			t.Errorf("expected phase %v, got %v", PhaseDone, s.Phase)
+		}
+		if s.Err != nil {
+			t.Errorf("unexpected error: %v", s.Err)
+		}
+		if s.BytesComplete != int64(size) || s.Progress != 1 {
+			t.Errorf("expected %d bytes and progress 1, got %d and %v", size, s.BytesComplete, s.Progress)
+		}
+		if !s.ETA.Equal(resp.End) || s.Duration != resp.Duration() {
+			t.Errorf("expected ETA and duration of completed transfer")
+		}
+	},
+		grabtest.RateLimiter(size*4),
+		grabtest.ContentLength(size),
+	)
+}
@@ -0,0 +1,87 @@
+package grab
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the size of the blocks of a file that are checked for
+// zeros by a sparseWriter. It matches the block size of most file systems.
+const sparseBlockSize = 4096
+
+// sparseWriter writes to a file, seeking past whole blocks of zero bytes
+// instead of writing them, so that the file remains sparse on file systems
+// that support it. The file must not be opened with os.O_APPEND and must not
+// contain any data beyond the initial offset, as skipped blocks are not
+// overwritten.
+type sparseWriter struct {
+	f    *os.File
+	off  int64 // offset of the next write
+	skip bool  // the last block was skipped
+}
+
+func newSparseWriter(f *os.File, offset int64) *sparseWriter {
+	return &sparseWriter{f: f, off: offset}
+}
+
+func (w *sparseWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// align blocks to the file offset
+		size := sparseBlockSize - int(w.off%sparseBlockSize)
+		if size > len(p) {
+			size = len(p)
+		}
+		b := p[:size]
+		if size == sparseBlockSize-int(w.off%sparseBlockSize) && isZero(b) {
+			w.skip = true
+		} else {
+			if w.skip {
+				if _, err = w.f.Seek(w.off, io.SeekStart); err != nil {
+					return n, err
+				}
+				w.skip = false
+			}
+			if _, err = w.f.Write(b); err != nil {
+				return n, err
+			}
+		}
+		w.off += int64(size)
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// extend extends the file to the offset of the next write, if the last blocks
+// were skipped.
+func (w *sparseWriter) extend() error {
+	if !w.skip {
+		return nil
+	}
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < w.off {
+		return w.f.Truncate(w.off)
+	}
+	return nil
+}
+
+func (w *sparseWriter) Truncate(size int64) error {
+	return w.f.Truncate(size)
+}
+
+func (w *sparseWriter) Close() error {
+	return w.f.Close()
+}
+
+// isZero returns true if all bytes of b are zero.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package grab
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// sparseContent returns test content with runs of zeros at the start, middle
+// and end, and data that is not aligned to sparseBlockSize.
+func sparseContent() []byte {
+	b := make([]byte, 16*sparseBlockSize+123)
+	for i := 3*sparseBlockSize + 7; i < 5*sparseBlockSize; i++ {
+		b[i] = byte(i)
+	}
+	b[9*sparseBlockSize] = 1
+	return b
+}
+
+func TestSparseWriter(t *testing.T) {
+	filename := ".testSparseWriter"
+	defer os.Remove(filename)
+	content := sparseContent()
+
+	// resume writing the second half of the content
+	offset := int64(len(content) / 2)
+	if err := ioutil.WriteFile(filename, content[:offset], 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	w := newSparseWriter(f, offset)
+	for p := content[offset:]; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.extend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("file content does not match")
+	}
+}
+
+func TestSparse(t *testing.T) {
+	filename := ".testSparse"
+	defer os.Remove(filename)
+	content := sparseContent()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	req := mustNewRequest(filename, s.URL+"/file")
+	req.Sparse = true
+	resp := mustDo(req)
+	testComplete(t, resp)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("file content does not match")
+	}
+}
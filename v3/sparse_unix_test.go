@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package grab
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestSparseAllocation tests that blocks of zeros are not allocated on disk.
+func TestSparseAllocation(t *testing.T) {
+	filename := ".testSparseAllocation"
+	defer os.Remove(filename)
+	size := 1 << 20
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(make([]byte, size))
+	}))
+	defer s.Close()
+
+	req := mustNewRequest(filename, s.URL+"/file")
+	req.Sparse = true
+	resp := mustDo(req)
+	testComplete(t, resp)
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(size) {
+		t.Fatalf("expected file size %d, got %d", size, fi.Size())
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Skip("allocated size is not available")
+	}
+	if allocated := int64(st.Blocks) * 512; allocated >= fi.Size() {
+		t.Errorf("expected allocated size to be less than %d bytes, got %d", fi.Size(), allocated)
+	}
+}
@@ -0,0 +1,139 @@
+package grab
+
+import (
+	"io"
+	"sync"
+)
+
+// streamBuffer is a bounded ring buffer that connects a file transfer to a
+// consumer reading via Response.Stream or the reader returned by
+// Client.DoStream. Writes block while the buffer is full and reads block while
+// it is empty, until the buffer is closed.
+type streamBuffer struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	r       int   // offset of unread data
+	n       int   // length of unread data
+	err     error // set once closed
+	discard bool  // set once closed by the consumer
+}
+
+func newStreamBuffer(size int) *streamBuffer {
+	b := &streamBuffer{buf: make([]byte, size)}
+	b.cond.L = &b.mu
+	return b
+}
+
+// Write copies p into the buffer, blocking until there is enough free space or
+// the buffer is closed.
+func (b *streamBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(p) > 0 {
+		for b.n == len(b.buf) && b.err == nil && !b.discard {
+			b.cond.Wait()
+		}
+		if b.discard {
+			return n + len(p), nil
+		}
+		if b.err != nil {
+			if b.err == io.EOF {
+				return n, io.ErrClosedPipe
+			}
+			return n, b.err
+		}
+		w := (b.r + b.n) % len(b.buf)
+		free := len(b.buf) - b.n
+		if w+free > len(b.buf) {
+			free = len(b.buf) - w
+		}
+		c := copy(b.buf[w:w+free], p)
+		b.n += c
+		n += c
+		p = p[c:]
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Read reads unread data from the buffer, blocking until data is available or
+// the buffer is closed. Once closed and drained, Read returns the error the
+// buffer was closed with.
+func (b *streamBuffer) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discard {
+		return 0, io.ErrClosedPipe
+	}
+	for b.n == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.n == 0 {
+		return 0, b.err
+	}
+	avail := b.n
+	if b.r+avail > len(b.buf) {
+		avail = len(b.buf) - b.r
+	}
+	n = copy(p, b.buf[b.r:b.r+avail])
+	b.r = (b.r + n) % len(b.buf)
+	b.n -= n
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// close unblocks all readers and writers. Readers will receive err once the
+// buffer is drained, or io.EOF if err is nil. Only the first call to close has
+// any effect.
+func (b *streamBuffer) close(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	b.err = err
+	b.cond.Broadcast()
+}
+
+// closeRead closes the buffer for reading. Any unread data and all subsequent
+// writes are discarded, so that the transfer may continue without a consumer.
+func (b *streamBuffer) closeRead() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.discard = true
+	b.n = 0
+	b.cond.Broadcast()
+}
+
+// streamReader is the reading side of a streamBuffer, as returned by
+// Client.DoStream.
+type streamReader struct {
+	b *streamBuffer
+}
+
+func (r streamReader) Read(p []byte) (n int, err error) {
+	return r.b.Read(p)
+}
+
+func (r streamReader) Close() error {
+	r.b.closeRead()
+	return nil
+}
+
+// pipeWriter writes to the destination given to Client.Pipe, wrapping any
+// error so that it matches ErrBadDestination.
+type pipeWriter struct {
+	w io.Writer
+}
+
+func (w pipeWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	if err != nil {
+		err = &badDestinationError{err}
+	}
+	return n, err
+}
@@ -0,0 +1,74 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package grab
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cavaliergopher/grab/v3/pkg/grabtest"
+)
+
+// TestSymlinkDestination tests that a transfer is not written through a
+// symbolic link at the destination path, unless Request.FollowSymlinks is set.
+func TestSymlinkDestination(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		Name   string
+		Follow bool
+		Dst    func(dir string) string // returns the destination path
+		Expect error
+	}{
+		{"Refused", false, func(dir string) string { return filepath.Join(dir, "link") }, ErrSymlinkDestination},
+		{"RefusedResolved", false, func(dir string) string { return dir }, ErrSymlinkDestination},
+		{"Followed", true, func(dir string) string { return filepath.Join(dir, "link") }, nil},
+		{"Directory", false, func(dir string) string { return filepath.Join(dir, "linkdir") + "/" }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "grab-symlink-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			target := filepath.Join(dir, "target")
+			if err := ioutil.WriteFile(target, secret, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(filepath.Join(dir, "sub"), filepath.Join(dir, "linkdir")); err != nil {
+				t.Fatal(err)
+			}
+
+			grabtest.WithTestServer(t, func(url string) {
+				req := mustNewRequest(test.Dst(dir), url+"/link")
+				req.FollowSymlinks = test.Follow
+				resp := DefaultClient.Do(req)
+				if err := resp.Err(); err != test.Expect {
+					t.Fatalf("expected error %v, got %v", test.Expect, err)
+				}
+				b, err := ioutil.ReadFile(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if written := string(b) != string(secret); written != test.Follow {
+					t.Errorf("expected link target to be written: %v", test.Follow)
+				}
+				if test.Name == "Directory" {
+					testComplete(t, resp)
+					if _, err := os.Stat(filepath.Join(dir, "sub", "link")); err != nil {
+						t.Errorf("expected download in linked directory: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
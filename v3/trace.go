@@ -0,0 +1,70 @@
+package grab
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// Timings describes the latency of the HTTP requests sent for a transfer, as
+// returned by Response.Timings.
+type Timings struct {
+	// DNS is the time taken to resolve the host name of the remote server.
+	DNS time.Duration
+
+	// Connect is the time taken to establish a connection to the remote
+	// server.
+	Connect time.Duration
+
+	// TLSHandshake is the time taken by the TLS handshake with the remote
+	// server.
+	TLSHandshake time.Duration
+
+	// TTFB is the time to first byte of the last request sent for the
+	// transfer, from the start of the request until the first byte of the
+	// response was received.
+	TTFB time.Duration
+}
+
+// withTrace returns a context that records the timings of a request sent for
+// the given Response, and calls the hooks of Request.ClientTrace, if set.
+func withTrace(ctx context.Context, resp *Response) context.Context {
+	if t := resp.Request.ClientTrace; t != nil {
+		ctx = httptrace.WithClientTrace(ctx, t)
+	}
+	// hooks may be called from different goroutines, so all state is guarded
+	// by the lock of the Response
+	var start, dnsStart, connectStart, tlsStart time.Time
+	record := func(f func(t *Timings)) {
+		resp.timingsMu.Lock()
+		f(&resp.timings)
+		resp.timingsMu.Unlock()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			record(func(*Timings) { start = time.Now() })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			record(func(*Timings) { dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			record(func(t *Timings) { t.DNS = time.Since(dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			record(func(*Timings) { connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			record(func(t *Timings) { t.Connect = time.Since(connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			record(func(*Timings) { tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(func(t *Timings) { t.TLSHandshake = time.Since(tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			record(func(t *Timings) { t.TTFB = time.Since(start) })
+		},
+	})
+}
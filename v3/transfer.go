@@ -3,6 +3,7 @@ package grab
 import (
 	"context"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,47 +12,145 @@ import (
 
 type transfer struct {
 	n     int64 // must be 64bit aligned on 386
+	limit int64 // maximum bytes to copy or -1 if unlimited
 	ctx   context.Context
 	gauge bps.Gauge
 	lim   RateLimiter
 	w     io.Writer
 	r     io.Reader
 	b     []byte
+
+	// interval is the period between samples taken of the transfer progress.
+	interval time.Duration
+
+	// nread is the number of bytes read from the source reader.
+	nread int64
+
+	// total, if not nil, is atomically incremented by the number of bytes read
+	// from the source reader, such as to account for a Client's ByteQuota.
+	total *int64
+
+	// truncate specifies that any data in the source beyond limit is ignored,
+	// rather than causing ErrBadLength.
+	truncate bool
+
+	// readFrom specifies that the copy may be delegated to a destination that
+	// implements io.ReaderFrom.
+	readFrom bool
+
+	// didPause indicates that the transfer was paused since the source reader
+	// was last replaced.
+	didPause bool
+
+	// reconnect, if not nil, returns a new source reader positioned at the
+	// given offset, to replace a connection that was idle while paused.
+	reconnect func(offset int64) (io.Reader, error)
+
+	// retries is the number of times the source reader may still be replaced
+	// after it ends before the expected number of bytes have been read.
+	retries int
+
+	mu     sync.Mutex
+	paused chan struct{} // non-nil while paused and closed on resume
+	first  time.Time     // time at which the first byte was read
 }
 
+// pauseReconnectThreshold is the duration for which a transfer may be paused
+// before the connection to the remote server is assumed to have been dropped
+// and is replaced on resume.
+var pauseReconnectThreshold = 30 * time.Second
+
 func newTransfer(ctx context.Context, lim RateLimiter, dst io.Writer, src io.Reader, buf []byte) *transfer {
 	return &transfer{
+		limit: -1,
 		ctx:   ctx,
 		gauge: bps.NewSMA(6), // five second moving average sampling every second
 		lim:   lim,
 		w:     dst,
 		r:     src,
 		b:     buf,
+
+		interval: time.Second,
 	}
 }
 
+// setInterval sets the period between samples of the transfer progress and
+// resizes the default gauge to keep a five second moving average.
+func (c *transfer) setInterval(d time.Duration) {
+	n := int(1 + (5*time.Second+d-1)/d)
+	if n < 2 {
+		n = 2
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interval = d
+	c.gauge = bps.NewSMA(n)
+}
+
+// setGauge replaces the gauge used to measure the transfer rate.
+func (c *transfer) setGauge(g bps.Gauge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gauge = g
+}
+
+// reset prepares the transfer to copy from the beginning of a new source
+// reader, such as when a transfer is restarted. Unlike replacing the transfer,
+// resetting it is safe while its progress is read by another goroutine.
+func (c *transfer) reset(dst io.Writer, src io.Reader, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.StoreInt64(&c.n, 0)
+	c.limit = -1
+	c.gauge = bps.NewSMA(6)
+	c.interval = time.Second
+	c.w = dst
+	c.r = src
+	c.b = buf
+	c.nread = 0
+	c.didPause = false
+	c.first = time.Time{}
+}
+
 // copy behaves similarly to io.CopyBuffer except that it checks for cancelation
 // of the given context.Context, reports progress in a thread-safe manner and
 // tracks the transfer rate.
+//
+// If a limit is set, copy stops reading once limit bytes have been written and
+// returns ErrBadLength if the source has more data.
+//
+// If readFrom is set, no rate limiter is set and the destination implements
+// io.ReaderFrom, the copy is delegated to the destination and progress is
+// reported as bytes are read from the source.
+//
+// If the context is canceled, copy returns the error of the context rather than
+// the error of the interrupted read.
 func (c *transfer) copy() (written int64, err error) {
 	// maintain a bps gauge in another goroutine
 	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
-	go bps.Watch(ctx, c.gauge, c.N, time.Second)
+	go bps.Watch(ctx, c.gauge, c.N, c.interval)
+	defer func() {
+		if err != nil && !isNoSpace(err) && c.ctx.Err() != nil {
+			err = c.ctx.Err()
+		}
+	}()
+
+	// delegate to the destination
+	if rf, ok := c.w.(io.ReaderFrom); ok && c.readFrom && c.lim == nil {
+		written, err = rf.ReadFrom(countingReader{c})
+		if err != nil && isNoSpace(err) {
+			err = &noSpaceError{err}
+		}
+		return written, err
+	}
 
 	// start the transfer
 	if c.b == nil {
 		c.b = make([]byte, 32*1024)
 	}
 	for {
-		select {
-		case <-c.ctx.Done():
-			err = c.ctx.Err()
-			return
-		default:
-			// keep working
-		}
-		nr, er := c.r.Read(c.b)
+		nr, er := c.read(c.b)
 		if nr > 0 {
 			nw, ew := c.w.Write(c.b[0:nr])
 			if nw > 0 {
@@ -60,6 +159,9 @@ func (c *transfer) copy() (written int64, err error) {
 			}
 			if ew != nil {
 				err = ew
+				if isNoSpace(ew) {
+					err = &noSpaceError{ew}
+				}
 				break
 			}
 			if nr != nw {
@@ -84,6 +186,171 @@ func (c *transfer) copy() (written int64, err error) {
 	return written, err
 }
 
+// read reads from the source reader, checking for cancelation, waiting while
+// the transfer is paused and reconnecting if required. Once limit bytes have
+// been read, read returns io.EOF, or ErrBadLength if the source has more data
+// and truncate is not set.
+func (c *transfer) read(p []byte) (n int, err error) {
+	if err = c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// wait while paused
+	idle, err := c.waitWhilePaused()
+	if err != nil {
+		return 0, err
+	}
+	if idle > 0 && c.reconnect != nil {
+		c.didPause = true
+		if idle >= pauseReconnectThreshold {
+			if err = c.reopen(c.nread); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if c.limit >= 0 {
+		if c.nread == c.limit {
+			if c.truncate {
+				return 0, io.EOF
+			}
+			if err = c.checkEOF(); err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if remaining := c.limit - c.nread; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err = c.r.Read(p)
+	if n > 0 && c.nread == 0 {
+		c.mu.Lock()
+		c.first = time.Now()
+		c.mu.Unlock()
+	}
+	c.nread += int64(n)
+	if c.total != nil && n > 0 {
+		atomic.AddInt64(c.total, int64(n))
+	}
+	if c.isShortRead(err) && c.retries > 0 && c.ctx.Err() == nil {
+		// the connection may have been closed by an intermediary
+		c.retries--
+		c.didPause = false
+		if err = c.reopen(c.nread); err != nil {
+			return n, err
+		}
+		return n, nil
+	}
+	if err != nil && err != io.EOF && c.didPause {
+		// the remote server may have dropped the connection while paused
+		c.didPause = false
+		if err = c.reopen(c.nread); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// isShortRead returns true if the given error of the source reader indicates
+// that it ended before all expected bytes were read.
+func (c *transfer) isShortRead(err error) bool {
+	if c.reconnect == nil {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	return err == io.EOF && c.limit >= 0 && c.nread < c.limit && !c.truncate
+}
+
+// countingReader reads from the source of a transfer, reporting the number of
+// bytes read as the progress of the transfer.
+type countingReader struct {
+	c *transfer
+}
+
+func (r countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.c.read(p)
+	atomic.AddInt64(&r.c.n, int64(n))
+	return n, err
+}
+
+// reopen replaces the source reader with a new connection, positioned at the
+// given offset.
+func (c *transfer) reopen(offset int64) error {
+	r, err := c.reconnect(offset)
+	if err != nil {
+		return err
+	}
+	c.r = r
+	return nil
+}
+
+// pause suspends reading from the source reader until resume is called.
+func (c *transfer) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused == nil {
+		c.paused = make(chan struct{})
+	}
+}
+
+// resume continues a paused transfer.
+func (c *transfer) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused != nil {
+		close(c.paused)
+		c.paused = nil
+	}
+}
+
+// isPaused returns true if the transfer is paused.
+func (c *transfer) isPaused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused != nil
+}
+
+// waitWhilePaused blocks while the transfer is paused and returns the duration
+// for which it blocked.
+func (c *transfer) waitWhilePaused() (time.Duration, error) {
+	c.mu.Lock()
+	paused := c.paused
+	c.mu.Unlock()
+	if paused == nil {
+		return 0, nil
+	}
+	start := time.Now()
+	select {
+	case <-paused:
+		return time.Since(start), nil
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
+
+// checkEOF returns ErrBadLength if the source has any more data to read.
+func (c *transfer) checkEOF() error {
+	var b [1]byte
+	for {
+		n, err := c.r.Read(b[:])
+		if n > 0 {
+			return ErrBadLength
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // N returns the number of bytes transferred.
 func (c *transfer) N() (n int64) {
 	if c == nil {
@@ -93,11 +360,28 @@ func (c *transfer) N() (n int64) {
 	return
 }
 
+// FirstByte returns the time at which the first byte was read from the source,
+// or the zero time if no bytes have been read.
+func (c *transfer) FirstByte() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.first
+}
+
 // BPS returns the current bytes per second transfer rate using a simple moving
 // average.
 func (c *transfer) BPS() (bps float64) {
-	if c == nil || c.gauge == nil {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	g := c.gauge
+	c.mu.Unlock()
+	if g == nil {
 		return 0
 	}
-	return c.gauge.BPS()
+	return g.BPS()
 }
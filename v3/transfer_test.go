@@ -0,0 +1,168 @@
+package grab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestTransferReadFrom tests that transfers delegated to an io.ReaderFrom
+// report progress and respect limits and cancelation.
+func TestTransferReadFrom(t *testing.T) {
+	src := bytes.Repeat([]byte{0xFF}, 1<<20)
+
+	t.Run("Copy", func(t *testing.T) {
+		dst := &bytes.Buffer{}
+		c := newTransfer(context.Background(), nil, dst, bytes.NewReader(src), nil)
+		c.readFrom = true
+		n, err := c.copy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(src)) || c.N() != n || dst.Len() != len(src) {
+			t.Errorf("expected %d bytes, got %d (N: %d, len: %d)",
+				len(src), n, c.N(), dst.Len())
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		c := newTransfer(context.Background(), nil, &bytes.Buffer{}, bytes.NewReader(src), nil)
+		c.readFrom = true
+		c.limit = 1024
+		if _, err := c.copy(); err != ErrBadLength {
+			t.Errorf("expected ErrBadLength, got %v", err)
+		}
+		if c.N() != 1024 {
+			t.Errorf("expected 1024 bytes, got %d", c.N())
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c := newTransfer(ctx, nil, &bytes.Buffer{}, bytes.NewReader(src), nil)
+		c.readFrom = true
+		if _, err := c.copy(); err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+// cancelingReader cancels a context on its first read and fails with an error
+// that is unrelated to the context, as the body of an HTTP response may.
+type cancelingReader struct {
+	cancel context.CancelFunc
+}
+
+func (r cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return 0, errors.New("net/http: request canceled")
+}
+
+// TestTransferCancelError tests that a transfer interrupted by cancelation
+// returns the error of its context, rather than the error of the source.
+func TestTransferCancelError(t *testing.T) {
+	for _, readFrom := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := newTransfer(ctx, nil, &bytes.Buffer{}, cancelingReader{cancel}, nil)
+		c.readFrom = readFrom
+		if _, err := c.copy(); !IsCanceled(err) {
+			t.Errorf("readFrom %v: expected context.Canceled, got %v", readFrom, err)
+		}
+	}
+}
+
+func benchmarkTransfer(b *testing.B, readFrom bool) {
+	src := bytes.Repeat([]byte{0xFF}, 1<<20)
+	dst := &bytes.Buffer{}
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		c := newTransfer(context.Background(), nil, dst, bytes.NewReader(src), nil)
+		c.readFrom = readFrom
+		if _, err := c.copy(); err != nil && err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransferCopy(b *testing.B)     { benchmarkTransfer(b, false) }
+func BenchmarkTransferReadFrom(b *testing.B) { benchmarkTransfer(b, true) }
+
+// benchmarkTransferFile benchmarks writing a large file to disk, as for a
+// transfer that is stored at Request.Filename.
+func benchmarkTransferFile(b *testing.B, readFrom bool) {
+	src := bytes.Repeat([]byte{0xFF}, 16<<20)
+	f, err := ioutil.TempFile("", "grab-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		c := newTransfer(context.Background(), nil, f, bytes.NewReader(src), buf)
+		c.readFrom = readFrom
+		if _, err := c.copy(); err != nil && err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransferFileCopy(b *testing.B)     { benchmarkTransferFile(b, false) }
+func BenchmarkTransferFileReadFrom(b *testing.B) { benchmarkTransferFile(b, true) }
+
+// slowWriter simulates a destination with a fixed cost for each write, such as
+// a slow disk.
+type slowWriter struct {
+	io.Writer
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Microsecond)
+	return w.Writer.Write(p)
+}
+
+// benchmarkTransferWriteBuffer benchmarks reading in small chunks and writing
+// to a slow destination, with writes optionally buffered to the given size as
+// with Request.WriteBufferSize.
+func benchmarkTransferWriteBuffer(b *testing.B, writeBufferSize int) {
+	src := bytes.Repeat([]byte{0xFF}, 1<<20)
+	dst := &bytes.Buffer{}
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		var w io.Writer = slowWriter{dst}
+		var bw *bufio.Writer
+		if writeBufferSize > 0 {
+			bw = bufio.NewWriterSize(w, writeBufferSize)
+			w = bw
+		}
+		c := newTransfer(context.Background(), nil, w, bytes.NewReader(src), buf)
+		if _, err := c.copy(); err != nil && err != io.EOF {
+			b.Fatal(err)
+		}
+		if bw != nil {
+			if err := bw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkTransferUnbufferedWrites(b *testing.B) { benchmarkTransferWriteBuffer(b, 0) }
+func BenchmarkTransferBufferedWrites(b *testing.B)   { benchmarkTransferWriteBuffer(b, 256<<10) }
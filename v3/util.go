@@ -1,14 +1,27 @@
 package grab
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // setLastModified sets the last modified timestamp of a local file according to
@@ -20,14 +33,43 @@ func setLastModified(resp *http.Response, filename string) error {
 	if header == "" {
 		return nil
 	}
-	lastmod, err := time.Parse(http.TimeFormat, header)
-	if err != nil {
+	lastmod, ok := parseHTTPTime(header)
+	if !ok {
+		// leave the local timestamp alone
 		return nil
 	}
 	return os.Chtimes(filename, lastmod, lastmod)
 }
 
+// parseHTTPTime parses a timestamp from a HTTP header in any of the formats
+// permitted by RFC 7231 (RFC 1123, RFC 850 and ANSI C asctime), or in RFC 1123
+// format with a numeric or non-GMT zone, as sent by some servers. The returned
+// time is in UTC.
+func parseHTTPTime(s string) (time.Time, bool) {
+	t, err := http.ParseTime(s)
+	if err != nil {
+		for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+			if t, err = time.Parse(layout, s); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil || t.IsZero() {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// isModifiedSince returns true if the Last-Modified header of the given
+// response is later than t.
+func isModifiedSince(resp *http.Response, t time.Time) bool {
+	lastmod, ok := parseHTTPTime(resp.Header.Get("Last-Modified"))
+	return ok && lastmod.After(t.Truncate(time.Second))
+}
+
 // mkdirp creates all missing parent directories for the destination file path.
+// An error matching ErrBadDestination is returned if the parent path is a file
+// or if permission to create a directory is denied.
 func mkdirp(path string) error {
 	dir := filepath.Dir(path)
 	if fi, err := os.Stat(dir); err != nil {
@@ -35,14 +77,140 @@ func mkdirp(path string) error {
 			return fmt.Errorf("error checking destination directory: %v", err)
 		}
 		if err := os.MkdirAll(dir, 0777); err != nil {
+			if os.IsPermission(err) {
+				return &badDestinationError{err}
+			}
 			return fmt.Errorf("error creating destination directory: %v", err)
 		}
 	} else if !fi.IsDir() {
-		panic("grab: developer error: destination path is not directory")
+		return &badDestinationError{&os.PathError{
+			Op:   "mkdir",
+			Path: dir,
+			Err:  errors.New("not a directory"),
+		}}
+	}
+	return nil
+}
+
+// checkDestination returns an error matching ErrBadDestination if the given
+// destination file path names a directory, or if the nearest existing ancestor
+// of the path is not a directory. This allows a transfer to fail before any
+// requests are sent to the remote server. Permissions are not checked, as
+// nothing is written to the directory until the destination is opened.
+func checkDestination(filename string) error {
+	fi, err := os.Stat(filename)
+	if err == nil && fi.IsDir() {
+		return &badDestinationError{&os.PathError{
+			Op:   "open",
+			Path: filename,
+			Err:  errors.New("is a directory"),
+		}}
+	}
+
+	// find the nearest existing directory
+	dir := filepath.Dir(filename)
+	for {
+		fi, err = os.Stat(dir)
+		if err == nil || !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	if err != nil {
+		return &badDestinationError{err}
+	}
+	if !fi.IsDir() {
+		return &badDestinationError{&os.PathError{
+			Op:   "mkdir",
+			Path: dir,
+			Err:  errors.New("not a directory"),
+		}}
 	}
 	return nil
 }
 
+// checkSymlink returns ErrSymlinkDestination if the given path is a symbolic
+// link, unless it links to a directory. Any other error is left to the caller
+// to detect when the path is used.
+func checkSymlink(name string) error {
+	fi, err := os.Lstat(name)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		return nil
+	}
+	return ErrSymlinkDestination
+}
+
+// createUnique creates and opens a new file at the given path, or if it already
+// exists, at the first path derived from it by appending " (1)", " (2)", etc.
+// before the file extension that does not exist.
+func createUnique(filename string, flag int) (*os.File, error) {
+	ext := filepath.Ext(filename)
+	if ext == filepath.Base(filename) {
+		// dot file with no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(filename, ext)
+	name := filename
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, flag|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// sameContents returns true if the files at the given paths have identical
+// contents.
+func sameContents(name1, name2 string) (bool, error) {
+	f1, err := os.Open(name1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(name2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+	fi1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi1.Size() != fi2.Size() {
+		return false, nil
+	}
+	b1 := make([]byte, 32*1024)
+	b2 := make([]byte, 32*1024)
+	for {
+		n1, err1 := io.ReadFull(f1, b1)
+		n2, err2 := io.ReadFull(f2, b2)
+		if !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// maxFilenameLength is the maximum length in bytes of a filename resolved from
+// a server response, which is the limit of most file systems.
+const maxFilenameLength = 255
+
 // guessFilename returns a filename for the given http.Response. If none can be
 // determined ErrNoFilename is returned.
 //
@@ -50,11 +218,9 @@ func mkdirp(path string) error {
 func guessFilename(resp *http.Response) (string, error) {
 	filename := resp.Request.URL.Path
 	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
-		if _, params, err := mime.ParseMediaType(cd); err == nil {
-			if val, ok := params["filename"]; ok {
-				filename = val
-			} // else filename directive is missing.. fallback to URL.Path
-		}
+		if val, ok := contentDispositionFilename(cd); ok {
+			filename = val
+		} // else filename directive is missing.. fallback to URL.Path
 	}
 
 	// sanitize
@@ -63,9 +229,259 @@ func guessFilename(resp *http.Response) (string, error) {
 	}
 
 	filename = filepath.Base(path.Clean("/" + filename))
-	if filename == "" || filename == "." || filename == "/" {
+	if filename == "" || filename == "." || filename == "/" || len(filename) > maxFilenameLength {
 		return "", ErrNoFilename
 	}
 
 	return filename, nil
 }
+
+// contentDispositionFilename returns the filename parameter of the given
+// Content-Disposition header value. An RFC 5987 extended filename* parameter is
+// preferred over the plain filename parameter if it can be decoded.
+func contentDispositionFilename(cd string) (string, bool) {
+	if _, _, err := mime.ParseMediaType(cd); err != nil {
+		return "", false
+	}
+
+	// mime.ParseMediaType decodes filename* itself but does not fall back to
+	// the plain filename if the extended value is malformed, so any filename*
+	// parameters are handled here and removed before parsing the remainder.
+	params := strings.Split(cd, ";")
+	plain := params[:1]
+	for _, param := range params[1:] {
+		i := strings.Index(param, "=")
+		if i < 0 || strings.ToLower(strings.TrimSpace(param[:i])) != "filename*" {
+			plain = append(plain, param)
+			continue
+		}
+		if val, ok := decodeExtValue(strings.TrimSpace(param[i+1:])); ok {
+			return val, true
+		}
+	}
+	_, p, err := mime.ParseMediaType(strings.Join(plain, ";"))
+	if err != nil {
+		return "", false
+	}
+	val, ok := p["filename"]
+	return val, ok
+}
+
+// decodeExtValue decodes an RFC 5987 ext-value of the form
+// charset'[language]'value-chars. Only the UTF-8 and ISO-8859-1 charsets are
+// supported.
+func decodeExtValue(s string) (string, bool) {
+	parts := strings.SplitN(s, "'", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	b, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parts[0]) {
+	case "utf-8", "us-ascii":
+		if !utf8.ValidString(b) {
+			return "", false
+		}
+		return b, true
+
+	case "iso-8859-1":
+		r := make([]rune, len(b))
+		for i := 0; i < len(b); i++ {
+			r[i] = rune(b[i])
+		}
+		return string(r), true
+	}
+	return "", false
+}
+
+// preferredExtensions maps media types with several registered extensions to
+// the most common one.
+var preferredExtensions = map[string]string{
+	"application/javascript": ".js",
+	"application/xml":        ".xml",
+	"audio/mpeg":             ".mp3",
+	"image/jpeg":             ".jpg",
+	"image/tiff":             ".tiff",
+	"text/html":              ".html",
+	"text/javascript":        ".js",
+	"text/plain":             ".txt",
+	"text/xml":               ".xml",
+	"video/mpeg":             ".mpeg",
+}
+
+// extensionByType returns the file extension for the given Content-Type, or an
+// empty string if the type is unknown or has no specific extension.
+func extensionByType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// matchContentType returns true if the media type of the given Content-Type
+// header value matches any of the given types, which may end with a wildcard
+// subtype such as "image/*".
+func matchContentType(contentType string, types []string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediatype || t == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediatype, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSizeHeader returns the size in bytes given in a header value, or -1 if
+// it is not a valid size.
+func parseSizeHeader(value string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// parseContentRange parses a Content-Range header such as "bytes 0-499/1234",
+// returning a total of -1 if the size of the remote file is given as "*".
+func parseContentRange(cr string) (start, end, total int64, ok bool) {
+	var size string
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, 0, 0, false
+	}
+	if size == "*" {
+		return start, end, -1, true
+	}
+	if total, err := strconv.ParseInt(size, 10, 64); err == nil {
+		return start, end, total, true
+	}
+	return 0, 0, 0, false
+}
+
+// isHeadRejected returns true if the given status code, in response to a HEAD
+// request, indicates that the remote server does not allow HEAD requests for
+// the resource rather than that the resource is unavailable.
+func isHeadRejected(code int) bool {
+	switch code {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// isExpiredSignature returns true if the given http.Response indicates that the
+// signature of a pre-signed URL has expired. S3 and Google Cloud Storage both
+// respond with 403 Forbidden and an XML error document describing the cause.
+//
+// The response body is left intact for subsequent readers.
+func isExpiredSignature(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden || resp.Body == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	b = bytes.ToLower(b)
+	return bytes.Contains(b, []byte("request has expired")) ||
+		bytes.Contains(b, []byte("expiredtoken"))
+}
+
+// isAllowedHost returns true if the host of u is the given host or matches one
+// of the given hosts. Hosts given without a port match any port.
+func isAllowedHost(u *url.URL, host string, hosts []string) bool {
+	if strings.EqualFold(u.Host, host) {
+		return true
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(u.Host, h) || strings.EqualFold(u.Hostname(), h) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseContentMD5 returns the MD5 checksum of a remote file, given in the
+// Content-MD5 header or the ETag of the given response headers, or nil if none
+// is given. The Content-MD5 header of a partial response is ignored, as it
+// describes only the range that was sent.
+func parseContentMD5(header http.Header, partial bool) []byte {
+	if v := header.Get("Content-MD5"); v != "" && !partial {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err == nil && len(sum) == md5.Size {
+			return sum
+		}
+	}
+	etag := strings.TrimSpace(header.Get("ETag"))
+	if strings.HasPrefix(etag, "W/") || strings.Contains(etag, "-") {
+		// weak or multipart ETags are not the MD5 checksum of the content
+		return nil
+	}
+	sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+	return sum
+}
+
+// parseDigest returns a new hash and the expected checksum from the first
+// supported algorithm found in the given Digest header values, as described in
+// RFC 3230. If no supported and valid digest is found, a nil hash is returned.
+func parseDigest(values []string) (hash.Hash, []byte) {
+	for _, value := range values {
+		for _, digest := range strings.Split(value, ",") {
+			i := strings.Index(digest, "=")
+			if i < 0 {
+				continue
+			}
+			var h hash.Hash
+			switch strings.ToLower(strings.TrimSpace(digest[:i])) {
+			case "sha-256":
+				h = sha256.New()
+			case "sha-512":
+				h = sha512.New()
+			default:
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(digest[i+1:]))
+			if err != nil || len(sum) != h.Size() {
+				continue
+			}
+			return h, sum
+		}
+	}
+	return nil, nil
+}
+
+// decodeChecksum decodes a hex or base64 encoded checksum of the given size,
+// as sent in a checksum trailer.
+func decodeChecksum(value string, size int) ([]byte, bool) {
+	value = strings.TrimSpace(value)
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == size {
+		return sum, true
+	}
+	if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == size {
+		return sum, true
+	}
+	return nil, false
+}
@@ -2,9 +2,14 @@ package grab
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestURLFilenames(t *testing.T) {
@@ -121,6 +126,7 @@ func TestHeaderFilenames(t *testing.T) {
 			"filename/",
 			"filename//",
 			"filename/..",
+			strings.Repeat("f", maxFilenameLength+1),
 		}
 
 		for _, tc := range testCases {
@@ -165,3 +171,128 @@ func TestHeaderWithMissingDirective(t *testing.T) {
 		}
 	})
 }
+
+func TestHeaderExtendedFilenames(t *testing.T) {
+	u, _ := url.ParseRequestURI("http://test.com/badfilename")
+	resp := &http.Response{
+		Request: &http.Request{
+			URL: u,
+		},
+		Header: http.Header{},
+	}
+
+	testCases := []struct {
+		Header string
+		Expect string
+	}{
+		{`attachment; filename*=UTF-8''file%20with%20spaces.txt`, "file with spaces.txt"},
+		{`attachment; filename*=utf-8'en'na%C3%AFve%20r%C3%A9sum%C3%A9.pdf`, "naïve résumé.pdf"},
+		{`attachment; filename*=UTF-8''%E6%97%A5%E6%9C%AC%E8%AA%9E.txt`, "日本語.txt"},
+		{`attachment; filename*=ISO-8859-1''caf%E9.txt`, "café.txt"},
+		{`attachment; filename="plain.txt"; filename*=UTF-8''%E2%82%AC%20rates.txt`, "€ rates.txt"},
+		{`attachment; filename*=UTF-8''%E2%82%AC%20rates.txt; filename="plain.txt"`, "€ rates.txt"},
+		{`attachment; filename="plain.txt"; filename*=UTF-8''bad%ZZ.txt`, "plain.txt"},
+		{`attachment; filename="plain.txt"; filename*=UTF-8''%FF.txt`, "plain.txt"},
+		{`attachment; filename="plain.txt"; filename*=KOI8-R''%C1.txt`, "plain.txt"},
+		{`attachment; filename="plain.txt"; filename*=no-quotes.txt`, "plain.txt"},
+		{`attachment; filename*=UTF-8''..%2F..%2Fpath%2Ffilename`, "filename"},
+		{`attachment; filename*=garbage`, "badfilename"},
+	}
+
+	for _, tc := range testCases {
+		resp.Header.Set("Content-Disposition", tc.Header)
+		actual, err := guessFilename(resp)
+		if err != nil {
+			t.Errorf("error (%v): %v", tc.Header, err)
+		}
+		if actual != tc.Expect {
+			t.Errorf("expected '%v' (%v), got '%v'", tc.Expect, tc.Header, actual)
+		}
+	}
+}
+
+func TestSetLastModified(t *testing.T) {
+	filename := ".testSetLastModified"
+	if err := ioutil.WriteFile(filename, []byte("test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	original := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	expect := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+	testCases := []struct {
+		Header string
+		Expect time.Time
+	}{
+		{"Sun, 06 Nov 1994 08:49:37 GMT", expect},   // RFC 1123
+		{"Sun, 06 Nov 1994 09:49:37 +0100", expect}, // RFC 1123 with numeric zone
+		{"Sunday, 06-Nov-94 08:49:37 GMT", expect},  // RFC 850
+		{"Sun Nov  6 08:49:37 1994", expect},        // ANSI C asctime
+		{"06/11/1994 08:49:37", original},           // malformed
+		{"Mon, 01 Jan 0001 00:00:00 GMT", original}, // zero
+		{"", original},
+	}
+
+	for _, tc := range testCases {
+		if err := os.Chtimes(filename, original, original); err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Last-Modified", tc.Header)
+		if err := setLastModified(resp, filename); err != nil {
+			t.Errorf("error (%v): %v", tc.Header, err)
+			continue
+		}
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(tc.Expect) {
+			t.Errorf("expected modification time %v for '%s', got %v", tc.Expect, tc.Header, fi.ModTime())
+		}
+	}
+}
+
+func TestMkdirp(t *testing.T) {
+	dir := ".testMkdirp"
+	defer os.RemoveAll(dir)
+
+	// create missing directories
+	filename := filepath.Join(dir, "a", "b", "file")
+	if err := mkdirp(filename); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Dir(filename)); err != nil || !fi.IsDir() {
+		t.Fatalf("expected directory to be created, got: %v", err)
+	}
+
+	// parent path is a file
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err := mkdirp(filepath.Join(dir, "file", "file"))
+	if !IsBadDestination(err) {
+		t.Errorf("expected ErrBadDestination, got: %v", err)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		Header            string
+		Start, End, Total int64
+		OK                bool
+	}{
+		{"bytes 0-499/1234", 0, 499, 1234, true},
+		{"bytes 500-1233/*", 500, 1233, -1, true},
+		{"bytes */1234", 0, 0, 0, false},
+		{"bytes 0-499/abc", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, total, ok := parseContentRange(test.Header)
+		if start != test.Start || end != test.End || total != test.Total || ok != test.OK {
+			t.Errorf("%q: expected %d-%d/%d (%v), got %d-%d/%d (%v)",
+				test.Header, test.Start, test.End, test.Total, test.OK, start, end, total, ok)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package grab
+
+import "io"
+
+// Verifier is an interface that may be satisfied to validate the content of a
+// downloaded file, for example, by checking a detached signature.
+//
+// See MinisignVerifier for an implementation that validates minisign
+// signatures.
+type Verifier interface {
+	// Verify reads the downloaded file from the given reader and returns a
+	// non-nil error if it fails validation.
+	Verify(file io.Reader) error
+}